@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	collector "llm-collector/internal/collector"
@@ -10,13 +15,47 @@ import (
 
 func main() {
 	addr := ":" + collector.Getenv("PORT", "8081")
-	outPath := collector.Getenv("EVENT_LOG_PATH", "")
+	cfg := collector.Config{
+		EventLogPath:     collector.Getenv("EVENT_LOG_PATH", ""),
+		KeyHMACSecret:    collector.Getenv("GATEWAY_KEY_HMAC_SECRET", ""),
+		RejectRawAppKeys: envBool("REJECT_RAW_APP_KEYS"),
+		MaxBatchBytes:    envInt("BATCH_MAX_BYTES"),
+		RotateMaxBytes:   envInt("EVENT_LOG_MAX_BYTES"),
+		RotateInterval:   envDuration("EVENT_LOG_ROTATE_INTERVAL", 0),
+		RotateName:       collector.Getenv("EVENT_LOG_ROTATE_NAME", ""),
+		RotateCompress:   collector.Getenv("EVENT_LOG_COMPRESS", ""),
+		RetainCount:      int(envInt("EVENT_LOG_RETAIN_COUNT")),
+		RetainAge:        envDuration("EVENT_LOG_RETAIN_AGE", 0),
+		AdminToken:       collector.Getenv("COLLECTOR_ADMIN_TOKEN", ""),
+	}
+
+	if path := collector.Getenv("EVENT_DB_PATH", ""); path != "" {
+		sink, err := collector.OpenSQLiteSink(path)
+		if err != nil {
+			log.Fatalf("collector: %v", err)
+		}
+		cfg.Sinks = append(cfg.Sinks, sink)
+		log.Printf("collector: storing events in %s", path)
+	}
 
-	s, err := collector.NewServer(outPath)
+	readinessDelay := envDuration("SHUTDOWN_READINESS_DELAY", 5*time.Second)
+	gracePeriod := envDuration("SHUTDOWN_GRACE_PERIOD", 20*time.Second)
+
+	s, err := collector.NewServerWithConfig(cfg)
 	if err != nil {
-		log.Fatalf("open log file: %v", err)
+		log.Fatalf("collector: %v", err)
 	}
-	defer s.Close()
+
+	// SIGHUP rotates the event log, e.g. from logrotate's postrotate
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := s.Rotate(); err != nil {
+				log.Printf("collector: rotating event log: %v", err)
+			}
+		}
+	}()
 
 	log.Printf("collector listening on %s", addr)
 
@@ -26,5 +65,66 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		s.Close()
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal terminates immediately
+
+	log.Printf("shutdown: draining for %s", readinessDelay)
+	s.StartDrain()
+	time.Sleep(readinessDelay)
+
+	graceCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if err := srv.Shutdown(graceCtx); err != nil {
+		log.Printf("shutdown: grace period over; closing remaining connections")
+		_ = srv.Close()
+	}
+	s.Close()
+	log.Printf("shutdown: done")
+}
+
+// envInt parses a non-negative integer; unset means 0.
+func envInt(key string) int64 {
+	v := collector.Getenv(key, "")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("config error: invalid %s %q", key, v)
+	}
+	return n
+}
+
+// envBool parses a boolean as strconv.ParseBool does; unset means false.
+func envBool(key string) bool {
+	v := collector.Getenv(key, "")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("config error: invalid %s %q", key, v)
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := collector.Getenv(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("config error: invalid %s %q", key, v)
+	}
+	return d
 }
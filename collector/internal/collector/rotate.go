@@ -0,0 +1,312 @@
+package collector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultRotateName names rotated event logs: events.ndjson becomes
+// events-20240102T150405Z.ndjson.
+const DefaultRotateName = "{name}-{time}{ext}"
+
+// rotateTimeFormat sorts lexically in time order.
+const rotateTimeFormat = "20060102T150405Z"
+
+var errNoEventLog = errors.New("no event log configured")
+
+// withRotateDefaults validates the rotation settings and fills in defaults.
+func withRotateDefaults(cfg Config) (Config, error) {
+	if cfg.RotateName == "" {
+		cfg.RotateName = DefaultRotateName
+	}
+	if !strings.Contains(cfg.RotateName, "{time}") {
+		return cfg, fmt.Errorf("rotate name %q must contain {time}", cfg.RotateName)
+	}
+	if strings.ContainsRune(cfg.RotateName, filepath.Separator) {
+		return cfg, fmt.Errorf("rotate name %q must not contain a path separator", cfg.RotateName)
+	}
+	switch cfg.RotateCompress {
+	case "", "gzip", "zstd":
+	case "none":
+		cfg.RotateCompress = ""
+	default:
+		return cfg, fmt.Errorf("unknown compression %q (want gzip, zstd or none)", cfg.RotateCompress)
+	}
+	return cfg, nil
+}
+
+// openLocked opens the event log for appending. s.mu must be held.
+func (s *Server) openLocked() error {
+	f, err := os.OpenFile(s.cfg.EventLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriterSize(f, 1<<20)
+	s.size = st.Size()
+	s.openedAt = time.Now()
+	return nil
+}
+
+// Rotate closes the event log, renames it per RotateName and opens a new
+// one. It returns the rotated path, or "" if the log was empty. Compression
+// and pruning of old logs run in the background.
+func (s *Server) Rotate() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotateLocked()
+}
+
+// rotateLocked rotates the event log under s.mu, so no line is split across
+// files. If the log cannot be reopened, events go to stdout.
+func (s *Server) rotateLocked() (string, error) {
+	if s.file == nil {
+		return "", errNoEventLog
+	}
+	if s.size == 0 {
+		return "", nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return "", err
+	}
+	_ = s.file.Close()
+	s.w, s.file = nil, nil
+
+	dst := s.rotatedPath(time.Now())
+	renameErr := os.Rename(s.cfg.EventLogPath, dst)
+	if err := s.openLocked(); err != nil {
+		log.Printf("collector: cannot reopen event log (events go to stdout): %v", err)
+		return "", err
+	}
+	if renameErr != nil {
+		return "", renameErr
+	}
+	log.Printf("collector: rotated event log to %s", dst)
+
+	s.bg.Add(1)
+	go func() {
+		defer s.bg.Done()
+		s.finishRotation(dst)
+	}()
+	return dst, nil
+}
+
+// rotatedPath expands RotateName next to the event log. A name that is
+// already taken gets a -1, -2, … suffix after the time.
+func (s *Server) rotatedPath(now time.Time) string {
+	dir, base := filepath.Split(s.cfg.EventLogPath)
+	ext := filepath.Ext(base)
+	r := strings.NewReplacer("{name}", strings.TrimSuffix(base, ext), "{ext}", ext)
+	pattern := r.Replace(s.cfg.RotateName)
+	ts := now.UTC().Format(rotateTimeFormat)
+	for i := 0; ; i++ {
+		t := ts
+		if i > 0 {
+			t = fmt.Sprintf("%s-%d", ts, i)
+		}
+		p := filepath.Join(dir, strings.ReplaceAll(pattern, "{time}", t))
+		if !exists(p) && !exists(p+".gz") && !exists(p+".zst") {
+			return p
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// finishRotation compresses a rotated log and prunes old ones. Rotations
+// are finished one at a time.
+func (s *Server) finishRotation(path string) {
+	s.post.Lock()
+	defer s.post.Unlock()
+
+	if s.cfg.RotateCompress != "" {
+		if err := compressFile(path, s.cfg.RotateCompress); err != nil {
+			log.Printf("collector: compressing %s: %v", path, err)
+		}
+	}
+	s.prune()
+}
+
+// compressFile replaces path with path.gz or path.zst. The compressed file
+// keeps the modification time of the original.
+func compressFile(path, format string) (err error) {
+	dst := path + ".gz"
+	if format == "zstd" {
+		dst = path + ".zst"
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	var zw io.WriteCloser
+	if format == "zstd" {
+		if zw, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	} else {
+		zw = gzip.NewWriter(out)
+	}
+	if _, err = io.Copy(zw, src); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	_ = os.Chtimes(tmp, st.ModTime(), st.ModTime())
+	if err = os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune deletes rotated logs beyond RetainCount or older than RetainAge.
+func (s *Server) prune() {
+	if s.cfg.RetainCount <= 0 && s.cfg.RetainAge <= 0 {
+		return
+	}
+	files, err := s.rotatedLogs()
+	if err != nil {
+		log.Printf("collector: listing rotated logs: %v", err)
+		return
+	}
+	for i, f := range files {
+		tooMany := s.cfg.RetainCount > 0 && i >= s.cfg.RetainCount
+		tooOld := s.cfg.RetainAge > 0 && time.Since(f.mod) > s.cfg.RetainAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("collector: pruning %s: %v", f.path, err)
+			continue
+		}
+		log.Printf("collector: pruned %s", f.path)
+	}
+}
+
+type rotatedLog struct {
+	path string
+	mod  time.Time
+}
+
+// rotatedLogs lists the rotated event logs, newest first.
+func (s *Server) rotatedLogs() ([]rotatedLog, error) {
+	dir, base := filepath.Split(s.cfg.EventLogPath)
+	ext := filepath.Ext(base)
+	r := strings.NewReplacer("{name}", strings.TrimSuffix(base, ext), "{ext}", ext, "{time}", "*")
+	matches, err := filepath.Glob(filepath.Join(dir, r.Replace(s.cfg.RotateName)) + "*")
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedLog
+	for _, m := range matches {
+		if m == filepath.Clean(s.cfg.EventLogPath) || strings.HasSuffix(m, ".tmp") {
+			continue
+		}
+		st, err := os.Stat(m)
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, rotatedLog{path: m, mod: st.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].mod.Equal(files[j].mod) {
+			return files[i].mod.After(files[j].mod)
+		}
+		return files[i].path > files[j].path
+	})
+	return files, nil
+}
+
+// rotateLoop rotates the event log every RotateInterval after it was
+// opened. Empty logs are not rotated.
+func (s *Server) rotateLoop() {
+	defer s.bg.Done()
+	t := time.NewTimer(s.cfg.RotateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		if s.file != nil && time.Since(s.openedAt) >= s.cfg.RotateInterval {
+			if _, err := s.rotateLocked(); err != nil {
+				log.Printf("collector: rotating event log: %v", err)
+			}
+			if s.size == 0 {
+				s.openedAt = time.Now()
+			}
+		}
+		next := s.cfg.RotateInterval - time.Since(s.openedAt)
+		s.mu.Unlock()
+		t.Reset(max(next, time.Second))
+	}
+}
+
+// handleRotate serves POST /admin/rotate, authenticated with
+// COLLECTOR_ADMIN_TOKEN.
+func (s *Server) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path, err := s.Rotate()
+	if err != nil {
+		http.Error(w, "rotate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"rotated": path})
+}
@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// readLog returns the event lines of a plain, .gz or .zst log.
+func readLog(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r := io.Reader(f)
+	switch filepath.Ext(path) {
+	case ".gz":
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		r = zr
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		require.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	}
+	var lines []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	require.NoError(t, sc.Err())
+	return lines
+}
+
+func TestRotate_BySizeKeepsLinesWhole(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "events.ndjson")
+	s, err := NewServerWithConfig(Config{EventLogPath: out, RotateMaxBytes: 300, RotateCompress: "gzip"})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, http.StatusAccepted, postEvent(t, s, MeteringEvent{RequestID: fmt.Sprintf("req_%d", i)}).Code)
+	}
+	s.Close()
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "events-*.ndjson.gz"))
+	require.NoError(t, err)
+	require.NotEmpty(t, rotated)
+	tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	require.Empty(t, tmp)
+
+	seen := map[string]bool{}
+	for _, p := range append(rotated, out) {
+		st, err := os.Stat(p)
+		require.NoError(t, err)
+		if !strings.HasSuffix(p, ".gz") {
+			require.LessOrEqual(t, st.Size(), int64(300))
+		}
+		for _, line := range readLog(t, p) {
+			require.True(t, strings.HasPrefix(line, `{"request_id":"req_`) && strings.HasSuffix(line, "}"), line)
+			seen[line[:strings.Index(line, ",")]] = true
+		}
+	}
+	require.Len(t, seen, 10)
+}
+
+func TestRotate_ManualCompressAndRetain(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "events.ndjson")
+	s, err := NewServerWithConfig(Config{
+		EventLogPath:   out,
+		RotateName:     "{name}{ext}.{time}",
+		RotateCompress: "zstd",
+		RetainCount:    2,
+		AdminToken:     "adm1n",
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// an empty log is not rotated
+	path, err := s.Rotate()
+	require.NoError(t, err)
+	require.Empty(t, path)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		postEvent(t, s, MeteringEvent{RequestID: fmt.Sprintf("req_%d", i)})
+		path, err := s.Rotate()
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(filepath.Base(path), "events.ndjson.20"), path)
+		paths = append(paths, path)
+	}
+	s.bg.Wait()
+
+	// the oldest of the three was pruned, the others compressed
+	require.NoFileExists(t, paths[0])
+	require.NoFileExists(t, paths[0]+".zst")
+	require.Equal(t, []string{`req_1`}, requestIDs(readLog(t, paths[1]+".zst")))
+	require.Equal(t, []string{`req_2`}, requestIDs(readLog(t, paths[2]+".zst")))
+	st, err := os.Stat(out)
+	require.NoError(t, err)
+	require.Zero(t, st.Size())
+
+	mux := s.Mux()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/rotate", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	postEvent(t, s, MeteringEvent{RequestID: "req_3"})
+	req := httptest.NewRequest(http.MethodPost, "/admin/rotate", nil)
+	req.Header.Set("Authorization", "Bearer adm1n")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"rotated":"`+filepath.Join(dir, "events.ndjson.20"))
+}
+
+func TestRotate_ByInterval(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "events.ndjson")
+	s, err := NewServerWithConfig(Config{EventLogPath: out, RotateInterval: 50 * time.Millisecond, RetainAge: time.Hour})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// rotated logs past the retention age are pruned
+	old := filepath.Join(dir, "events-20000101T000000Z.ndjson")
+	require.NoError(t, os.WriteFile(old, []byte("{}\n"), 0o644))
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+	postEvent(t, s, MeteringEvent{RequestID: "req_1"})
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.size == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(old)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	rotated, err := filepath.Glob(filepath.Join(dir, "events-*.ndjson"))
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+}
+
+func TestRotate_InvalidConfig(t *testing.T) {
+	_, err := NewServerWithConfig(Config{RotateName: "{name}.old"})
+	require.ErrorContains(t, err, "{time}")
+	_, err = NewServerWithConfig(Config{RotateCompress: "xz"})
+	require.ErrorContains(t, err, "unknown compression")
+
+	s, err := NewServer("")
+	require.NoError(t, err)
+	_, err = s.Rotate()
+	require.ErrorIs(t, err, errNoEventLog)
+}
+
+func requestIDs(lines []string) []string {
+	var ids []string
+	for _, l := range lines {
+		l = strings.TrimPrefix(l, `{"request_id":"`)
+		ids = append(ids, l[:strings.Index(l, `"`)])
+	}
+	return ids
+}
@@ -2,50 +2,100 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	mu   sync.Mutex
-	file *os.File
-	w    *bufio.Writer
+	cfg Config
+
+	draining atomic.Bool
+
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	bg       sync.WaitGroup // rotation loop, compression and pruning
+	post     sync.Mutex     // serializes finishRotation
 }
 
 // NewServer creates a server. If outPath is empty, events are printed to stdout.
 func NewServer(outPath string) (*Server, error) {
-	s := &Server{}
+	return NewServerWithConfig(Config{EventLogPath: outPath})
+}
+
+func NewServerWithConfig(cfg Config) (*Server, error) {
+	cfg, err := withRotateDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: cfg, stop: make(chan struct{})}
+	outPath := cfg.EventLogPath
 	if outPath == "" {
-		log.Printf("collector: EVENT_LOG_PATH not set; events will be printed to stdout")
+		if len(cfg.Sinks) == 0 {
+			log.Printf("collector: EVENT_LOG_PATH not set; events will be printed to stdout")
+		}
 		return s, nil
 	}
 
-	f, err := os.OpenFile(outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
+	if err := s.openLocked(); err != nil {
 		return nil, err
 	}
-
-	s.file = f
-	s.w = bufio.NewWriterSize(f, 1<<20)
+	if cfg.RotateInterval > 0 {
+		s.bg.Add(1)
+		go s.rotateLoop()
+	}
 	log.Printf("collector: writing events to %s", outPath)
 	return s, nil
 }
 
-// Close flushes and closes the underlying file if configured.
+// StartDrain makes /readyz fail so that no new events are routed here.
+func (s *Server) StartDrain() {
+	s.draining.Store(true)
+}
+
+// Close flushes and closes the underlying file if configured, waits for
+// rotated logs to be compressed and closes the sinks. Events arriving
+// afterwards are printed to stdout.
 func (s *Server) Close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	first := false
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		first = true
+	})
 
+	s.mu.Lock()
 	if s.w != nil {
 		_ = s.w.Flush()
 	}
 	if s.file != nil {
 		_ = s.file.Close()
 	}
+	s.w, s.file = nil, nil
+	s.mu.Unlock()
+
+	s.bg.Wait()
+	if !first {
+		return
+	}
+	for _, sink := range s.cfg.Sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("collector: closing sink: %v", err)
+		}
+	}
 }
 
 func (s *Server) Mux() *http.ServeMux {
@@ -54,7 +104,19 @@ func (s *Server) Mux() *http.ServeMux {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if s.draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
 	mux.HandleFunc("/events", s.HandleEvents)
+	mux.HandleFunc("/events/batch", s.HandleEventBatch)
+	if s.cfg.AdminToken != "" {
+		mux.HandleFunc("/admin/rotate", s.handleRotate)
+	}
 	return mux
 }
 
@@ -64,39 +126,165 @@ func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ev, err := s.decodeEvent(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.write([]MeteringEvent{ev}); err != nil {
+		log.Printf("collector: storing event: %v", err)
+		http.Error(w, "cannot store event", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("accepted"))
+}
+
+// HandleEventBatch accepts NDJSON, optionally gzip-compressed, with one
+// event per line. Each line is validated on its own: valid events are
+// written and the response lists the rejected lines.
+func (s *Server) HandleEventBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	limit := s.cfg.MaxBatchBytes
+	if limit <= 0 {
+		limit = DefaultMaxBatchBytes
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > limit {
+		http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var (
+		res    BatchResponse
+		events []MeteringEvent
+	)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		ev, err := s.decodeEvent(bytes.NewReader(line))
+		if err != nil {
+			res.Rejected = append(res.Rejected, RejectedEvent{Line: i + 1, Error: err.Error()})
+			continue
+		}
+		events = append(events, ev)
+	}
+	if err := s.write(events); err != nil {
+		log.Printf("collector: storing %d events: %v", len(events), err)
+		http.Error(w, "cannot store events", http.StatusServiceUnavailable)
+		return
+	}
+	res.Accepted = len(events)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// decodeEvent validates and normalizes one event.
+func (s *Server) decodeEvent(r io.Reader) (MeteringEvent, error) {
 	var ev MeteringEvent
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(r)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&ev); err != nil {
-		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
-		return
+		return ev, errors.New("invalid json: " + err.Error())
 	}
 
 	if ev.RequestID == "" {
-		http.Error(w, "missing request_id", http.StatusBadRequest)
-		return
+		return ev, errors.New("missing request_id")
 	}
 	if ev.At.IsZero() {
 		ev.At = time.Now().UTC()
 	}
+	if err := s.normalizeAppKey(&ev); err != nil {
+		return ev, err
+	}
+	return ev, nil
+}
 
-	b, err := json.Marshal(ev)
-	if err != nil {
-		http.Error(w, "failed to marshal", http.StatusInternalServerError)
-		return
+// write stores events in the sinks, then appends them to the event log with
+// one flush. When a sink fails, nothing is logged and the sender retries.
+// Without an event log, events are printed to stdout unless a sink stored
+// them.
+func (s *Server) write(events []MeteringEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	lines := make([][]byte, len(events))
+	for i, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		lines[i] = b
+	}
+	for _, sink := range s.cfg.Sinks {
+		if err := sink.Write(events); err != nil {
+			return err
+		}
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
+	for _, b := range lines {
+		if s.w != nil && s.cfg.RotateMaxBytes > 0 && s.size+int64(len(b))+1 > s.cfg.RotateMaxBytes {
+			if _, err := s.rotateLocked(); err != nil {
+				log.Printf("collector: rotating event log: %v", err)
+			}
+		}
+		if s.w != nil {
+			_, _ = s.w.Write(b)
+			_, _ = s.w.WriteString("\n")
+			s.size += int64(len(b)) + 1
+		} else if len(s.cfg.Sinks) == 0 {
+			log.Printf("EVENT %s", string(b))
+		}
+	}
 	if s.w != nil {
-		_, _ = s.w.Write(b)
-		_, _ = s.w.WriteString("\n")
 		_ = s.w.Flush()
-	} else {
-		log.Printf("EVENT %s", string(b))
 	}
+	return nil
+}
 
-	w.WriteHeader(http.StatusAccepted)
-	_, _ = w.Write([]byte("accepted"))
+// normalizeAppKey makes sure no raw gateway token is persisted. Events from
+// proxies that predate app_key_id carry the token in app_key; it is replaced
+// by its fingerprint unless RejectRawAppKeys is set. An app_key equal to
+// app_key_id (proxy compat mode) is kept.
+func (s *Server) normalizeAppKey(ev *MeteringEvent) error {
+	if ev.AppKey == "" || ev.AppKey == ev.AppKeyID {
+		return nil
+	}
+	if ev.AppKeyID == "" {
+		if s.cfg.RejectRawAppKeys {
+			return errors.New("raw app_key is not accepted; send app_key_id")
+		}
+		ev.AppKeyID = KeyFingerprint(s.cfg.KeyHMACSecret, ev.AppKey)
+	}
+	ev.AppKey = ""
+	return nil
 }
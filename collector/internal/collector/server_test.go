@@ -2,9 +2,12 @@ package collector
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -59,3 +62,147 @@ func TestHandleEvents_MissingRequestID(t *testing.T) {
 
 	require.Equal(t, http.StatusBadRequest, rec.Code)
 }
+
+func postEvent(t *testing.T, s *Server, ev MeteringEvent) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(ev)
+	req := httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.HandleEvents(rec, req)
+	return rec
+}
+
+func TestHandleEvents_LegacyRawAppKeyIsFingerprinted(t *testing.T) {
+	out := t.TempDir() + "/events.ndjson"
+	s, err := NewServerWithConfig(Config{EventLogPath: out, KeyHMACSecret: "s3cret"})
+	require.NoError(t, err)
+
+	rec := postEvent(t, s, MeteringEvent{RequestID: "req_1", AppKey: "gw_live_raw"})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	rec = postEvent(t, s, MeteringEvent{RequestID: "req_2", AppKey: "team-a", AppKeyID: "team-a"})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	s.Close()
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "gw_live_raw")
+	require.Contains(t, string(b), KeyFingerprint("s3cret", "gw_live_raw"))
+	require.Contains(t, string(b), `"app_key":"team-a","app_key_id":"team-a"`)
+}
+
+func TestHandleEvents_RejectRawAppKeys(t *testing.T) {
+	s, err := NewServerWithConfig(Config{RejectRawAppKeys: true})
+	require.NoError(t, err)
+
+	rec := postEvent(t, s, MeteringEvent{RequestID: "req_1", AppKey: "gw_live_raw"})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postEvent(t, s, MeteringEvent{RequestID: "req_2", AppKeyID: "team-a"})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+}
+
+func TestHandleEvents_AcceptsProxyFields(t *testing.T) {
+	s, err := NewServer("")
+	require.NoError(t, err)
+
+	body := `{"request_id":"req_1","endpoint":"/v1/embeddings","input_count":3,"embedding_dimensions":256,"image_count":2,"file_bytes":1048576,"audio_seconds":12.5,"audio_seconds_estimated":true,"provider":"openai","upstream":"azure-eu","model":"gpt-4o",` +
+		`"attempts":[{"upstream":"openai","status_code":503,"latency_ms":12},{"upstream":"azure-eu","status_code":200,"latency_ms":80}],` +
+		`"error_class":"upstream_5xx","error_code":"","aborted":true,"aborted_by":"timeout","cached_tokens":4,"reasoning_tokens":2,"usage_source":"estimated","upstream_ttfb_ms":230,"ttft_ms":310,"stream_duration_ms":1800,"chunk_count":42,"chunk_gap_mean_ms":35.5,"chunk_gap_p95_ms":80.25,"input_audio_tokens":3,"output_audio_tokens":1,"sequence":2,"response_count":5,"final":true,"cost_usd":0.0012,"price_catalog_version":"2025-06-01"}`
+	req := httptest.NewRequest(http.MethodPost, "/events", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	s.HandleEvents(rec, req)
+
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+}
+
+func postBatch(t *testing.T, s *Server, body string, gz bool) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if gz {
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(body))
+		require.NoError(t, zw.Close())
+	} else {
+		buf.WriteString(body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/events/batch", &buf)
+	if gz {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	s.Mux().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleEventBatch_PerLineAcceptance(t *testing.T) {
+	out := t.TempDir() + "/events.ndjson"
+	s, err := NewServerWithConfig(Config{EventLogPath: out})
+	require.NoError(t, err)
+
+	body := `{"request_id":"req_1","model":"gpt-4o"}` + "\n" +
+		`{"model":"gpt-4o"}` + "\n" +
+		"\n" +
+		`{"request_id":"req_3","unknown_field":1}` + "\n" +
+		`{"request_id":"req_4"}`
+	rec := postBatch(t, s, body, true)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var res BatchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Equal(t, 2, res.Accepted)
+	require.Len(t, res.Rejected, 2)
+	require.Equal(t, 2, res.Rejected[0].Line)
+	require.Equal(t, "missing request_id", res.Rejected[0].Error)
+	require.Equal(t, 4, res.Rejected[1].Line)
+	s.Close()
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"request_id":"req_1"`)
+	require.Contains(t, lines[1], `"request_id":"req_4"`)
+}
+
+func TestHandleEventBatch_Errors(t *testing.T) {
+	s, err := NewServerWithConfig(Config{MaxBatchBytes: 64})
+	require.NoError(t, err)
+
+	rec := postBatch(t, s, `{"request_id":"req_1"}`, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = postBatch(t, s, strings.Repeat(`{"request_id":"req_1"}`+"\n", 4), true)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/events/batch", bytes.NewBufferString("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	s.Mux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServer_DrainAndClose(t *testing.T) {
+	out := t.TempDir() + "/events.ndjson"
+	s, err := NewServerWithConfig(Config{EventLogPath: out})
+	require.NoError(t, err)
+	mux := s.Mux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s.StartDrain()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// draining still accepts events until the listener is closed
+	require.Equal(t, http.StatusAccepted, postEvent(t, s, MeteringEvent{RequestID: "req_1"}).Code)
+	s.Close()
+	require.Equal(t, http.StatusAccepted, postEvent(t, s, MeteringEvent{RequestID: "req_2"}).Code)
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"request_id":"req_1"`)
+	require.NotContains(t, string(b), `"request_id":"req_2"`)
+}
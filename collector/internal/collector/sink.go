@@ -0,0 +1,11 @@
+package collector
+
+// Sink stores accepted events, e.g. in a database. Write gets the events of
+// one request, already validated and normalized, and must store all or none
+// of them: on error the sender retries the whole request, so sinks should
+// ignore events they already stored (same request_id and sequence). Sinks
+// must be safe for concurrent use.
+type Sink interface {
+	Write(events []MeteringEvent) error
+	Close() error
+}
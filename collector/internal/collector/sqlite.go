@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite" // pure-Go driver "sqlite"
+)
+
+// sqliteTimeFormat has a fixed width so that ts sorts and compares as text.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// sqliteSchema is version 1 of the events table. The columns are the
+// fields usage queries filter and sum on; event has the full event.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id                INTEGER PRIMARY KEY,
+	request_id        TEXT    NOT NULL,
+	sequence          INTEGER NOT NULL DEFAULT 0,
+	ts                TEXT    NOT NULL,
+	tenant            TEXT    NOT NULL,
+	app_key_id        TEXT    NOT NULL DEFAULT '',
+	endpoint          TEXT    NOT NULL DEFAULT '',
+	provider          TEXT    NOT NULL DEFAULT '',
+	model             TEXT    NOT NULL,
+	status_code       INTEGER NOT NULL,
+	error_class       TEXT    NOT NULL DEFAULT '',
+	prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+	completion_tokens INTEGER NOT NULL DEFAULT 0,
+	total_tokens      INTEGER NOT NULL DEFAULT 0,
+	cached_tokens     INTEGER NOT NULL DEFAULT 0,
+	reasoning_tokens  INTEGER NOT NULL DEFAULT 0,
+	cost_usd          REAL,
+	latency_ms        INTEGER NOT NULL DEFAULT 0,
+	event             TEXT    NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS events_request ON events (request_id, sequence);
+CREATE INDEX IF NOT EXISTS events_ts ON events (ts);
+CREATE INDEX IF NOT EXISTS events_tenant_ts ON events (tenant, ts);
+CREATE INDEX IF NOT EXISTS events_app_key_ts ON events (app_key_id, ts);
+CREATE INDEX IF NOT EXISTS events_model_ts ON events (model, ts);
+PRAGMA user_version = 1;
+`
+
+const sqliteInsert = `
+INSERT INTO events (
+	request_id, sequence, ts, tenant, app_key_id, endpoint, provider, model,
+	status_code, error_class, prompt_tokens, completion_tokens, total_tokens,
+	cached_tokens, reasoning_tokens, cost_usd, latency_ms, event
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (request_id, sequence) DO NOTHING`
+
+// SQLiteSink stores events in a SQLite database, one transaction per
+// request. Events that are already stored are ignored.
+type SQLiteSink struct {
+	db *sql.DB
+}
+
+// OpenSQLiteSink opens or creates the database at path. It uses WAL mode,
+// so other processes can query it while the collector writes.
+func OpenSQLiteSink(path string) (*SQLiteSink, error) {
+	q := url.Values{}
+	for _, p := range []string{"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(NORMAL)"} {
+		q.Add("_pragma", p)
+	}
+	// the path is escaped, or a '?' or '#' in it would end it early
+	dsn := url.URL{Scheme: "file", Path: path, OmitHost: true, RawQuery: q.Encode()}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	// one writer; SQLite serializes writes anyway
+	db.SetMaxOpenConns(1)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if version > 1 {
+		_ = db.Close()
+		return nil, fmt.Errorf("open %s: unknown schema version %d", path, version)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return &SQLiteSink{db: db}, nil
+}
+
+func (sq *SQLiteSink) Write(events []MeteringEvent) error {
+	tx, err := sq.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.Prepare(sqliteInsert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(
+			ev.RequestID, ev.Sequence, ev.At.UTC().Format(sqliteTimeFormat), ev.Tenant, ev.AppKeyID,
+			ev.Endpoint, ev.Provider, ev.Model, ev.StatusCode, ev.ErrorClass,
+			ev.PromptTokens, ev.CompletionTokens, ev.TotalTokens, ev.CachedTokens, ev.ReasoningTokens,
+			ev.CostUSD, ev.LatencyMs, string(b),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (sq *SQLiteSink) Close() error {
+	return sq.db.Close()
+}
@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteSink_StoresBatchesOnce(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "events.db")
+	sink, err := OpenSQLiteSink(dbPath)
+	require.NoError(t, err)
+	s, err := NewServerWithConfig(Config{Sinks: []Sink{sink}})
+	require.NoError(t, err)
+
+	body := `{"request_id":"req_1","tenant":"acme","app_key_id":"hk_1","provider":"openai","model":"gpt-4o","prompt_tokens":10,"completion_tokens":5,"total_tokens":15,"cost_usd":0.25,"status_code":200,"ts":"2024-05-01T10:00:00Z"}
+{"request_id":"req_2","tenant":"acme","provider":"openai","model":"gpt-4o-mini","total_tokens":7,"status_code":200,"ts":"2024-05-01T11:00:00.5Z"}
+{"request_id":"rt_1","tenant":"acme","model":"gpt-4o-realtime","sequence":1,"status_code":101}
+{"request_id":"rt_1","tenant":"acme","model":"gpt-4o-realtime","sequence":2,"status_code":101,"final":true}`
+	rec := postBatch(t, s, body, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"accepted":4}`, rec.Body.String())
+	// a retried batch is not stored twice
+	require.Equal(t, http.StatusOK, postBatch(t, s, body, false).Code)
+	s.Close()
+
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM events`).Scan(&count))
+	require.Equal(t, 4, count)
+
+	var (
+		ts, appKeyID, event string
+		tokens              int
+		cost                sql.NullFloat64
+	)
+	require.NoError(t, db.QueryRow(`SELECT ts, app_key_id, total_tokens, cost_usd, event FROM events WHERE request_id = 'req_1'`).
+		Scan(&ts, &appKeyID, &tokens, &cost, &event))
+	require.Equal(t, "2024-05-01T10:00:00.000Z", ts)
+	require.Equal(t, "hk_1", appKeyID)
+	require.Equal(t, 15, tokens)
+	require.Equal(t, sql.NullFloat64{Float64: 0.25, Valid: true}, cost)
+	require.Contains(t, event, `"provider":"openai"`)
+
+	require.NoError(t, db.QueryRow(`SELECT cost_usd FROM events WHERE request_id = 'req_2'`).Scan(&cost))
+	require.False(t, cost.Valid)
+
+	var sum int
+	require.NoError(t, db.QueryRow(`SELECT sum(total_tokens) FROM events WHERE tenant = 'acme' AND ts >= '2024-05-01T10:30:00.000Z' AND ts < '2024-05-02'`).Scan(&sum))
+	require.Equal(t, 7, sum)
+
+	var plan string
+	require.NoError(t, db.QueryRow(`EXPLAIN QUERY PLAN SELECT * FROM events WHERE model = 'gpt-4o' AND ts > '2024'`).
+		Scan(new(int), new(int), new(int), &plan))
+	require.Contains(t, plan, "events_model_ts")
+
+	// reopening keeps the data and the schema
+	sink, err = OpenSQLiteSink(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+}
+
+func TestSQLiteSink_PathWithURIDelimiters(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a?b#c%20d")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	dbPath := filepath.Join(dir, "events.db")
+	sink, err := OpenSQLiteSink(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write([]MeteringEvent{{RequestID: "req_1", Tenant: "acme", Model: "gpt-4o", StatusCode: 200}}))
+	require.NoError(t, sink.Close())
+
+	_, err = os.Stat(dbPath)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+type failingSink struct{}
+
+func (failingSink) Write([]MeteringEvent) error { return errors.New("disk full") }
+func (failingSink) Close() error                { return nil }
+
+func TestServer_SinkFailureIsRetryable(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "events.ndjson")
+	s, err := NewServerWithConfig(Config{EventLogPath: out, Sinks: []Sink{failingSink{}}})
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusServiceUnavailable, postEvent(t, s, MeteringEvent{RequestID: "req_1"}).Code)
+	require.Equal(t, http.StatusServiceUnavailable, postBatch(t, s, `{"request_id":"req_2"}`, false).Code)
+	s.Close()
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Empty(t, b)
+}
@@ -2,17 +2,108 @@ package collector
 
 import "time"
 
+type Config struct {
+	// EventLogPath is the NDJSON output file. Empty means stdout.
+	EventLogPath string
+	// KeyHMACSecret must match the proxy's GATEWAY_KEY_HMAC_SECRET so that
+	// legacy events carrying a raw app_key map to the same app_key_id.
+	KeyHMACSecret string
+	// RejectRawAppKeys rejects legacy events that carry app_key without
+	// app_key_id instead of fingerprinting them.
+	RejectRawAppKeys bool
+	// MaxBatchBytes bounds the decompressed body of a batch; 0 means
+	// DefaultMaxBatchBytes.
+	MaxBatchBytes int64
+
+	// RotateMaxBytes rotates the event log before it grows past this size;
+	// 0 disables size-based rotation.
+	RotateMaxBytes int64
+	// RotateInterval rotates the event log this long after it was opened;
+	// 0 disables time-based rotation.
+	RotateInterval time.Duration
+	// RotateName names rotated logs, next to the event log. {name} and {ext}
+	// are the event log's base name and extension, {time} the UTC rotation
+	// time. Empty means DefaultRotateName.
+	RotateName string
+	// RotateCompress compresses rotated logs: "gzip", "zstd" or "" (none).
+	RotateCompress string
+	// RetainCount keeps at most this many rotated logs; 0 keeps all.
+	RetainCount int
+	// RetainAge deletes rotated logs older than this; 0 keeps all.
+	RetainAge time.Duration
+	// AdminToken enables POST /admin/rotate for bearers of this token.
+	AdminToken string
+	// Sinks store accepted events in addition to the event log. The server
+	// closes them on Close.
+	Sinks []Sink
+}
+
+// DefaultMaxBatchBytes is the default limit of a decompressed batch body.
+const DefaultMaxBatchBytes = 32 << 20
+
+// BatchResponse reports the outcome of a batch. Lines are numbered from 1;
+// every non-empty line not listed in Rejected was accepted.
+type BatchResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected []RejectedEvent `json:"rejected,omitempty"`
+}
+
+type RejectedEvent struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
 type MeteringEvent struct {
-	RequestID        string    `json:"request_id"`
-	Tenant           string    `json:"tenant"`
-	AppKey           string    `json:"app_key"`
-	Provider         string    `json:"provider"`
-	Model            string    `json:"model"`
-	PromptTokens     int       `json:"prompt_tokens"`
-	CompletionTokens int       `json:"completion_tokens"`
-	TotalTokens      int       `json:"total_tokens"`
-	LatencyMs        int64     `json:"latency_ms"`
-	StatusCode       int       `json:"status_code"`
-	At               time.Time `json:"ts"`
-	Stream           bool      `json:"stream,omitempty"`
+	RequestID             string    `json:"request_id"`
+	Tenant                string    `json:"tenant"`
+	AppKey                string    `json:"app_key,omitempty"`
+	AppKeyID              string    `json:"app_key_id,omitempty"`
+	Endpoint              string    `json:"endpoint,omitempty"`
+	Provider              string    `json:"provider"`
+	Upstream              string    `json:"upstream,omitempty"`
+	Model                 string    `json:"model"`
+	PromptTokens          int       `json:"prompt_tokens"`
+	CompletionTokens      int       `json:"completion_tokens"`
+	TotalTokens           int       `json:"total_tokens"`
+	CachedTokens          int       `json:"cached_tokens,omitempty"`
+	ReasoningTokens       int       `json:"reasoning_tokens,omitempty"`
+	UsageSource           string    `json:"usage_source,omitempty"`
+	InputAudioTokens      int       `json:"input_audio_tokens,omitempty"`
+	OutputAudioTokens     int       `json:"output_audio_tokens,omitempty"`
+	InputCount            int       `json:"input_count,omitempty"`
+	EmbeddingDimensions   int       `json:"embedding_dimensions,omitempty"`
+	ImageCount            int       `json:"image_count,omitempty"`
+	FileBytes             int64     `json:"file_bytes,omitempty"`
+	AudioSeconds          float64   `json:"audio_seconds,omitempty"`
+	AudioSecondsEstimated bool      `json:"audio_seconds_estimated,omitempty"`
+	LatencyMs             int64     `json:"latency_ms"`
+	StatusCode            int       `json:"status_code"`
+	At                    time.Time `json:"ts"`
+	UpstreamTTFBMs        int64     `json:"upstream_ttfb_ms,omitempty"`
+	TTFTMs                int64     `json:"ttft_ms,omitempty"`
+	StreamDurationMs      int64     `json:"stream_duration_ms,omitempty"`
+	ChunkCount            int       `json:"chunk_count,omitempty"`
+	ChunkGapMeanMs        float64   `json:"chunk_gap_mean_ms,omitempty"`
+	ChunkGapP95Ms         float64   `json:"chunk_gap_p95_ms,omitempty"`
+	ErrorClass            string    `json:"error_class,omitempty"`
+	ErrorCode             string    `json:"error_code,omitempty"`
+	Stream                bool      `json:"stream,omitempty"`
+	Aborted               bool      `json:"aborted,omitempty"`
+	AbortedBy             string    `json:"aborted_by,omitempty"`
+	Attempts              []Attempt `json:"attempts,omitempty"`
+
+	CostUSD             *float64 `json:"cost_usd,omitempty"`
+	PriceCatalogVersion string   `json:"price_catalog_version,omitempty"`
+
+	Sequence      int  `json:"sequence,omitempty"`
+	ResponseCount int  `json:"response_count,omitempty"`
+	Final         bool `json:"final,omitempty"`
+}
+
+// Attempt is one upstream call made by the proxy for a request.
+type Attempt struct {
+	Upstream   string `json:"upstream"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
 }
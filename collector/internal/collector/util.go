@@ -1,6 +1,11 @@
 package collector
 
-import "os"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
 
 func Getenv(k, def string) string {
 	v := os.Getenv(k)
@@ -9,3 +14,14 @@ func Getenv(k, def string) string {
 	}
 	return v
 }
+
+// KeyFingerprint mirrors the proxy's fingerprint of a gateway token.
+func KeyFingerprint(secret, token string) string {
+	if secret == "" {
+		sum := sha256.Sum256([]byte(token))
+		return "sha256_" + hex.EncodeToString(sum[:16])
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(token))
+	return "hk_" + hex.EncodeToString(m.Sum(nil)[:16])
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	proxy "llm-proxy/internal/proxy"
@@ -14,7 +18,10 @@ func main() {
 		log.Fatalf("config error: %v", err)
 	}
 
-	s := proxy.NewServer(cfg)
+	s, err := proxy.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("server init error: %v", err)
+	}
 
 	srv := &http.Server{
 		Addr:              cfg.ListenAddr,
@@ -28,5 +35,28 @@ func main() {
 	log.Printf("llm-proxy listening on %s (upstream=%s collector=%s capture_bytes=%d)",
 		cfg.ListenAddr, cfg.UpstreamBaseURL, cfg.CollectorURL, cfg.MeteringCaptureBytes)
 
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal terminates immediately
+
+	// fail readiness first so load balancers stop routing to this instance
+	log.Printf("shutdown: draining for %s", cfg.ShutdownReadinessDelay)
+	s.StartDrain()
+	time.Sleep(cfg.ShutdownReadinessDelay)
+
+	graceCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+	if err := srv.Shutdown(graceCtx); err != nil {
+		log.Printf("shutdown: grace period over; closing remaining connections")
+		_ = srv.Close()
+	}
+	s.Shutdown(graceCtx)
+	log.Printf("shutdown: done")
 }
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// audioHeaderBytes is how much of an uploaded audio file is kept to
+// estimate its duration.
+const audioHeaderBytes = 64 << 10
+
+// estimateAudioSeconds estimates the duration of an audio file from its
+// first bytes and total size. WAV and FLAC headers give the exact length;
+// MP3 uses the Xing/Info frame count when present and the bitrate of the
+// first frame otherwise. Other formats return 0.
+func estimateAudioSeconds(head []byte, size int64) float64 {
+	switch {
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return wavSeconds(head, size)
+	case len(head) >= 4 && string(head[:4]) == "fLaC":
+		return flacSeconds(head)
+	default:
+		return mp3Seconds(head, size)
+	}
+}
+
+func wavSeconds(head []byte, size int64) float64 {
+	var byteRate uint32
+	for off := 12; off+8 <= len(head); {
+		id, n := string(head[off:off+4]), int64(binary.LittleEndian.Uint32(head[off+4:off+8]))
+		data := off + 8
+		switch id {
+		case "fmt ":
+			if data+12 <= len(head) {
+				byteRate = binary.LittleEndian.Uint32(head[data+8 : data+12])
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0
+			}
+			// streamed WAVs often carry a placeholder data size
+			n = min(n, size-int64(data))
+			return float64(n) / float64(byteRate)
+		}
+		off = data + int(n) + int(n&1)
+	}
+	return 0
+}
+
+func flacSeconds(head []byte) float64 {
+	// STREAMINFO is the first metadata block: 4 byte block header, then
+	// sample rate (20 bits) and total samples (36 bits) at bytes 10..17
+	if len(head) < 8+18 || head[4]&0x7f != 0 {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(head[8+10 : 8+18])
+	rate, samples := v>>44, v&(1<<36-1)
+	if rate == 0 {
+		return 0
+	}
+	return float64(samples) / float64(rate)
+}
+
+var (
+	mp3Bitrates = [2][16]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Seconds handles MPEG audio layer III.
+func mp3Seconds(head []byte, size int64) float64 {
+	off := 0
+	if len(head) >= 10 && string(head[:3]) == "ID3" {
+		off = 10 + (int(head[6])<<21 | int(head[7])<<14 | int(head[8])<<7 | int(head[9]))
+		if head[5]&0x10 != 0 {
+			off += 10
+		}
+	}
+	for ; off+4 <= len(head); off++ {
+		if head[off] == 0xff && head[off+1]&0xe0 == 0xe0 {
+			break
+		}
+	}
+	if off+4 > len(head) {
+		return 0
+	}
+
+	h := head[off:]
+	version, layer := h[1]>>3&3, h[1]>>1&3
+	bitrateIdx, rateIdx := h[2]>>4, h[2]>>2&3
+	if version == 1 || layer != 1 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return 0
+	}
+	mpeg1 := version == 3
+	table, samplesPerFrame, rate := 1, 576, mp3SampleRates[rateIdx]
+	if mpeg1 {
+		table, samplesPerFrame = 0, 1152
+	} else {
+		rate /= 2
+		if version == 0 {
+			rate /= 2
+		}
+	}
+
+	// a Xing/Info frame after the side information gives the frame count
+	sideInfo := 17
+	if mono := h[3]>>6 == 3; mpeg1 && !mono {
+		sideInfo = 32
+	} else if !mpeg1 && mono {
+		sideInfo = 9
+	}
+	if x := 4 + sideInfo; len(h) >= x+12 {
+		tag := h[x : x+4]
+		if (bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info"))) && h[x+7]&1 != 0 {
+			frames := binary.BigEndian.Uint32(h[x+8 : x+12])
+			return float64(frames) * float64(samplesPerFrame) / float64(rate)
+		}
+	}
+
+	bitrate := mp3Bitrates[table][bitrateIdx] * 1000
+	return float64(size-int64(off)) * 8 / float64(bitrate)
+}
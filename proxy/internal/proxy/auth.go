@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultTenant = "default"
+
+// authenticate resolves the gateway key from the Authorization header and
+// writes an OpenAI-shaped error when the request must be rejected. The
+// returned key is nil in open mode, when no key store is configured.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*GatewayKey, string, bool) {
+	token := BearerToken(r.Header.Get("Authorization"))
+	if token == "" {
+		WriteOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key",
+			"missing Authorization bearer token (gateway key)")
+		return nil, "", false
+	}
+
+	if s.keys == nil {
+		return nil, token, true
+	}
+
+	key, err := s.keys.Lookup(token, time.Now())
+	switch {
+	case err == nil:
+		return key, token, true
+	case errors.Is(err, ErrKeyDisabled):
+		log.Printf("auth: rejected disabled key key_id=%s", key.ID)
+		WriteOpenAIError(w, http.StatusForbidden, "invalid_request_error", "key_disabled",
+			"the gateway key is disabled")
+	case errors.Is(err, ErrKeyExpired):
+		log.Printf("auth: rejected expired key key_id=%s", key.ID)
+		WriteOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "key_expired",
+			"the gateway key has expired")
+	default:
+		WriteOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+			"invalid gateway key")
+	}
+	return nil, "", false
+}
+
+// appKeyID returns the identifier recorded in metering events for the
+// caller. The raw bearer token is never emitted.
+func (s *Server) appKeyID(key *GatewayKey, token string) string {
+	if key != nil {
+		return key.ID
+	}
+	return KeyFingerprint(s.cfg.KeyHMACSecret, token)
+}
+
+// legacyAppKey returns the value for the deprecated app_key field.
+func (s *Server) legacyAppKey(keyID string) string {
+	if s.cfg.AppKeyCompat {
+		return keyID
+	}
+	return ""
+}
+
+// authorizeModel rejects the request when the key may not call model.
+func authorizeModel(w http.ResponseWriter, key *GatewayKey, model string) bool {
+	if key == nil || key.AllowsModel(model) {
+		return true
+	}
+	WriteOpenAIError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed",
+		"the gateway key is not allowed to use model '"+model+"'")
+	return false
+}
+
+// authorizePath rejects the request when the key may not reach the path.
+func (s *Server) authorizePath(w http.ResponseWriter, key *GatewayKey, p string) bool {
+	if key.AllowsPath(p, s.cfg.AllowedPaths) {
+		return true
+	}
+	WriteOpenAIError(w, http.StatusForbidden, "invalid_request_error", "path_not_allowed",
+		"the gateway key is not allowed to call "+p)
+	return false
+}
+
+// resolveTenant derives the tenant for a request. With a key store the key's
+// tenant wins; the X-LLM-Tenant/X-Tenant headers may only select one of the
+// key's sub-tenants. Without a key store the headers are trusted as before.
+func resolveTenant(w http.ResponseWriter, r *http.Request, key *GatewayKey) (string, bool) {
+	requested := strings.TrimSpace(FirstNonEmpty(
+		r.Header.Get("X-LLM-Tenant"),
+		r.Header.Get("X-Tenant"),
+	))
+
+	if key == nil {
+		return FirstNonEmpty(requested, defaultTenant), true
+	}
+
+	tenant := FirstNonEmpty(key.Tenant, defaultTenant)
+	if requested == "" || requested == tenant {
+		return tenant, true
+	}
+	if key.AllowsSubTenant(requested) {
+		return requested, true
+	}
+
+	log.Printf("auth: tenant override rejected key_id=%s key_tenant=%s requested_tenant=%q", key.ID, tenant, requested)
+	WriteOpenAIError(w, http.StatusForbidden, "invalid_request_error", "tenant_not_allowed",
+		"the gateway key may not act for tenant '"+requested+"'")
+	return "", false
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrBodyTooLarge is returned when a request body exceeds the configured
+// maximum.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// bodyBuffer holds a request body that may be sent more than once (retries
+// and failover). Bodies up to memLimit stay in memory; larger ones are
+// spooled to a temporary file so that big requests do not sit in the heap.
+type bodyBuffer struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// readBody buffers r, failing with ErrBodyTooLarge once more than maxSize
+// bytes were read. Close must be called to remove the temporary file.
+func readBody(r io.Reader, memLimit, maxSize int64) (*bodyBuffer, error) {
+	b := &bodyBuffer{}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	if n <= memLimit {
+		b.mem, b.size = buf.Bytes(), n
+		return b, nil
+	}
+
+	f, err := os.CreateTemp("", "llm-proxy-body-*")
+	if err != nil {
+		return nil, err
+	}
+	// unlink right away on platforms that allow it; the open file stays usable
+	_ = os.Remove(f.Name())
+	b.file = f
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		b.Close()
+		return nil, err
+	}
+	rest, err := io.Copy(f, io.LimitReader(r, maxSize-n+1))
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.size = n + rest
+	if b.size > maxSize {
+		b.Close()
+		return nil, ErrBodyTooLarge
+	}
+	return b, nil
+}
+
+func (b *bodyBuffer) Size() int64 { return b.size }
+
+// Section returns a reader over bytes [off, off+n) of the body.
+func (b *bodyBuffer) Section(off, n int64) io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, off, n)
+	}
+	return bytes.NewReader(b.mem[off : off+n])
+}
+
+// Reader returns a new reader over the whole body.
+func (b *bodyBuffer) Reader() io.Reader {
+	return b.Section(0, b.size)
+}
+
+// Replace returns a reader over the body with bytes [start, end) replaced
+// by repl, and the resulting length.
+func (b *bodyBuffer) Replace(start, end int64, repl []byte) (io.Reader, int64) {
+	r := io.MultiReader(b.Section(0, start), bytes.NewReader(repl), b.Section(end, b.size-end))
+	return r, b.size - (end - start) + int64(len(repl))
+}
+
+func (b *bodyBuffer) Close() {
+	if b.file != nil {
+		_ = b.file.Close()
+		_ = os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
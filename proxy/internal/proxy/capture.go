@@ -1,8 +1,14 @@
 package proxy
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 type limitedCapture struct {
-	limit int
-	buf   []byte
+	limit     int
+	buf       []byte
+	truncated bool
 }
 
 func NewLimitedCapture(limit int) *limitedCapture {
@@ -13,10 +19,10 @@ func NewLimitedCapture(limit int) *limitedCapture {
 }
 
 func (lc *limitedCapture) Write(p []byte) (int, error) {
-	if lc.limit <= 0 {
-		return len(p), nil
-	}
 	remain := lc.limit - len(lc.buf)
+	if len(p) > remain {
+		lc.truncated = true
+	}
 	if remain <= 0 {
 		return len(p), nil
 	}
@@ -31,3 +37,44 @@ func (lc *limitedCapture) Write(p []byte) (int, error) {
 func (lc *limitedCapture) Bytes() []byte {
 	return lc.buf
 }
+
+// Truncated reports whether bytes beyond the limit were written and dropped.
+func (lc *limitedCapture) Truncated() bool {
+	return lc.truncated
+}
+
+// tailCapture keeps the last size bytes written to it.
+type tailCapture struct {
+	size int
+	buf  []byte
+}
+
+func (tc *tailCapture) Write(p []byte) (int, error) {
+	if len(p) >= tc.size {
+		tc.buf = append(tc.buf[:0], p[len(p)-tc.size:]...)
+		return len(p), nil
+	}
+	tc.buf = append(tc.buf, p...)
+	if over := len(tc.buf) - tc.size; over > 0 {
+		tc.buf = append(tc.buf[:0], tc.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// trailingUsage decodes the last "usage" object of a JSON body from its
+// tail, for bodies too large to capture whole; OpenAI responses end with it.
+func trailingUsage(tail []byte) *Usage {
+	i := bytes.LastIndex(tail, []byte(`"usage"`))
+	if i < 0 {
+		return nil
+	}
+	rest, ok := bytes.CutPrefix(bytes.TrimLeft(tail[i+len(`"usage"`):], " \t\r\n"), []byte(":"))
+	if !ok {
+		return nil
+	}
+	var u Usage
+	if err := json.NewDecoder(bytes.NewReader(rest)).Decode(&u); err != nil || u.TotalTokens == 0 {
+		return nil
+	}
+	return &u
+}
@@ -12,6 +12,11 @@ func TestLimitedCapture_RespectsLimit(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 11, n)
 	require.Equal(t, []byte("hello"), lc.Bytes())
+	require.True(t, lc.Truncated())
+
+	lc = NewLimitedCapture(5)
+	_, _ = lc.Write([]byte("hello"))
+	require.False(t, lc.Truncated())
 }
 
 func TestLimitedCapture_ZeroLimit(t *testing.T) {
@@ -19,4 +24,23 @@ func TestLimitedCapture_ZeroLimit(t *testing.T) {
 	_, err := lc.Write([]byte("data"))
 	require.NoError(t, err)
 	require.Nil(t, lc.Bytes())
+	require.True(t, lc.Truncated())
+}
+
+func TestTailCapture_KeepsLastBytes(t *testing.T) {
+	tc := &tailCapture{size: 5}
+	_, _ = tc.Write([]byte("abc"))
+	_, _ = tc.Write([]byte("defg"))
+	require.Equal(t, []byte("cdefg"), tc.buf)
+	_, _ = tc.Write([]byte("0123456789"))
+	require.Equal(t, []byte("56789"), tc.buf)
+}
+
+func TestTrailingUsage(t *testing.T) {
+	u := trailingUsage([]byte(`tent":"say \"usage\": {}"}}],"usage": {"prompt_tokens":3,"completion_tokens":2,"total_tokens":5},"system_fingerprint":"fp"}`))
+	require.NotNil(t, u)
+	require.Equal(t, 5, u.TotalTokens)
+
+	require.Nil(t, trailingUsage([]byte(`"content":"no usage here"}}]}`)))
+	require.Nil(t, trailingUsage([]byte(`"usage":null}`)))
 }
@@ -6,20 +6,83 @@ import (
 	"time"
 )
 
+// DefaultAllowedPaths are the API paths keys may call unless they list
+// allowed_paths. Endpoints holding state shared by everyone behind the
+// upstream key (files, batches, fine-tuning, assistants, vector stores) must
+// be granted per key.
+var DefaultAllowedPaths = []string{
+	"/v1/chat/completions",
+	"/v1/embeddings",
+	"/v1/responses",
+	"/v1/realtime",
+	"/v1/completions",
+	"/v1/moderations",
+	"/v1/images/*",
+	"/v1/audio/*",
+	"/v1/models*",
+}
+
 func LoadConfig() (Config, error) {
 	cfg := Config{
-		ListenAddr:           EnvOr("LISTEN_ADDR", ":8080"),
-		UpstreamBaseURL:      EnvOr("UPSTREAM_OPENAI_BASE_URL", "https://api.openai.com"),
-		UpstreamAPIKey:       os.Getenv("UPSTREAM_OPENAI_API_KEY"),
-		CollectorURL:         EnvOr("COLLECTOR_URL", "http://llm-collector.llm-system.svc.cluster.local:8081/events"),
-		EventQueueSize:       EnvOrInt("EVENT_QUEUE_SIZE", 10000),
-		EventFlushTimeout:    EnvOrDuration("EVENT_FLUSH_TIMEOUT", 2*time.Second),
-		HTTPClientTimeout:    EnvOrDuration("HTTP_CLIENT_TIMEOUT", 120*time.Second),
-		MeteringCaptureBytes: EnvOrInt("METERING_CAPTURE_BYTES", 256*1024),
+		ListenAddr:             EnvOr("LISTEN_ADDR", ":8080"),
+		UpstreamBaseURL:        EnvOr("UPSTREAM_OPENAI_BASE_URL", "https://api.openai.com"),
+		UpstreamAPIKey:         os.Getenv("UPSTREAM_OPENAI_API_KEY"),
+		UpstreamProvider:       EnvOr("UPSTREAM_PROVIDER", ProviderOpenAI),
+		CollectorURL:           EnvOr("COLLECTOR_URL", "http://llm-collector.llm-system.svc.cluster.local:8081/events"),
+		EventQueueSize:         EnvOrInt("EVENT_QUEUE_SIZE", 10000),
+		EventFlushTimeout:      EnvOrDuration("EVENT_FLUSH_TIMEOUT", 2*time.Second),
+		HTTPClientTimeout:      EnvOrDuration("HTTP_CLIENT_TIMEOUT", 120*time.Second),
+		MeteringCaptureBytes:   EnvOrInt("METERING_CAPTURE_BYTES", 256*1024),
+		AnthropicBaseURL:       EnvOr("ANTHROPIC_BASE_URL", "https://api.anthropic.com"),
+		AnthropicAPIKey:        os.Getenv("ANTHROPIC_API_KEY"),
+		AnthropicModelPrefixes: EnvOrList("ANTHROPIC_MODEL_PREFIXES", []string{"claude-"}),
+		RoutesFile:             EnvOr("ROUTES_FILE", ""),
+		UpstreamMaxAttempts:    EnvOrInt("UPSTREAM_MAX_ATTEMPTS", 1),
+
+		DisableStreamUsageInjection: !EnvOrBool("STREAM_USAGE_INJECTION", true),
+
+		RateLimitsFile:           EnvOr("RATE_LIMITS_FILE", ""),
+		RateLimitsReloadInterval: EnvOrDuration("RATE_LIMITS_RELOAD_INTERVAL", 10*time.Second),
+		KeysFile:                 EnvOr("GATEWAY_KEYS_FILE", ""),
+		OpenMode:                 EnvOrBool("GATEWAY_OPEN_MODE", false),
+		KeyHMACSecret:            os.Getenv("GATEWAY_KEY_HMAC_SECRET"),
+		AppKeyCompat:             EnvOrBool("METERING_APP_KEY_COMPAT", false),
+		MetricsTenants:           EnvOrList("METRICS_TENANTS", nil),
+		MetricsModels:            EnvOrList("METRICS_MODELS", nil),
+		PriceCatalogFile:         EnvOr("PRICE_CATALOG_FILE", ""),
+		RequestMemoryBufferBytes: int64(EnvOrInt("REQUEST_MEMORY_BUFFER_BYTES", 1<<20)),
+		EmbeddingsMaxBodyBytes:   int64(EnvOrInt("EMBEDDINGS_MAX_BODY_BYTES", 256<<20)),
+		ChatMaxBodyBytes:         int64(EnvOrInt("CHAT_MAX_BODY_BYTES", 8<<20)),
+		AllowedPaths:             EnvOrList("GATEWAY_ALLOWED_PATHS", DefaultAllowedPaths),
+		PassthroughMaxBodyBytes:  int64(EnvOrInt("PASSTHROUGH_MAX_BODY_BYTES", 512<<20)),
+		RealtimeMeteringInterval: EnvOrDuration("REALTIME_METERING_INTERVAL", time.Minute),
+		RealtimeAllowedOrigins:   EnvOrList("REALTIME_ALLOWED_ORIGINS", nil),
+		CollectorBatchURL:        EnvOr("COLLECTOR_BATCH_URL", ""),
+		CollectorTimeout:         EnvOrDuration("COLLECTOR_TIMEOUT", 5*time.Second),
+		EventBatchSize:           EnvOrInt("EVENT_BATCH_SIZE", 500),
+		EventBatchMaxAge:         EnvOrDuration("EVENT_BATCH_MAX_AGE", time.Second),
+		EventSenderWorkers:       EnvOrInt("EVENT_SENDER_WORKERS", 4),
+		EventBatchMaxAttempts:    EnvOrInt("EVENT_BATCH_MAX_ATTEMPTS", 3),
+		ShutdownReadinessDelay:   EnvOrDuration("SHUTDOWN_READINESS_DELAY", 5*time.Second),
+		ShutdownGracePeriod:      EnvOrDuration("SHUTDOWN_GRACE_PERIOD", 20*time.Second),
+		ShutdownFlushTimeout:     EnvOrDuration("SHUTDOWN_FLUSH_TIMEOUT", 5*time.Second),
+		EventSpoolDir:            EnvOr("EVENT_SPOOL_DIR", ""),
+		EventSpoolMaxBytes:       int64(EnvOrInt("EVENT_SPOOL_MAX_BYTES", 1<<30)),
+		EventSpoolSegmentBytes:   int64(EnvOrInt("EVENT_SPOOL_SEGMENT_BYTES", 64<<20)),
+		EventSpoolFsync:          EnvOr("EVENT_SPOOL_FSYNC", SpoolFsyncInterval),
+		EventSpoolFsyncInterval:  EnvOrDuration("EVENT_SPOOL_FSYNC_INTERVAL", time.Second),
 	}
 
-	if cfg.UpstreamAPIKey == "" {
-		return cfg, errors.New("UPSTREAM_OPENAI_API_KEY is required")
+	if cfg.UpstreamAPIKey == "" && cfg.RoutesFile == "" {
+		return cfg, errors.New("UPSTREAM_OPENAI_API_KEY is required (or configure ROUTES_FILE)")
+	}
+	if _, ok := NewProvider(cfg.UpstreamProvider, cfg); !ok {
+		return cfg, errors.New("unknown UPSTREAM_PROVIDER: " + cfg.UpstreamProvider)
+	}
+	switch cfg.EventSpoolFsync {
+	case SpoolFsyncAlways, SpoolFsyncInterval, SpoolFsyncNever:
+	default:
+		return cfg, errors.New("EVENT_SPOOL_FSYNC must be always, interval or never")
 	}
 	if cfg.MeteringCaptureBytes < 0 {
 		cfg.MeteringCaptureBytes = 0
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// batchRetryDelay is the wait before the second attempt of a batch; it
+// doubles with every further attempt.
+const batchRetryDelay = 200 * time.Millisecond
+
+// withDeliveryDefaults fills in unset event delivery settings. Without a
+// batch age, batches are sent as soon as the queue is drained.
+func withDeliveryDefaults(cfg Config) Config {
+	if cfg.CollectorBatchURL == "" {
+		cfg.CollectorBatchURL = strings.TrimSuffix(cfg.CollectorURL, "/") + "/batch"
+	}
+	if cfg.CollectorTimeout <= 0 {
+		cfg.CollectorTimeout = 5 * time.Second
+	}
+	cfg.EventBatchSize = max(cfg.EventBatchSize, 1)
+	cfg.EventSenderWorkers = max(cfg.EventSenderWorkers, 1)
+	cfg.EventBatchMaxAttempts = max(cfg.EventBatchMaxAttempts, 1)
+	if cfg.ShutdownFlushTimeout <= 0 {
+		cfg.ShutdownFlushTimeout = 5 * time.Second
+	}
+	return cfg
+}
+
+func (s *Server) enqueue(ev MeteringEvent) {
+	select {
+	case s.events <- ev:
+	default:
+		if s.spool == nil {
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+		s.spoolEvent(b)
+	}
+}
+
+// backgroundSender groups queued events into batches for the batch senders.
+// A batch is handed over when it has EventBatchSize events or its oldest
+// event is EventBatchMaxAge old. While the spool has a backlog, new events
+// are spooled behind it instead.
+func (s *Server) backgroundSender() {
+	defer s.senders.Done()
+	ticker := time.NewTicker(s.cfg.EventFlushTimeout)
+	defer ticker.Stop()
+	age := time.NewTimer(time.Hour)
+	age.Stop()
+
+	var batch [][]byte
+	flush := func() {
+		age.Stop()
+		if len(batch) > 0 {
+			s.batches <- batch
+			batch = nil
+		}
+	}
+	add := func(ev MeteringEvent) {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("metering: cannot encode event (drop): %v", err)
+			return
+		}
+		if s.spool != nil && s.spool.Pending() {
+			s.spoolEvent(b)
+			return
+		}
+		batch = append(batch, b)
+		switch {
+		case len(batch) >= s.cfg.EventBatchSize,
+			s.cfg.EventBatchMaxAge <= 0 && len(s.events) == 0:
+			flush()
+		case len(batch) == 1:
+			age.Reset(s.cfg.EventBatchMaxAge)
+		}
+	}
+	for {
+		select {
+		case ev := <-s.events:
+			add(ev)
+		case <-s.stop:
+			// hand over what is queued and let the batch senders finish
+			for len(s.events) > 0 {
+				add(<-s.events)
+			}
+			flush()
+			close(s.batches)
+			return
+		case <-age.C:
+			flush()
+		case <-ticker.C:
+			d := atomic.LoadUint64(&s.dropped)
+			if d > 0 {
+				log.Printf("metering: dropped_events=%d (queue full or overload)", d)
+			}
+		}
+	}
+}
+
+func (s *Server) batchSender() {
+	defer s.senders.Done()
+	for batch := range s.batches {
+		s.sendBatch(batch)
+	}
+}
+
+// sendBatch posts a batch with up to EventBatchMaxAttempts attempts; a
+// retry only sends the events the collector did not take yet. When the
+// attempts all fail, or one fails during shutdown, the rest is spooled, or
+// dropped without a spool.
+func (s *Server) sendBatch(batch [][]byte) {
+	var err error
+	for attempt := 0; attempt < s.cfg.EventBatchMaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-s.stop:
+			case <-time.After(batchRetryDelay << (attempt - 1)):
+			}
+			if s.stopping() {
+				break
+			}
+		}
+		var n int
+		n, err = s.postBatch(batch)
+		batch = batch[n:]
+		if err == nil || errors.Is(err, errCollectorRejected) {
+			break
+		}
+	}
+	if err == nil {
+		return
+	}
+	s.metrics.collectorFailures.Add(float64(len(batch)))
+	if s.spool == nil || errors.Is(err, errCollectorRejected) {
+		log.Printf("collector post failed (drop %d events): %v", len(batch), err)
+		return
+	}
+	log.Printf("collector post failed (spooled %d events): %v", len(batch), err)
+	for _, b := range batch {
+		s.spoolEvent(b)
+	}
+}
+
+// stopping reports whether Shutdown stopped the event senders.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// spoolEvent appends an encoded event to the spool. Metering fails open: when
+// the spool is full or the disk fails the event is dropped.
+func (s *Server) spoolEvent(b []byte) {
+	if err := s.spool.Append(b); err != nil {
+		atomic.AddUint64(&s.dropped, 1)
+		log.Printf("metering: cannot spool event (drop): %v", err)
+		return
+	}
+	s.metrics.eventsSpooled.Inc()
+}
+
+// replaySpool sends spooled events to the collector in order, backing off
+// while the collector is unavailable, and syncs the spool every
+// EVENT_SPOOL_FSYNC_INTERVAL. The sync saves the replay position whatever
+// the fsync policy; appended events are only fsynced as it says.
+func (s *Server) replaySpool() {
+	defer s.senders.Done()
+	interval := s.cfg.EventSpoolFsyncInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	syncTick := time.NewTicker(interval)
+	defer syncTick.Stop()
+
+	var backoff time.Duration
+	for {
+		var retry <-chan time.Time
+		batch, err := s.spool.Next(s.cfg.EventBatchSize)
+		switch {
+		case err == nil:
+			var n int
+			n, err = s.postBatch(batch)
+			if err == nil || errors.Is(err, errCollectorRejected) {
+				if err != nil {
+					s.metrics.collectorFailures.Add(float64(len(batch) - n))
+					log.Printf("collector rejected %d spooled events (drop): %v", len(batch)-n, err)
+				}
+				if err := s.spool.Ack(len(batch)); err != nil {
+					log.Printf("metering: spool: %v", err)
+				}
+				backoff = 0
+				continue
+			}
+			if n > 0 {
+				// the collector has these; only the rest is replayed
+				if err := s.spool.Ack(n); err != nil {
+					log.Printf("metering: spool: %v", err)
+				}
+			}
+			backoff = min(max(2*backoff, 500*time.Millisecond), 30*time.Second)
+			log.Printf("collector post failed (replay in %s): %v", backoff, err)
+			retry = time.After(backoff)
+		case err != io.EOF:
+			backoff = min(max(2*backoff, 500*time.Millisecond), 30*time.Second)
+			log.Printf("metering: spool: %v", err)
+			retry = time.After(backoff)
+		}
+
+		appended := s.spool.Appended()
+		if retry != nil {
+			appended = nil
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-retry:
+		case <-appended:
+		case <-syncTick.C:
+			if err := s.spool.Sync(); err != nil {
+				log.Printf("metering: spool sync: %v", err)
+			}
+		}
+	}
+}
+
+// errCollectorRejected marks events the collector refused for good; they
+// are not retried.
+var errCollectorRejected = errors.New("collector rejected event")
+
+// batchResponse is the collector's answer to a batch: the 1-based line
+// numbers it rejected, the other lines were accepted.
+type batchResponse struct {
+	Accepted int `json:"accepted"`
+	Rejected []struct {
+		Line  int    `json:"line"`
+		Error string `json:"error"`
+	} `json:"rejected"`
+}
+
+// postBatch posts encoded events to the collector as gzip-compressed NDJSON
+// and returns how many leading events of batch the collector took; on error
+// only the rest must be sent again. Lines the collector rejects are logged
+// and dropped. A collector without the batch endpoint gets the events one
+// by one, and a batch that is too large for it is split.
+func (s *Server) postBatch(batch [][]byte) (int, error) {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	for _, b := range batch {
+		_, _ = zw.Write(b)
+		_, _ = zw.Write([]byte{'\n'})
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(s.delivery, http.MethodPost, s.cfg.CollectorBatchURL, &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := s.collectorClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return s.postEach(batch)
+	case resp.StatusCode == http.StatusRequestEntityTooLarge && len(batch) > 1:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		half := len(batch) / 2
+		if n, err := s.postBatch(batch[:half]); err != nil {
+			return n, err
+		}
+		n, err := s.postBatch(batch[half:])
+		return half + n, err
+	case resp.StatusCode/100 != 2:
+		return 0, collectorStatusError(resp)
+	}
+
+	var res batchResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return 0, fmt.Errorf("invalid collector batch response: %w", err)
+	}
+	for _, r := range res.Rejected {
+		s.metrics.collectorFailures.Inc()
+		log.Printf("collector rejected event (drop): line %d of %d: %s", r.Line, len(batch), r.Error)
+	}
+	return len(batch), nil
+}
+
+// postEach posts events one by one to a collector that predates batches and
+// returns how many were taken before an error.
+func (s *Server) postEach(batch [][]byte) (int, error) {
+	for i, b := range batch {
+		err := postEvent(s.delivery, s.collectorClient, s.cfg.CollectorURL, b)
+		if errors.Is(err, errCollectorRejected) {
+			s.metrics.collectorFailures.Inc()
+			log.Printf("collector post failed (drop): %v", err)
+			continue
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+func postEvent(ctx context.Context, client *http.Client, collectorURL string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, collectorURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return collectorStatusError(resp)
+	}
+	return nil
+}
+
+// collectorStatusError describes a non-2xx collector response. Client
+// errors other than 408 and 429 wrap errCollectorRejected.
+func collectorStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	msg := "collector returned " + resp.Status + " body=" + string(body)
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %s", errCollectorRejected, msg)
+	}
+	return errors.New(msg)
+}
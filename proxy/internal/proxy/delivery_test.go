@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// batchCollector records the batches it receives; respond may override the
+// answer to the n-th request (1-based) by returning true.
+type batchCollector struct {
+	mu       sync.Mutex
+	batches  [][]MeteringEvent
+	singles  []MeteringEvent
+	requests atomic.Int32
+}
+
+func newBatchCollector(t *testing.T, respond func(n int, w http.ResponseWriter, r *http.Request) bool) (*batchCollector, string) {
+	t.Helper()
+	bc := &batchCollector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(bc.requests.Add(1))
+		if respond != nil && respond(n, w, r) {
+			return
+		}
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		if !strings.HasSuffix(r.URL.Path, "/batch") {
+			var ev MeteringEvent
+			_ = json.NewDecoder(r.Body).Decode(&ev)
+			bc.singles = append(bc.singles, ev)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		batch, err := decodeEventBatch(r)
+		require.NoError(t, err)
+		bc.batches = append(bc.batches, batch)
+		_, _ = w.Write([]byte(`{"accepted":1}`))
+	}))
+	t.Cleanup(srv.Close)
+	return bc, srv.URL + "/events"
+}
+
+func (bc *batchCollector) batchSizes() []int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	var sizes []int
+	for _, b := range bc.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestDelivery_BatchesByCountAndAge(t *testing.T) {
+	bc, url := newBatchCollector(t, nil)
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = url
+		cfg.EventBatchSize = 3
+		cfg.EventBatchMaxAge = 200 * time.Millisecond
+	})
+
+	for i := 0; i < 4; i++ {
+		env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	}
+	// three fill a batch; the fourth goes out once it is old enough
+	require.Eventually(t, func() bool { return len(bc.batchSizes()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, []int{3, 1}, bc.batchSizes())
+	require.Equal(t, "gpt-4o-mini", bc.batches[0][0].Model)
+}
+
+func TestDelivery_RetriesBatch(t *testing.T) {
+	bc, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = url
+		cfg.EventBatchMaxAttempts = 3
+	})
+
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Eventually(t, func() bool { return len(bc.batchSizes()) == 1 }, 3*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 3, bc.requests.Load())
+	require.Contains(t, scrapeMetrics(t, env), "llm_proxy_collector_post_failures_total 0")
+}
+
+func TestDelivery_RejectedLinesAreNotRetried(t *testing.T) {
+	_, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		_, _ = w.Write([]byte(`{"accepted":1,"rejected":[{"line":2,"error":"missing request_id"}]}`))
+		return true
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = url
+		cfg.EventBatchMaxAttempts = 3
+	})
+
+	n, err := env.srv.postBatch([][]byte{[]byte(`{"request_id":"a"}`), []byte(`{}`)})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Contains(t, scrapeMetrics(t, env), "llm_proxy_collector_post_failures_total 1")
+}
+
+func TestDelivery_FallsBackToSingleEvents(t *testing.T) {
+	bc, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, "/batch") {
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { cfg.CollectorURL = url })
+
+	_, err := env.srv.postBatch([][]byte{[]byte(`{"request_id":"a"}`), []byte(`{"request_id":"b"}`)})
+	require.NoError(t, err)
+	require.Len(t, bc.singles, 2)
+	require.Equal(t, "b", bc.singles[1].RequestID)
+}
+
+func TestDelivery_SplitsTooLargeBatches(t *testing.T) {
+	bc, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		if n == 1 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return true
+		}
+		return false
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { cfg.CollectorURL = url })
+
+	_, err := env.srv.postBatch([][]byte{[]byte(`{"request_id":"a"}`), []byte(`{"request_id":"b"}`), []byte(`{"request_id":"c"}`)})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, bc.batchSizes())
+}
+
+func TestDelivery_RetryResendsOnlyUntakenEvents(t *testing.T) {
+	// the batch is split; the collector takes the first half and fails the
+	// second once
+	bc, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return true
+		case 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = url
+		cfg.EventBatchMaxAttempts = 2
+	})
+
+	env.srv.sendBatch([][]byte{[]byte(`{"request_id":"a"}`), []byte(`{"request_id":"b"}`), []byte(`{"request_id":"c"}`)})
+	require.Equal(t, []int{1, 2}, bc.batchSizes())
+	require.Equal(t, "a", bc.batches[0][0].RequestID)
+	require.Equal(t, "b", bc.batches[1][0].RequestID)
+	require.Contains(t, scrapeMetrics(t, env), "llm_proxy_collector_post_failures_total 0")
+}
+
+func TestDelivery_SingleEventFallbackResumesAfterFailure(t *testing.T) {
+	bc, url := newBatchCollector(t, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/batch"):
+			http.NotFound(w, r)
+			return true
+		case n == 3:
+			w.WriteHeader(http.StatusBadGateway)
+			return true
+		}
+		return false
+	})
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { cfg.CollectorURL = url })
+
+	n, err := env.srv.postBatch([][]byte{[]byte(`{"request_id":"a"}`), []byte(`{"request_id":"b"}`)})
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, bc.singles, 1)
+	require.Equal(t, "a", bc.singles[0].RequestID)
+}
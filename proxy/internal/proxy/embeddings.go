@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// EmbeddingsProvider is implemented by providers that can serve
+// /v1/embeddings. The body is forwarded as sent by the client.
+type EmbeddingsProvider interface {
+	NewEmbeddingsRequest(ctx context.Context, up *Upstream, in http.Header, body io.Reader, size int64) (*http.Request, error)
+}
+
+// embeddingsRequest holds what routing and metering need from an
+// embeddings request body.
+type embeddingsRequest struct {
+	Model          string
+	InputCount     int
+	Dimensions     int
+	EncodingFormat string
+	// modelStart and modelEnd locate the raw "model" value in the body so
+	// that it can be replaced without re-encoding the (possibly huge) input.
+	modelStart, modelEnd int64
+}
+
+func (s *Server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	g := s.beginRequest(w, r, "/v1/embeddings")
+	defer s.finishRequest(g)
+	w = g.w
+	if !s.authenticateRequest(g, r) {
+		return
+	}
+
+	body, ok := s.readRequestBody(g, r, s.cfg.EmbeddingsMaxBodyBytes)
+	if !ok {
+		return
+	}
+	defer body.Close()
+
+	ereq, err := scanEmbeddingsRequest(body.Reader())
+	if err != nil {
+		WriteOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request",
+			"invalid JSON body: "+err.Error())
+		return
+	}
+
+	targets, ok := s.routeRequest(g, ereq.Model)
+	if !ok {
+		return
+	}
+	adm, ok := s.admitRequest(g, int(body.Size()/4)+1)
+	if !ok {
+		return
+	}
+
+	res, err := s.sendWithFailover(g.ctx, targets, func(t RouteTarget) (*http.Request, error) {
+		ep, ok := t.Upstream.Provider.(EmbeddingsProvider)
+		if !ok {
+			return nil, fmt.Errorf("%w: upstream %q does not support embeddings", ErrTranslateRequest, t.Upstream.Name)
+		}
+		rd, n := body.Reader(), body.Size()
+		if t.Model != ereq.Model && ereq.modelEnd > 0 {
+			raw, _ := json.Marshal(t.Model)
+			rd, n = body.Replace(ereq.modelStart, ereq.modelEnd, raw)
+		}
+		return ep.NewEmbeddingsRequest(g.ctx, t.Upstream, r.Header, rd, n)
+	})
+	up := res.target.Upstream
+	g.rm.upstream = up.Name
+	if err != nil {
+		adm.Reconcile(0)
+		s.failUpstream(g, r, res, err)
+		return
+	}
+	upResp := res.resp
+	defer upResp.Body.Close()
+
+	out, copyErr := relayEmbeddings(w, upResp)
+
+	ev := g.event(up.Provider.Name(), up.Name, FirstNonEmpty(out.Model, res.target.Model, "unknown"))
+	ev.StatusCode = upResp.StatusCode
+	ev.ErrorClass = classifyUpstreamStatus(upResp.StatusCode)
+	ev.Attempts = attemptsForEvent(res.attempts)
+	g.recordResponse(&ev, res, nil)
+	g.markAborted(&ev, r, copyErr)
+	ev.InputCount = ereq.InputCount
+	if upResp.StatusCode/100 == 2 {
+		ev.EmbeddingDimensions = FirstNonZero(out.Dimensions, ereq.Dimensions)
+	}
+	if u := out.Usage; u != nil {
+		ev.PromptTokens = u.PromptTokens
+		ev.TotalTokens = u.TotalTokens
+	}
+	s.priceEvent(&ev, out.Usage)
+	g.rm.usage = out.Usage
+	reconcileUsage(adm, upResp.StatusCode, out.Usage)
+	s.meter(g, ev)
+
+	if copyErr != nil {
+		log.Printf("proxy copy error request_id=%s endpoint=embeddings status=%d class=%s err=%v",
+			g.id, upResp.StatusCode, ev.ErrorClass, copyErr)
+	}
+}
+
+// scanEmbeddingsRequest reads the top-level fields of an embeddings request
+// token by token, so large inputs are never decoded into memory at once.
+func scanEmbeddingsRequest(r io.Reader) (embeddingsRequest, error) {
+	var er embeddingsRequest
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return er, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return er, err
+		}
+		switch key {
+		case "model":
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return er, err
+			}
+			if err := json.Unmarshal(raw, &er.Model); err != nil {
+				return er, fmt.Errorf("model: %w", err)
+			}
+			er.modelEnd = dec.InputOffset()
+			er.modelStart = er.modelEnd - int64(len(raw))
+		case "input":
+			if er.InputCount, err = countInputs(dec); err != nil {
+				return er, fmt.Errorf("input: %w", err)
+			}
+		case "dimensions":
+			if err := dec.Decode(&er.Dimensions); err != nil {
+				return er, fmt.Errorf("dimensions: %w", err)
+			}
+		case "encoding_format":
+			if err := dec.Decode(&er.EncodingFormat); err != nil {
+				return er, fmt.Errorf("encoding_format: %w", err)
+			}
+		default:
+			if err := skipValue(dec); err != nil {
+				return er, err
+			}
+		}
+	}
+	return er, expectDelim(dec, '}')
+}
+
+// countInputs counts the inputs of an embeddings request: a string, an
+// array of strings, an array of token IDs (one input) or an array of token
+// ID arrays.
+func countInputs(dec *json.Decoder) (int, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if d, ok := tok.(json.Delim); !ok {
+		return 1, nil
+	} else if d != '[' {
+		return 0, fmt.Errorf("unexpected %v", d)
+	}
+
+	n, tokenIDs := 0, false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		switch tok.(type) {
+		case json.Delim:
+			if err := skipRest(dec); err != nil {
+				return 0, err
+			}
+		case float64:
+			tokenIDs = true
+		}
+		n++
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return 0, err
+	}
+	if tokenIDs {
+		return 1, nil
+	}
+	return n, nil
+}
+
+type embeddingsResult struct {
+	Model      string
+	Usage      *Usage
+	Dimensions int
+}
+
+// relayEmbeddings copies an embeddings response to the client while reading
+// the model, usage and dimensions from it. Responses can be far larger than
+// the metering capture buffer, so the JSON is scanned as it streams through.
+func relayEmbeddings(w http.ResponseWriter, resp *http.Response) (embeddingsResult, error) {
+	copyResponseHeaders(w, resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+
+	var out embeddingsResult
+	tee := io.TeeReader(resp.Body, w)
+	if resp.StatusCode/100 == 2 {
+		// a malformed body is still relayed; only metering loses detail
+		_ = scanEmbeddingsResponse(json.NewDecoder(tee), &out)
+	}
+	_, err := io.Copy(io.Discard, tee)
+	return out, err
+}
+
+func scanEmbeddingsResponse(dec *json.Decoder, out *embeddingsResult) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "model":
+			err = dec.Decode(&out.Model)
+		case "usage":
+			err = dec.Decode(&out.Usage)
+		case "data":
+			err = scanEmbeddingsData(dec, out)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// scanEmbeddingsData walks the data array and takes the dimensions from the
+// first embedding (a float array, or base64 of little-endian float32s).
+func scanEmbeddingsData(dec *json.Decoder, out *embeddingsResult) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := expectDelim(dec, '{'); err != nil {
+			return err
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if key != "embedding" || out.Dimensions > 0 {
+				if err := skipValue(dec); err != nil {
+					return err
+				}
+				continue
+			}
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			switch v := tok.(type) {
+			case string:
+				out.Dimensions = base64.StdEncoding.DecodedLen(len(v)) / 4
+				if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+					out.Dimensions = len(b) / 4
+				}
+			case json.Delim:
+				n := 0
+				for dec.More() {
+					if _, err := dec.Token(); err != nil {
+						return err
+					}
+					n++
+				}
+				if _, err := dec.Token(); err != nil {
+					return err
+				}
+				out.Dimensions = n
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// skipValue skips the next JSON value without keeping it in memory.
+func skipValue(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); ok && (d == '{' || d == '[') {
+		return skipRest(dec)
+	}
+	return nil
+}
+
+// skipRest skips to the end of the array or object whose opening delimiter
+// was just read.
+func skipRest(dec *json.Decoder) error {
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+			default:
+				depth--
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanEmbeddingsRequest(t *testing.T) {
+	tests := []struct {
+		body   string
+		inputs int
+	}{
+		{`{"model":"text-embedding-3-small","input":"hello"}`, 1},
+		{`{"input":["a","b","c"],"model":"text-embedding-3-small"}`, 3},
+		{`{"model":"text-embedding-3-small","input":[1,2,3]}`, 1},
+		{`{"model":"text-embedding-3-small","input":[[1,2],[3],[4,5,6]]}`, 3},
+		{`{"model":"text-embedding-3-small","input":[],"user":{"x":[1,{"y":2}]}}`, 0},
+	}
+	for _, tt := range tests {
+		er, err := scanEmbeddingsRequest(strings.NewReader(tt.body))
+		require.NoError(t, err, tt.body)
+		require.Equal(t, "text-embedding-3-small", er.Model, tt.body)
+		require.Equal(t, tt.inputs, er.InputCount, tt.body)
+		require.Equal(t, `"text-embedding-3-small"`, tt.body[er.modelStart:er.modelEnd], tt.body)
+	}
+
+	er, err := scanEmbeddingsRequest(strings.NewReader(`{"model" : "m", "dimensions": 256, "encoding_format": "base64"}`))
+	require.NoError(t, err)
+	require.Equal(t, 256, er.Dimensions)
+	require.Equal(t, "base64", er.EncodingFormat)
+
+	for _, bad := range []string{``, `[]`, `{"model":1}`, `{"model":"m","input":[`, `{"model":"m"`} {
+		_, err := scanEmbeddingsRequest(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	b, err := readBody(strings.NewReader("0123456789"), 4, 100)
+	require.NoError(t, err)
+	defer b.Close()
+	require.NotNil(t, b.file)
+	require.Equal(t, int64(10), b.Size())
+
+	all, err := io.ReadAll(b.Reader())
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(all))
+
+	r, n := b.Replace(2, 5, []byte("xy"))
+	all, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "01xy56789", string(all))
+	require.Equal(t, int64(9), n)
+
+	small, err := readBody(strings.NewReader("abc"), 4, 100)
+	require.NoError(t, err)
+	require.Nil(t, small.file)
+	small.Close()
+
+	_, err = readBody(strings.NewReader(strings.Repeat("x", 101)), 4, 100)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	_, err = readBody(strings.NewReader(strings.Repeat("x", 11)), 100, 10)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func embeddingsResponse(n, dims int, b64 bool) string {
+	var sb strings.Builder
+	sb.WriteString(`{"object":"list","data":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `{"object":"embedding","index":%d,"embedding":`, i)
+		if b64 {
+			sb.WriteString(`"` + base64.StdEncoding.EncodeToString(make([]byte, 4*dims)) + `"`)
+		} else {
+			sb.WriteByte('[')
+			for d := 0; d < dims; d++ {
+				if d > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString("-0.0123456")
+			}
+			sb.WriteByte(']')
+		}
+		sb.WriteByte('}')
+	}
+	fmt.Fprintf(&sb, `],"model":"text-embedding-3-small","usage":{"prompt_tokens":%d,"total_tokens":%d}}`, 7*n, 7*n)
+	return sb.String()
+}
+
+func TestRelayEmbeddings(t *testing.T) {
+	for _, b64 := range []bool{false, true} {
+		body := embeddingsResponse(300, 1536, b64)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		rec := httptest.NewRecorder()
+		out, err := relayEmbeddings(rec, resp)
+		require.NoError(t, err)
+		require.Equal(t, body, rec.Body.String())
+		require.Equal(t, 1536, out.Dimensions)
+		require.Equal(t, "text-embedding-3-small", out.Model)
+		require.Equal(t, &Usage{PromptTokens: 2100, TotalTokens: 2100}, out.Usage)
+	}
+
+	// malformed bodies are relayed unchanged
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{"data":[1,`))}
+	rec := httptest.NewRecorder()
+	_, err := relayEmbeddings(rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, `{"data":[1,`, rec.Body.String())
+}
+
+func TestEmbeddings_Proxy(t *testing.T) {
+	var seen struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}
+	var seenLen int64
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/embeddings", r.URL.Path)
+		require.Equal(t, "Bearer team-key", r.Header.Get("Authorization"))
+		seenLen = r.ContentLength
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&seen))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(embeddingsResponse(len(seen.Input), 256, false)))
+	}, func(cfg *Config) {
+		cfg.RequestMemoryBufferBytes = 1 << 10
+		p := t.TempDir() + "/routes.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`
+upstreams:
+  - {name: team, provider: openai, base_url: "`+cfg.UpstreamBaseURL+`", api_key: team-key}
+  - {name: claude, provider: anthropic, base_url: "`+cfg.UpstreamBaseURL+`", api_key: x}
+routes:
+  - {match: "team/*", upstream: team, strip_prefix: "team/"}
+  - {match: "claude-*", upstream: claude}
+`), 0o600))
+		cfg.RoutesFile = p
+	})
+
+	// large enough to be spooled to disk
+	inputs := make([]string, 500)
+	for i := range inputs {
+		inputs[i] = strings.Repeat("lorem ipsum ", 10)
+	}
+	in, _ := json.Marshal(inputs)
+	body := `{"input":` + string(in) + `,"model":"team/text-embedding-3-small","dimensions":256}`
+
+	rec := env.do(t, "/v1/embeddings", "dummy", body, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text-embedding-3-small", seen.Model)
+	require.Len(t, seen.Input, 500)
+	require.Equal(t, int64(len(body)-len("team/")), seenLen)
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "/v1/embeddings", ev.Endpoint)
+	require.Equal(t, "team", ev.Upstream)
+	require.Equal(t, 500, ev.InputCount)
+	require.Equal(t, 256, ev.EmbeddingDimensions)
+	require.Equal(t, 3500, ev.PromptTokens)
+	require.Equal(t, 0, ev.CompletionTokens)
+
+	rec = env.do(t, "/v1/embeddings", "dummy", `{"model":"claude-3","input":"x"}`, nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, decodeOpenAIError(t, rec).Message, "does not support embeddings")
+	env.nextEvent(t)
+
+	rec = env.do(t, "/v1/embeddings", "dummy", `{"model":`, nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "invalid_request", decodeOpenAIError(t, rec).Code)
+}
+
+func TestEmbeddings_BodyTooLarge(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.RequestMemoryBufferBytes = 16
+		cfg.EmbeddingsMaxBodyBytes = 64
+	})
+	body := `{"model":"text-embedding-3-small","input":"` + string(bytes.Repeat([]byte("x"), 100)) + `"}`
+	rec := env.do(t, "/v1/embeddings", "dummy", body, nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Equal(t, "request_too_large", decodeOpenAIError(t, rec).Code)
+	require.Equal(t, ErrorClassInvalidRequest, env.nextEvent(t).ErrorClass)
+}
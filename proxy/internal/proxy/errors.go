@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+type OpenAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    string  `json:"code"`
+	Param   *string `json:"param"`
+}
+
+type openAIErrorEnvelope struct {
+	Error OpenAIError `json:"error"`
+}
+
+// WriteOpenAIError writes a gateway-originated error using the OpenAI error
+// envelope so that OpenAI SDKs can parse it.
+func WriteOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.errCode = code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(openAIErrorEnvelope{Error: OpenAIError{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+}
+
+// Error classes recorded as MeteringEvent.ErrorClass. They separate client
+// faults (auth, rate_limit, invalid_request, client_cancel) from provider
+// faults (upstream_*) and the gateway's own failures.
+const (
+	ErrorClassAuth              = "auth"
+	ErrorClassRateLimit         = "rate_limit"
+	ErrorClassInvalidRequest    = "invalid_request"
+	ErrorClassClientCancel      = "client_cancel"
+	ErrorClassUpstreamTimeout   = "upstream_timeout"
+	ErrorClassUpstream5xx       = "upstream_5xx"
+	ErrorClassUpstreamRateLimit = "upstream_rate_limit"
+	ErrorClassUpstreamAuth      = "upstream_auth"
+	ErrorClassUpstreamError     = "upstream_error"
+	ErrorClassGateway           = "gateway"
+)
+
+// Values of MeteringEvent.AbortedBy: who cut an upstream call short.
+const (
+	AbortedByClient   = "client"
+	AbortedByUpstream = "upstream"
+	AbortedByTimeout  = "timeout"
+)
+
+// abortedBy maps the classes of classifyTransportError to who aborted.
+var abortedBy = map[string]string{
+	ErrorClassClientCancel:    AbortedByClient,
+	ErrorClassUpstreamTimeout: AbortedByTimeout,
+	ErrorClassUpstreamError:   AbortedByUpstream,
+}
+
+// StatusClientClosedRequest is recorded when the client went away before a
+// response was written (nginx's 499).
+const StatusClientClosedRequest = 499
+
+// gatewayErrorClasses maps the codes of gateway-originated errors to their
+// error class.
+var gatewayErrorClasses = map[string]string{
+	"missing_api_key":         ErrorClassAuth,
+	"invalid_api_key":         ErrorClassAuth,
+	"key_expired":             ErrorClassAuth,
+	"key_disabled":            ErrorClassAuth,
+	"model_not_allowed":       ErrorClassAuth,
+	"tenant_not_allowed":      ErrorClassAuth,
+	"path_not_allowed":        ErrorClassAuth,
+	"origin_not_allowed":      ErrorClassAuth,
+	"rate_limit_exceeded":     ErrorClassRateLimit,
+	"method_not_allowed":      ErrorClassInvalidRequest,
+	"request_body_unreadable": ErrorClassInvalidRequest,
+	"request_too_large":       ErrorClassInvalidRequest,
+	"invalid_request":         ErrorClassInvalidRequest,
+	"model_not_found":         ErrorClassInvalidRequest,
+	"upstream_timeout":        ErrorClassUpstreamTimeout,
+	"upstream_unreachable":    ErrorClassUpstreamError,
+	"gateway_internal_error":  ErrorClassGateway,
+}
+
+// classifyUpstreamStatus returns the error class of a response relayed
+// from an upstream, or "" for successful responses.
+func classifyUpstreamStatus(status int) string {
+	switch {
+	case status < 400:
+		return ""
+	case status == http.StatusTooManyRequests:
+		return ErrorClassUpstreamRateLimit
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		// the gateway's upstream credentials were rejected
+		return ErrorClassUpstreamAuth
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrorClassUpstreamTimeout
+	case status >= 500:
+		return ErrorClassUpstream5xx
+	default:
+		return ErrorClassInvalidRequest
+	}
+}
+
+// classifyTransportError classifies a failed upstream call or an error
+// while relaying the response body.
+func classifyTransportError(ctx context.Context, err error) string {
+	if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrorClassClientCancel
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return ErrorClassUpstreamTimeout
+	}
+	return ErrorClassUpstreamError
+}
+
+// streamErrorClasses maps the error types and codes of OpenAI, Anthropic
+// and Responses API in-stream errors to error classes.
+var streamErrorClasses = map[string]string{
+	"rate_limit_exceeded":     ErrorClassUpstreamRateLimit,
+	"rate_limit_error":        ErrorClassUpstreamRateLimit,
+	"insufficient_quota":      ErrorClassUpstreamRateLimit,
+	"server_error":            ErrorClassUpstream5xx,
+	"api_error":               ErrorClassUpstream5xx,
+	"overloaded_error":        ErrorClassUpstream5xx,
+	"timeout":                 ErrorClassUpstreamTimeout,
+	"authentication_error":    ErrorClassUpstreamAuth,
+	"permission_error":        ErrorClassUpstreamAuth,
+	"invalid_api_key":         ErrorClassUpstreamAuth,
+	"invalid_request_error":   ErrorClassInvalidRequest,
+	"invalid_prompt":          ErrorClassInvalidRequest,
+	"context_length_exceeded": ErrorClassInvalidRequest,
+	"request_too_large":       ErrorClassInvalidRequest,
+}
+
+// upstreamStreamError is the error object of an error event sent in the
+// middle of a stream: {"error":{...}} from OpenAI-compatible servers,
+// {"type":"error","error":{...}} from Anthropic.
+type upstreamStreamError struct {
+	Type    string `json:"type"`
+	Code    any    `json:"code"`
+	Message string `json:"message"`
+}
+
+// class returns the error class of the error, by code first, then type;
+// unknown errors are upstream_error.
+func (e *upstreamStreamError) class() string {
+	if e == nil {
+		return ErrorClassUpstreamError
+	}
+	code, _ := e.Code.(string)
+	return classifyStreamError(code, e.Type)
+}
+
+func classifyStreamError(codeOrType ...string) string {
+	for _, s := range codeOrType {
+		if class, ok := streamErrorClasses[s]; ok {
+			return class
+		}
+	}
+	return ErrorClassUpstreamError
+}
+
+// writeUpstreamFailure answers a request for which no upstream response
+// could be obtained and returns the status and error class to record.
+func writeUpstreamFailure(ctx context.Context, w http.ResponseWriter, err error) (int, string) {
+	switch class := classifyTransportError(ctx, err); class {
+	case ErrorClassClientCancel:
+		// nobody is listening; only record the outcome
+		return StatusClientClosedRequest, class
+	case ErrorClassUpstreamTimeout:
+		WriteOpenAIError(w, http.StatusGatewayTimeout, "server_error", "upstream_timeout",
+			"the upstream did not respond in time")
+		return http.StatusGatewayTimeout, class
+	default:
+		WriteOpenAIError(w, http.StatusBadGateway, "server_error", "upstream_unreachable",
+			"the upstream could not be reached")
+		return http.StatusBadGateway, class
+	}
+}
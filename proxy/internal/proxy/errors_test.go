@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyUpstreamStatus(t *testing.T) {
+	for status, want := range map[int]string{
+		200: "",
+		400: ErrorClassInvalidRequest,
+		401: ErrorClassUpstreamAuth,
+		404: ErrorClassInvalidRequest,
+		429: ErrorClassUpstreamRateLimit,
+		500: ErrorClassUpstream5xx,
+		503: ErrorClassUpstream5xx,
+		504: ErrorClassUpstreamTimeout,
+	} {
+		require.Equal(t, want, classifyUpstreamStatus(status), "status %d", status)
+	}
+}
+
+func TestClassifyTransportError(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, ErrorClassUpstreamError, classifyTransportError(ctx, errors.New("connection refused")))
+	require.Equal(t, ErrorClassUpstreamTimeout, classifyTransportError(ctx, context.DeadlineExceeded))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, ErrorClassClientCancel, classifyTransportError(canceled, context.Canceled))
+}
+
+func TestChatCompletions_GatewayErrorsAreOpenAIShaped(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	env.srv.Mux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, "method_not_allowed", decodeOpenAIError(t, rec).Code)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	env.nextEvent(t)
+}
+
+func TestChatCompletions_BodyTooLarge(t *testing.T) {
+	var calls atomic.Int32
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		okChatUpstream(w, r)
+	}, func(cfg *Config) { cfg.ChatMaxBodyBytes = 64 })
+
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"` + strings.Repeat("x", 100) + `"}]}`
+	rec := env.do(t, "/v1/chat/completions", "dummy", body, nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Equal(t, "request_too_large", decodeOpenAIError(t, rec).Code)
+	require.Equal(t, ErrorClassInvalidRequest, env.nextEvent(t).ErrorClass)
+	require.Zero(t, calls.Load())
+}
+
+func TestChatCompletions_UpstreamUnreachable(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { cfg.UpstreamBaseURL = "http://127.0.0.1:1" })
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	e := decodeOpenAIError(t, rec)
+	require.Equal(t, "upstream_unreachable", e.Code)
+	require.Equal(t, "server_error", e.Type)
+
+	ev := env.nextEvent(t)
+	require.Equal(t, http.StatusBadGateway, ev.StatusCode)
+	require.Equal(t, ErrorClassUpstreamError, ev.ErrorClass)
+	require.Equal(t, "upstream_unreachable", ev.ErrorCode)
+}
+
+func TestChatCompletions_UpstreamTimeout(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}, func(cfg *Config) { cfg.HTTPClientTimeout = 50 * time.Millisecond })
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	require.Equal(t, "upstream_timeout", decodeOpenAIError(t, rec).Code)
+	require.Equal(t, ErrorClassUpstreamTimeout, env.nextEvent(t).ErrorClass)
+}
+
+func TestChatCompletions_Upstream5xxIsClassified(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":{"message":"boom","type":"server_error","code":null,"param":null}}`))
+	}, nil)
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), "boom")
+
+	ev := env.nextEvent(t)
+	require.Equal(t, ErrorClassUpstream5xx, ev.ErrorClass)
+	require.Empty(t, ev.ErrorCode)
+}
+
+func TestChatCompletions_ClientCancel(t *testing.T) {
+	started := make(chan struct{})
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		close(started)
+		<-r.Context().Done()
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+	req.Body = io.NopCloser(strings.NewReader(`{"model":"gpt-4o-mini"}`))
+	req.Header.Set("Authorization", "Bearer dummy")
+	rec := httptest.NewRecorder()
+	env.srv.Mux().ServeHTTP(rec, req)
+
+	ev := env.nextEvent(t)
+	require.Equal(t, StatusClientClosedRequest, ev.StatusCode)
+	require.Equal(t, ErrorClassClientCancel, ev.ErrorClass)
+	require.True(t, ev.Aborted)
+	require.Equal(t, AbortedByClient, ev.AbortedBy)
+}
+
+// streamingUpstream sends a content chunk, then calls then with the
+// connection still open.
+func streamingUpstream(then func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"id\":\"1\",\"model\":\"gpt-4o-mini\",\"choices\":[{\"delta\":{\"content\":\"tiktoken is great!\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		then(w, r)
+	}
+}
+
+func TestChatCompletions_StreamClientDisconnect(t *testing.T) {
+	upstreamGone := make(chan struct{})
+	env := newTestEnv(t, streamingUpstream(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamGone)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+				_, _ = w.Write([]byte("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\" more\"}}]}\n\n"))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}), nil)
+	proxySrv := httptest.NewServer(env.srv.Mux())
+	t.Cleanup(proxySrv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxySrv.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer dummy")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, err = resp.Body.Read(make([]byte, 64))
+	require.NoError(t, err)
+	cancel()
+	_ = resp.Body.Close()
+
+	select {
+	case <-upstreamGone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request not cancelled")
+	}
+	ev := env.nextEvent(t)
+	require.True(t, ev.Aborted)
+	require.Equal(t, AbortedByClient, ev.AbortedBy)
+	require.Equal(t, ErrorClassClientCancel, ev.ErrorClass)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+	require.GreaterOrEqual(t, ev.CompletionTokens, 6)
+}
+
+// brokenWriter fails every body write, like a connection the client closed
+// before the server noticed.
+type brokenWriter struct{ *httptest.ResponseRecorder }
+
+func (brokenWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestChatCompletions_StreamWriteFailureCancelsUpstream(t *testing.T) {
+	upstreamGone := make(chan struct{})
+	env := newTestEnv(t, streamingUpstream(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(upstreamGone)
+	}), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","stream":true}`))
+	req.Header.Set("Authorization", "Bearer dummy")
+	env.srv.Mux().ServeHTTP(brokenWriter{httptest.NewRecorder()}, req)
+
+	select {
+	case <-upstreamGone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request not cancelled")
+	}
+	ev := env.nextEvent(t)
+	require.Equal(t, AbortedByClient, ev.AbortedBy)
+	require.Equal(t, ErrorClassClientCancel, ev.ErrorClass)
+	require.Equal(t, 6, ev.CompletionTokens)
+}
+
+func TestChatCompletions_StreamAborted(t *testing.T) {
+	for name, tc := range map[string]struct {
+		then    func(w http.ResponseWriter, r *http.Request)
+		by      string
+		class   string
+		timeout time.Duration
+	}{
+		"upstream": {
+			then: func(w http.ResponseWriter, _ *http.Request) {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				_ = conn.Close()
+			},
+			by:    AbortedByUpstream,
+			class: ErrorClassUpstreamError,
+		},
+		"timeout": {
+			then:    func(_ http.ResponseWriter, r *http.Request) { <-r.Context().Done() },
+			by:      AbortedByTimeout,
+			class:   ErrorClassUpstreamTimeout,
+			timeout: 300 * time.Millisecond,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, streamingUpstream(tc.then), func(cfg *Config) {
+				if tc.timeout > 0 {
+					cfg.HTTPClientTimeout = tc.timeout
+				}
+			})
+			rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true}`, nil)
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Contains(t, rec.Body.String(), "tiktoken is great!")
+
+			ev := env.nextEvent(t)
+			require.True(t, ev.Aborted)
+			require.Equal(t, tc.by, ev.AbortedBy)
+			require.Equal(t, tc.class, ev.ErrorClass)
+			require.Equal(t, 6, ev.CompletionTokens)
+			require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+		})
+	}
+}
+
+func TestChatCompletions_InStreamError(t *testing.T) {
+	env := newTestEnv(t, streamingUpstream(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("data: {\"error\":{\"message\":\"The server had an error\",\"type\":\"server_error\",\"param\":null,\"code\":null}}\n\n"))
+	}), nil)
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "The server had an error")
+
+	ev := env.nextEvent(t)
+	require.Equal(t, http.StatusOK, ev.StatusCode)
+	require.Equal(t, ErrorClassUpstream5xx, ev.ErrorClass)
+	require.False(t, ev.Aborted)
+	require.Equal(t, 6, ev.CompletionTokens)
+}
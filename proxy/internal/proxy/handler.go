@@ -1,29 +1,50 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	cfg             Config
-	upstreamClient  *http.Client
 	collectorClient *http.Client
+	keys            *KeyStore
+	router          *Router
+	limiter         *RateLimiter
+	prices          *PriceCatalog
+	metrics         *Metrics
 
 	events  chan MeteringEvent
+	batches chan [][]byte
 	dropped uint64
+	// spool holds events until the collector accepts them; nil drops them
+	spool *Spool
+
+	// shutdown state, see Shutdown
+	draining atomic.Bool
+	requests sync.WaitGroup
+	closing  chan struct{} // closed to end Realtime sessions
+	stop     chan struct{} // closed to stop the event senders
+	senders  sync.WaitGroup
+	// delivery is the context of collector posts; Shutdown cancels it
+	// shortly before the flush deadline so that the rest can be spooled.
+	delivery       context.Context
+	cancelDelivery context.CancelFunc
 }
 
-func NewServer(cfg Config) *Server {
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.KeysFile == "" && !cfg.OpenMode {
+		return nil, errors.New("GATEWAY_KEYS_FILE is required (or set GATEWAY_OPEN_MODE=true to accept any bearer token)")
+	}
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
@@ -38,41 +59,98 @@ func NewServer(cfg Config) *Server {
 		ForceAttemptHTTP2:     true,
 	}
 
+	if cfg.AllowedPaths == nil {
+		cfg.AllowedPaths = DefaultAllowedPaths
+	}
+	cfg = withDeliveryDefaults(cfg)
 	s := &Server{
 		cfg: cfg,
-		upstreamClient: &http.Client{
-			Timeout:   cfg.HTTPClientTimeout,
-			Transport: transport,
-		},
 		collectorClient: &http.Client{
-			Timeout:   800 * time.Millisecond,
+			Timeout:   cfg.CollectorTimeout,
 			Transport: transport,
 		},
-		events: make(chan MeteringEvent, cfg.EventQueueSize),
+		events:  make(chan MeteringEvent, cfg.EventQueueSize),
+		batches: make(chan [][]byte),
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	s.delivery, s.cancelDelivery = context.WithCancel(context.Background())
+	s.metrics = newMetrics(s)
+
+	var err error
+	if cfg.RoutesFile != "" {
+		s.router, err = LoadRoutes(cfg.RoutesFile, cfg, transport)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("routing: loaded %d upstreams from %s", s.router.Len(), cfg.RoutesFile)
+	} else {
+		s.router, err = DefaultRouter(cfg, transport)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	go s.backgroundSender()
+	if cfg.RateLimitsFile != "" {
+		b, err := os.ReadFile(cfg.RateLimitsFile)
+		if err != nil {
+			return nil, err
+		}
+		rlc, err := ParseRateLimitConfig(b)
+		if err != nil {
+			return nil, err
+		}
+		s.limiter = NewRateLimiter(rlc)
+		if cfg.RateLimitsReloadInterval > 0 {
+			go s.watchRateLimits(cfg.RateLimitsFile, cfg.RateLimitsReloadInterval)
+		}
+		log.Printf("ratelimit: loaded limits from %s", cfg.RateLimitsFile)
+	}
 
-	return s
-}
+	if cfg.PriceCatalogFile != "" {
+		s.prices, err = LoadPriceCatalog(cfg.PriceCatalogFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("metering: loaded %d prices (version %s) from %s", len(s.prices.Prices), s.prices.Version, cfg.PriceCatalogFile)
+	}
 
-func (s *Server) backgroundSender() {
-	ticker := time.NewTicker(s.cfg.EventFlushTimeout)
-	defer ticker.Stop()
+	if cfg.KeysFile != "" {
+		ks, err := LoadKeyStore(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = ks
+		log.Printf("auth: loaded %d gateway keys from %s", ks.Len(), cfg.KeysFile)
+	} else {
+		log.Printf("auth: GATEWAY_OPEN_MODE set; gateway keys are NOT validated")
+	}
+	if cfg.KeyHMACSecret == "" {
+		log.Printf("metering: GATEWAY_KEY_HMAC_SECRET not set; unmatched keys are fingerprinted with plain SHA-256")
+	}
 
-	for {
-		select {
-		case ev := <-s.events:
-			if err := postEvent(s.collectorClient, s.cfg.CollectorURL, ev); err != nil {
-				log.Printf("collector post failed (drop): %v", err)
-			}
-		case <-ticker.C:
-			d := atomic.LoadUint64(&s.dropped)
-			if d > 0 {
-				log.Printf("metering: dropped_events=%d (queue full or overload)", d)
-			}
+	if cfg.EventSpoolDir != "" {
+		s.spool, err = OpenSpool(cfg.EventSpoolDir, SpoolOptions{
+			MaxBytes:     cfg.EventSpoolMaxBytes,
+			SegmentBytes: cfg.EventSpoolSegmentBytes,
+			Fsync:        cfg.EventSpoolFsync,
+		})
+		if err != nil {
+			return nil, err
 		}
+		log.Printf("metering: spooling undelivered events to %s (%d bytes pending, max %d, fsync %s)",
+			cfg.EventSpoolDir, s.spool.Bytes(), cfg.EventSpoolMaxBytes, cfg.EventSpoolFsync)
+		s.senders.Add(1)
+		go s.replaySpool()
 	}
+
+	s.senders.Add(cfg.EventSenderWorkers + 1)
+	for i := 0; i < cfg.EventSenderWorkers; i++ {
+		go s.batchSender()
+	}
+	go s.backgroundSender()
+
+	return s, nil
 }
 
 func (s *Server) Mux() *http.ServeMux {
@@ -82,198 +160,121 @@ func (s *Server) Mux() *http.ServeMux {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/readyz", s.handleReady)
 
+	mux.Handle("/metrics", s.metrics.Handler())
 	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("/v1/embeddings", s.handleEmbeddings)
+	mux.HandleFunc("/v1/responses", s.handleResponses)
+	mux.HandleFunc("/v1/realtime", s.handleRealtime)
+	mux.HandleFunc("/v1/", s.handlePassthrough)
 
 	return mux
 }
 
 func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 		return
 	}
 
-	start := time.Now()
-	requestID := NewReqID()
-
-	tenant := FirstNonEmpty(
-		r.Header.Get("X-LLM-Tenant"),
-		r.Header.Get("X-Tenant"),
-		"default",
-	)
-
-	appKey := BearerToken(r.Header.Get("Authorization"))
-	if appKey == "" {
-		http.Error(w, "missing Authorization bearer token (gateway key)", http.StatusUnauthorized)
+	g := s.beginRequest(w, r, "/v1/chat/completions")
+	defer s.finishRequest(g)
+	w = g.w
+	if !s.authenticateRequest(g, r) {
 		return
 	}
 
-	reqBody, err := io.ReadAll(io.LimitReader(r.Body, 8<<20))
-	if err != nil {
-		http.Error(w, "failed to read body", http.StatusBadRequest)
+	reqBody, ok := s.readRequestBytes(g, r, s.cfg.ChatMaxBodyBytes)
+	if !ok {
 		return
 	}
-	_ = r.Body.Close()
 
 	var oreq OpenAIRequest
 	_ = json.Unmarshal(reqBody, &oreq)
 
-	upURL := strings.TrimRight(s.cfg.UpstreamBaseURL, "/") + "/v1/chat/completions"
-	upReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upURL, bytes.NewReader(reqBody))
-	if err != nil {
-		http.Error(w, "failed to create upstream request", http.StatusInternalServerError)
+	targets, ok := s.routeRequest(g, oreq.Model)
+	if !ok {
 		return
 	}
-	upReq.Header.Set("Content-Type", "application/json")
-	upReq.Header.Set("Authorization", "Bearer "+s.cfg.UpstreamAPIKey)
 
-	if org := r.Header.Get("OpenAI-Organization"); org != "" {
-		upReq.Header.Set("OpenAI-Organization", org)
-	}
-	if beta := r.Header.Get("OpenAI-Beta"); beta != "" {
-		upReq.Header.Set("OpenAI-Beta", beta)
-	}
-	if proj := r.Header.Get("OpenAI-Project"); proj != "" {
-		upReq.Header.Set("OpenAI-Project", proj)
+	adm, ok := s.admitRequest(g, estimatePromptTokens(reqBody))
+	if !ok {
+		return
 	}
 
-	upResp, err := s.upstreamClient.Do(upReq)
+	res, err := s.sendWithFailover(g.ctx, targets, func(t RouteTarget) (*http.Request, error) {
+		body, treq := reqBody, oreq
+		if t.Model != oreq.Model {
+			b, err := rewriteModel(reqBody, t.Model)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid JSON body", ErrTranslateRequest)
+			}
+			body, treq.Model = b, t.Model
+		}
+		return t.Upstream.Provider.NewChatRequest(g.ctx, t.Upstream, r.Header, body, &treq)
+	})
+	up, provider := res.target.Upstream, res.target.Upstream.Provider
+	g.rm.upstream = up.Name
+	oreq.Model = res.target.Model
 	if err != nil {
-		http.Error(w, "upstream request failed", http.StatusBadGateway)
-		s.enqueue(MeteringEvent{
-			RequestID:        requestID,
-			Tenant:           tenant,
-			AppKey:           appKey,
-			Provider:         "openai",
-			Model:            FirstNonEmpty(oreq.Model, "unknown"),
-			LatencyMs:        time.Since(start).Milliseconds(),
-			StatusCode:       0,
-			At:               time.Now().UTC(),
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		})
+		adm.Reconcile(0)
+		s.failUpstream(g, r, res, err)
 		return
 	}
+	upResp := res.resp
 	defer upResp.Body.Close()
 
-	for k, vals := range upResp.Header {
-		if IsHopByHopHeader(k) {
-			continue
-		}
-		for _, v := range vals {
-			w.Header().Add(k, v)
-		}
-	}
-	w.Header().Set("X-LLM-Request-ID", requestID)
-	w.WriteHeader(upResp.StatusCode)
-
+	var (
+		seenModel string
+		seenUsage *Usage
+		copyErr   error
+		stats     *StreamStats
+	)
 	if oreq.Stream {
-		seenModel, seenUsage, copyErr := StreamSSE(w, upResp.Body)
-		lat := time.Since(start)
-
-		model := FirstNonEmpty(seenModel, oreq.Model, "unknown")
-		ev := MeteringEvent{
-			RequestID:        requestID,
-			Tenant:           tenant,
-			AppKey:           appKey,
-			Provider:         "openai",
-			Model:            model,
-			LatencyMs:        lat.Milliseconds(),
-			StatusCode:       upResp.StatusCode,
-			At:               time.Now().UTC(),
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		}
-		if seenUsage != nil {
-			ev.PromptTokens = seenUsage.PromptTokens
-			ev.CompletionTokens = seenUsage.CompletionTokens
-			ev.TotalTokens = seenUsage.TotalTokens
-		}
-		s.enqueue(ev)
-
-		if copyErr != nil {
-			log.Printf("proxy stream copy error request_id=%s status=%d err=%v", requestID, upResp.StatusCode, copyErr)
-		}
-		return
-	}
-
-	capWriter := NewLimitedCapture(s.cfg.MeteringCaptureBytes)
-	tee := io.TeeReader(upResp.Body, capWriter)
-
-	var out io.Writer = w
-	if fl, ok := w.(http.Flusher); ok {
-		out = &flushWriter{w: w, fl: fl}
+		stats = s.metrics.streamStats(g.rm)
+		seenModel, seenUsage, copyErr = provider.WriteStream(w, upResp, &oreq, stats)
+	} else {
+		seenModel, seenUsage, copyErr = provider.WriteResponse(w, upResp, &oreq)
 	}
 
-	_, copyErr := io.Copy(out, tee)
-	lat := time.Since(start)
-
-	captured := capWriter.Bytes()
-	var oresp OpenAIResponse
-	if len(captured) > 0 {
-		_ = json.Unmarshal(captured, &oresp)
-	}
-
-	model := FirstNonEmpty(oresp.Model, oreq.Model, "unknown")
-
-	ev := MeteringEvent{
-		RequestID:        requestID,
-		Tenant:           tenant,
-		AppKey:           appKey,
-		Provider:         "openai",
-		Model:            model,
-		LatencyMs:        lat.Milliseconds(),
-		StatusCode:       upResp.StatusCode,
-		At:               time.Now().UTC(),
-		PromptTokens:     0,
-		CompletionTokens: 0,
-		TotalTokens:      0,
-	}
-	if oresp.Usage != nil {
-		ev.PromptTokens = oresp.Usage.PromptTokens
-		ev.CompletionTokens = oresp.Usage.CompletionTokens
-		ev.TotalTokens = oresp.Usage.TotalTokens
+	ev := g.event(provider.Name(), up.Name, FirstNonEmpty(seenModel, oreq.Model, "unknown"))
+	ev.StatusCode = upResp.StatusCode
+	ev.ErrorClass = classifyUpstreamStatus(upResp.StatusCode)
+	ev.Attempts = attemptsForEvent(res.attempts)
+	g.recordResponse(&ev, res, stats)
+	g.markAborted(&ev, r, copyErr)
+	if seenUsage != nil {
+		ev.PromptTokens = seenUsage.PromptTokens
+		ev.CompletionTokens = seenUsage.CompletionTokens
+		ev.TotalTokens = seenUsage.TotalTokens
+		ev.CachedTokens = seenUsage.CachedTokens()
+		ev.ReasoningTokens = seenUsage.ReasoningTokens()
+		ev.UsageSource = UsageSourceUpstream
+		if seenUsage.Estimated {
+			ev.UsageSource = UsageSourceEstimated
+		}
 	}
-	s.enqueue(ev)
+	s.priceEvent(&ev, seenUsage)
+	g.rm.usage = seenUsage
+	reconcileUsage(adm, upResp.StatusCode, seenUsage)
+	s.meter(g, ev)
 
 	if copyErr != nil {
-		log.Printf("proxy copy error request_id=%s status=%d err=%v", requestID, upResp.StatusCode, copyErr)
-	}
-}
-
-func (s *Server) enqueue(ev MeteringEvent) {
-	select {
-	case s.events <- ev:
-	default:
-		atomic.AddUint64(&s.dropped, 1)
+		log.Printf("proxy copy error request_id=%s provider=%s status=%d stream=%t aborted_by=%s err=%v",
+			g.id, provider.Name(), upResp.StatusCode, oreq.Stream, ev.AbortedBy, copyErr)
 	}
 }
 
-func postEvent(client *http.Client, collectorURL string, ev MeteringEvent) error {
-	b, err := json.Marshal(ev)
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, collectorURL, bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode/100 != 2 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
-		return errors.New("collector returned " + resp.Status + " body=" + string(body))
+// reconcileUsage settles the rate limit estimate: real usage when known,
+// a full refund for failed requests, otherwise the estimate stands.
+func reconcileUsage(adm *Admission, status int, usage *Usage) {
+	switch {
+	case usage != nil:
+		adm.Reconcile(usage.TotalTokens)
+	case status/100 != 2:
+		adm.Reconcile(0)
 	}
-	return nil
 }
 
 type flushWriter struct {
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testEnv struct {
+	srv      *Server
+	upstream *httptest.Server
+	events   chan MeteringEvent
+}
+
+func newTestEnv(t *testing.T, upstream http.HandlerFunc, mutate func(*Config)) *testEnv {
+	t.Helper()
+
+	events := make(chan MeteringEvent, 16)
+	collector := httptest.NewServer(testCollector(events))
+	t.Cleanup(collector.Close)
+
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+
+	cfg := Config{
+		UpstreamBaseURL:      up.URL,
+		UpstreamAPIKey:       "sk-upstream",
+		CollectorURL:         collector.URL,
+		EventQueueSize:       16,
+		EventFlushTimeout:    time.Second,
+		HTTPClientTimeout:    5 * time.Second,
+		MeteringCaptureBytes: 64 * 1024,
+		OpenMode:             true,
+
+		RequestMemoryBufferBytes: 1 << 20,
+		EmbeddingsMaxBodyBytes:   64 << 20,
+		ChatMaxBodyBytes:         8 << 20,
+		PassthroughMaxBodyBytes:  64 << 20,
+	}
+	if mutate != nil {
+		mutate(&cfg)
+	}
+
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+	return &testEnv{srv: s, upstream: up, events: events}
+}
+
+// testCollector accepts single events and, on paths ending in /batch,
+// batches and passes them on to events.
+func testCollector(events chan<- MeteringEvent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/batch") {
+			var ev MeteringEvent
+			_ = json.NewDecoder(r.Body).Decode(&ev)
+			events <- ev
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		batch, err := decodeEventBatch(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, ev := range batch {
+			events <- ev
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"accepted":%d}`, len(batch))
+	}
+}
+
+func decodeEventBatch(r *http.Request) ([]MeteringEvent, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return nil, errors.New("batch is not gzip-compressed")
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var batch []MeteringEvent
+	dec := json.NewDecoder(zr)
+	for {
+		var ev MeteringEvent
+		err := dec.Decode(&ev)
+		if err == io.EOF {
+			return batch, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, ev)
+	}
+}
+
+func (e *testEnv) do(t *testing.T, path, token string, body string, hdr map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	e.srv.Mux().ServeHTTP(rec, req)
+	return rec
+}
+
+func (e *testEnv) nextEvent(t *testing.T) MeteringEvent {
+	t.Helper()
+	select {
+	case ev := <-e.events:
+		return ev
+	case <-time.After(5 * time.Second):
+		// generous: the first usage estimate loads the tokenizer
+		t.Fatal("no metering event received")
+		return MeteringEvent{}
+	}
+}
+
+func okChatUpstream(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.Copy(io.Discard, r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"id":"c1","model":"gpt-4o-mini","usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`))
+}
+
+func decodeOpenAIError(t *testing.T, rec *httptest.ResponseRecorder) OpenAIError {
+	t.Helper()
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var env openAIErrorEnvelope
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &env))
+	return env.Error
+}
+
+func withKeys(t *testing.T, cfg *Config, content string) {
+	t.Helper()
+	p := t.TempDir() + "/keys.yaml"
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	cfg.KeysFile = p
+}
+
+func TestChatCompletions_KeyValidation(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { withKeys(t, cfg, testKeyFile) })
+	body := `{"model":"gpt-4o-mini","messages":[]}`
+
+	rejected := func(rec *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		require.Equal(t, status, rec.Code)
+		require.Equal(t, code, decodeOpenAIError(t, rec).Code)
+		ev := env.nextEvent(t)
+		require.Equal(t, status, ev.StatusCode)
+		require.Equal(t, ErrorClassAuth, ev.ErrorClass)
+		require.Equal(t, code, ev.ErrorCode)
+	}
+
+	rejected(env.do(t, "/v1/chat/completions", "", body, nil), http.StatusUnauthorized, "missing_api_key")
+	rejected(env.do(t, "/v1/chat/completions", "unknown", body, nil), http.StatusUnauthorized, "invalid_api_key")
+	rejected(env.do(t, "/v1/chat/completions", "gw_b", body, nil), http.StatusForbidden, "key_disabled")
+	rejected(env.do(t, "/v1/chat/completions", "gw_a", `{"model":"gpt-3.5-turbo"}`, nil), http.StatusForbidden, "model_not_allowed")
+
+	rec := env.do(t, "/v1/chat/completions", "gw_a", body, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, 5, ev.TotalTokens)
+	require.Empty(t, ev.ErrorClass)
+}
+
+func TestChatCompletions_OpenModeAcceptsAnyKey(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, nil)
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("X-LLM-Request-ID"))
+	env.nextEvent(t)
+}
+
+func TestNewServer_RequiresKeysOrOpenMode(t *testing.T) {
+	_, err := NewServer(Config{UpstreamBaseURL: "http://127.0.0.1:1", UpstreamAPIKey: "sk-upstream"})
+	require.ErrorContains(t, err, "GATEWAY_OPEN_MODE")
+}
+
+func TestChatCompletions_TenantFromKey(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { withKeys(t, cfg, testKeyFile) })
+	body := `{"model":"gpt-4o-mini"}`
+
+	rec := env.do(t, "/v1/chat/completions", "gw_a", body, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "a", env.nextEvent(t).Tenant)
+
+	rec = env.do(t, "/v1/chat/completions", "gw_a", body, map[string]string{"X-LLM-Tenant": "a"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "a", env.nextEvent(t).Tenant)
+
+	rec = env.do(t, "/v1/chat/completions", "gw_a", body, map[string]string{"X-LLM-Tenant": "b"})
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "tenant_not_allowed", decodeOpenAIError(t, rec).Code)
+	require.Equal(t, ErrorClassAuth, env.nextEvent(t).ErrorClass)
+
+	rec = env.do(t, "/v1/chat/completions", "gw_platform", body, map[string]string{"X-Tenant": "team-x"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "team-x", env.nextEvent(t).Tenant)
+}
+
+func TestChatCompletions_OpenModeTenantHeader(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, nil)
+
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, map[string]string{"X-LLM-Tenant": "demo"})
+	require.Equal(t, "demo", env.nextEvent(t).Tenant)
+
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, "default", env.nextEvent(t).Tenant)
+}
+
+func TestChatCompletions_EventCarriesKeyID(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { withKeys(t, cfg, testKeyFile) })
+	env.do(t, "/v1/chat/completions", "gw_a", `{"model":"gpt-4o-mini"}`, nil)
+	ev := env.nextEvent(t)
+	require.Equal(t, "team-a", ev.AppKeyID)
+	require.Empty(t, ev.AppKey)
+
+	open := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.KeyHMACSecret = "s3cret"
+		cfg.AppKeyCompat = true
+	})
+	open.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	ev = open.nextEvent(t)
+	require.Equal(t, KeyFingerprint("s3cret", "dummy"), ev.AppKeyID)
+	require.Equal(t, ev.AppKeyID, ev.AppKey)
+}
+
+func TestChatCompletions_InjectsStreamUsage(t *testing.T) {
+	bodies := make(chan map[string]any, 4)
+	streamUpstream := func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies <- body
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"id\":\"1\",\"model\":\"gpt-4o-mini\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+			"data: {\"id\":\"1\",\"model\":\"gpt-4o-mini\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n" +
+			"data: [DONE]\n\n"))
+	}
+	env := newTestEnv(t, streamUpstream, nil)
+
+	// the gateway asks for usage and hides the extra chunk from the client
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true,"stream_options":{"include_obfuscation":false}}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, map[string]any{"include_usage": true, "include_obfuscation": false}, (<-bodies)["stream_options"])
+	require.NotContains(t, rec.Body.String(), `"total_tokens"`)
+	require.Contains(t, rec.Body.String(), "data: [DONE]")
+	require.Equal(t, 5, env.nextEvent(t).TotalTokens)
+
+	// a client that asked for usage gets the chunk
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true,"stream_options":{"include_usage":true}}`, nil)
+	require.Equal(t, map[string]any{"include_usage": true}, (<-bodies)["stream_options"])
+	require.Contains(t, rec.Body.String(), `"total_tokens":5`)
+	require.Equal(t, 5, env.nextEvent(t).TotalTokens)
+
+	// injection can be turned off
+	off := newTestEnv(t, streamUpstream, func(cfg *Config) { cfg.DisableStreamUsageInjection = true })
+	off.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true}`, nil)
+	require.NotContains(t, <-bodies, "stream_options")
+	off.nextEvent(t)
+}
+
+func TestChatCompletions_UsageOfResponseLargerThanCapture(t *testing.T) {
+	content := strings.Repeat("tiktoken is great! ", 100)
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"c1","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"` + content + `"}}],` +
+			`"usage":{"prompt_tokens":3,"completion_tokens":400,"total_tokens":403}}`))
+	}
+	for _, capture := range []int{64, 0} {
+		env := newTestEnv(t, upstream, func(cfg *Config) { cfg.MeteringCaptureBytes = capture })
+		rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), content)
+
+		ev := env.nextEvent(t)
+		require.Equal(t, UsageSourceUpstream, ev.UsageSource, "capture %d", capture)
+		require.Equal(t, 400, ev.CompletionTokens)
+		require.Equal(t, 403, ev.TotalTokens)
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrKeyUnknown  = errors.New("unknown gateway key")
+	ErrKeyDisabled = errors.New("gateway key is disabled")
+	ErrKeyExpired  = errors.New("gateway key has expired")
+)
+
+// GatewayKey is a single entry of the gateway key file. The secret is given
+// either in plain text (key) or as a hex encoded SHA-256 digest (key_sha256).
+type GatewayKey struct {
+	ID            string    `yaml:"id" json:"id"`
+	Key           string    `yaml:"key,omitempty" json:"key,omitempty"`
+	KeySHA256     string    `yaml:"key_sha256,omitempty" json:"key_sha256,omitempty"`
+	Tenant        string    `yaml:"tenant" json:"tenant"`
+	Enabled       *bool     `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	ExpiresAt     time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+	AllowedModels []string  `yaml:"allowed_models,omitempty" json:"allowed_models,omitempty"`
+	// SubTenants lists the tenants (globs allowed) this key may act for via
+	// the X-LLM-Tenant header. Keys without it are pinned to Tenant.
+	SubTenants []string `yaml:"sub_tenants,omitempty" json:"sub_tenants,omitempty"`
+	// AllowedPaths replaces the gateway's default path allow list for this
+	// key; DeniedPaths always wins. A trailing "*" is a prefix match.
+	AllowedPaths []string `yaml:"allowed_paths,omitempty" json:"allowed_paths,omitempty"`
+	DeniedPaths  []string `yaml:"denied_paths,omitempty" json:"denied_paths,omitempty"`
+}
+
+type keyFile struct {
+	Keys []GatewayKey `yaml:"keys" json:"keys"`
+}
+
+func (k *GatewayKey) IsEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+func (k *GatewayKey) IsExpired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// AllowsModel reports whether the key may call model. An empty allow list
+// means every model is allowed; entries may use path.Match globs ("gpt-4o*").
+func (k *GatewayKey) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	return matchAny(k.AllowedModels, model)
+}
+
+// AllowsPath reports whether the key may call the API path p. Keys without
+// allowed_paths get defaults. A nil key (open mode) only gets defaults.
+func (k *GatewayKey) AllowsPath(p string, defaults []string) bool {
+	allowed := defaults
+	if k != nil {
+		if matchAnyPath(k.DeniedPaths, p) {
+			return false
+		}
+		if len(k.AllowedPaths) > 0 {
+			allowed = k.AllowedPaths
+		}
+	}
+	return matchAnyPath(allowed, p)
+}
+
+func matchAnyPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchModelPattern(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSubTenant reports whether the key may attribute traffic to tenant.
+func (k *GatewayKey) AllowsSubTenant(tenant string) bool {
+	return tenant != "" && matchAny(k.SubTenants, tenant)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == s {
+			return true
+		}
+		if ok, err := path.Match(pattern, s); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore resolves bearer tokens to gateway keys loaded from a YAML or JSON
+// file. It is not changed after parsing and is safe for concurrent use.
+type KeyStore struct {
+	byHash map[string]*GatewayKey
+	// tenants holds the keys' tenants and sub-tenants that are not globs.
+	tenants map[string]bool
+	// models holds the keys' allowed models that are not globs.
+	models map[string]bool
+}
+
+func LoadKeyStore(filename string) (*KeyStore, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyStore(b)
+}
+
+// ParseKeyStore parses a key file. JSON is accepted as well since it is valid YAML.
+func ParseKeyStore(b []byte) (*KeyStore, error) {
+	var kf keyFile
+	if err := yaml.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("parse key file: %w", err)
+	}
+
+	byHash := make(map[string]*GatewayKey, len(kf.Keys))
+	tenants := map[string]bool{}
+	models := map[string]bool{}
+	ids := make(map[string]struct{}, len(kf.Keys))
+	for i := range kf.Keys {
+		k := kf.Keys[i]
+		if k.ID == "" {
+			return nil, fmt.Errorf("key #%d: missing id", i)
+		}
+		if _, dup := ids[k.ID]; dup {
+			return nil, fmt.Errorf("key %q: duplicate id", k.ID)
+		}
+		ids[k.ID] = struct{}{}
+
+		var h string
+		switch {
+		case k.Key != "" && k.KeySHA256 != "":
+			return nil, fmt.Errorf("key %q: set only one of key or key_sha256", k.ID)
+		case k.Key != "":
+			h = hashToken(k.Key)
+		case k.KeySHA256 != "":
+			h = strings.ToLower(strings.TrimSpace(k.KeySHA256))
+			if b, err := hex.DecodeString(h); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("key %q: key_sha256 must be a hex encoded SHA-256 digest", k.ID)
+			}
+		default:
+			return nil, fmt.Errorf("key %q: missing key or key_sha256", k.ID)
+		}
+		if _, dup := byHash[h]; dup {
+			return nil, fmt.Errorf("key %q: secret is shared with another key", k.ID)
+		}
+
+		// The plain secret is not needed after hashing.
+		k.Key = ""
+		k.KeySHA256 = h
+		byHash[h] = &k
+
+		tenants[FirstNonEmpty(k.Tenant, defaultTenant)] = true
+		for _, t := range k.SubTenants {
+			if !strings.ContainsAny(t, "*?[") {
+				tenants[t] = true
+			}
+		}
+		for _, m := range k.AllowedModels {
+			if !strings.ContainsAny(m, "*?[") {
+				models[m] = true
+			}
+		}
+	}
+
+	return &KeyStore{byHash: byHash, tenants: tenants, models: models}, nil
+}
+
+// Lookup returns the key for token, or one of ErrKeyUnknown, ErrKeyDisabled
+// and ErrKeyExpired.
+func (ks *KeyStore) Lookup(token string, now time.Time) (*GatewayKey, error) {
+	k, ok := ks.byHash[hashToken(token)]
+	if !ok {
+		return nil, ErrKeyUnknown
+	}
+	if !k.IsEnabled() {
+		return k, ErrKeyDisabled
+	}
+	if k.IsExpired(now) {
+		return k, ErrKeyExpired
+	}
+	return k, nil
+}
+
+// HasTenant reports whether a key names tenant as its tenant or as one of
+// its sub-tenants, not counting globs.
+func (ks *KeyStore) HasTenant(tenant string) bool {
+	return ks.tenants[tenant]
+}
+
+// HasModel reports whether a key lists model in its allowed models, not
+// counting globs.
+func (ks *KeyStore) HasModel(model string) bool {
+	return ks.models[model]
+}
+
+func (ks *KeyStore) Len() int {
+	return len(ks.byHash)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
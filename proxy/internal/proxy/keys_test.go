@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testKeyFile = `
+keys:
+  - id: team-a
+    key: gw_a
+    tenant: a
+    allowed_models: ["gpt-4o*"]
+  - id: platform
+    key: gw_platform
+    tenant: platform
+    sub_tenants: ["team-*"]
+  - id: team-b-off
+    key: gw_b
+    tenant: b
+    enabled: false
+`
+
+func TestKeyStore_Lookup(t *testing.T) {
+	ks, err := ParseKeyStore([]byte(testKeyFile))
+	require.NoError(t, err)
+	require.Equal(t, 3, ks.Len())
+
+	k, err := ks.Lookup("gw_a", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "team-a", k.ID)
+	require.Equal(t, "a", k.Tenant)
+
+	_, err = ks.Lookup("nope", time.Now())
+	require.ErrorIs(t, err, ErrKeyUnknown)
+
+	_, err = ks.Lookup("gw_b", time.Now())
+	require.ErrorIs(t, err, ErrKeyDisabled)
+}
+
+func TestKeyStore_ExpiredByHash(t *testing.T) {
+	ks, err := ParseKeyStore([]byte(`{"keys":[{"id":"old","key_sha256":"` + hashToken("gw_old") + `","tenant":"c","expires_at":"2020-01-01T00:00:00Z"}]}`))
+	require.NoError(t, err)
+
+	k, err := ks.Lookup("gw_old", time.Now())
+	require.ErrorIs(t, err, ErrKeyExpired)
+	require.Equal(t, "old", k.ID)
+}
+
+func TestKeyStore_Invalid(t *testing.T) {
+	_, err := ParseKeyStore([]byte(`keys: [{id: x}]`))
+	require.Error(t, err)
+
+	_, err = ParseKeyStore([]byte(`keys: [{id: x, key: a}, {id: x, key: b}]`))
+	require.Error(t, err)
+
+	_, err = ParseKeyStore([]byte(`keys: [{id: x, key_sha256: abc}]`))
+	require.Error(t, err)
+
+	_, err = ParseKeyStore([]byte(`keys: [{id: x, key_sha256: ` + strings.Repeat("zz", 32) + `}]`))
+	require.Error(t, err)
+}
+
+func TestGatewayKey_AllowsModel(t *testing.T) {
+	k := &GatewayKey{AllowedModels: []string{"gpt-4o*", "claude-3-5-sonnet"}}
+	require.True(t, k.AllowsModel("gpt-4o-mini"))
+	require.True(t, k.AllowsModel("claude-3-5-sonnet"))
+	require.False(t, k.AllowsModel("gpt-3.5-turbo"))
+	require.True(t, (&GatewayKey{}).AllowsModel("anything"))
+}
+
+func TestGatewayKey_AllowsSubTenant(t *testing.T) {
+	k := &GatewayKey{Tenant: "platform", SubTenants: []string{"team-*"}}
+	require.True(t, k.AllowsSubTenant("team-x"))
+	require.False(t, k.AllowsSubTenant("other"))
+	require.False(t, k.AllowsSubTenant(""))
+	require.False(t, (&GatewayKey{Tenant: "a"}).AllowsSubTenant("b"))
+}
+
+func TestGatewayKey_AllowsPath(t *testing.T) {
+	defaults := DefaultAllowedPaths
+	var open *GatewayKey
+	require.True(t, open.AllowsPath("/v1/chat/completions", defaults))
+	require.True(t, open.AllowsPath("/v1/images/generations", defaults))
+	require.True(t, open.AllowsPath("/v1/models/gpt-4o", defaults))
+	require.False(t, open.AllowsPath("/v1/files", defaults))
+
+	k := &GatewayKey{AllowedPaths: []string{"/v1/files*", "/v1/chat/completions"}, DeniedPaths: []string{"/v1/files/*/content"}}
+	require.True(t, k.AllowsPath("/v1/files", defaults))
+	require.True(t, k.AllowsPath("/v1/files/file-1", defaults))
+	require.False(t, k.AllowsPath("/v1/files/file-1/content", defaults))
+	require.False(t, k.AllowsPath("/v1/embeddings", defaults))
+
+	deny := &GatewayKey{DeniedPaths: []string{"/v1/images/*"}}
+	require.True(t, deny.AllowsPath("/v1/embeddings", defaults))
+	require.False(t, deny.AllowsPath("/v1/images/edits", defaults))
+}
@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "llm_proxy"
+
+// Metrics holds the proxy's Prometheus collectors. Each Server has its own
+// registry so tests can create several servers in one process.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	duration          *prometheus.HistogramVec
+	tokens            *prometheus.CounterVec
+	ttft              *prometheus.HistogramVec
+	upstreamTTFB      *prometheus.HistogramVec
+	chunkGap          *prometheus.HistogramVec
+	inFlight          prometheus.Gauge
+	collectorFailures prometheus.Counter
+	eventsSpooled     prometheus.Counter
+	realtimeUnparsed  prometheus.Counter
+
+	// tenantLabel and modelLabel map a tenant and a model to their label
+	// values.
+	tenantLabel func(string) string
+	modelLabel  func(string) string
+}
+
+var (
+	latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+	ttftBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30}
+	gapBuckets     = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+)
+
+func newMetrics(s *Server) *Metrics {
+	requestLabels := []string{"tenant", "model", "route", "upstream", "status"}
+	latencyLabels := []string{"tenant", "model", "route", "upstream"}
+	m := &Metrics{
+		registry:    prometheus.NewRegistry(),
+		tenantLabel: s.tenantLabel,
+		modelLabel:  s.modelLabel,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests handled, by tenant, model, route, upstream and response status.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "End-to-end request duration, including the whole stream for streaming requests.",
+			Buckets:   latencyBuckets,
+		}, requestLabels),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_total",
+			Help:      "Tokens reported by upstreams, by type (prompt, completion, cached, reasoning, audio_in, audio_out).",
+		}, []string{"tenant", "model", "route", "upstream", "type"}),
+		ttft: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_first_token_seconds",
+			Help:      "Time from request start until the first content chunk of a stream.",
+			Buckets:   ttftBuckets,
+		}, latencyLabels),
+		upstreamTTFB: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_ttfb_seconds",
+			Help:      "Time from sending the upstream request until its response headers arrived.",
+			Buckets:   ttftBuckets,
+		}, latencyLabels),
+		chunkGap: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_chunk_gap_seconds",
+			Help:      "Time between consecutive content chunks of streamed responses.",
+			Buckets:   gapBuckets,
+		}, latencyLabels),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "in_flight_requests",
+			Help:      "Requests currently being handled.",
+		}),
+		collectorFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "collector_post_failures_total",
+			Help:      "Metering events that could not be delivered to the collector.",
+		}),
+		eventsSpooled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_spooled_total",
+			Help:      "Metering events written to the on-disk spool (EVENT_SPOOL_DIR).",
+		}),
+		realtimeUnparsed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "realtime_unparsed_events_total",
+			Help:      "Realtime response.done events whose usage could not be decoded.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.duration, m.tokens, m.ttft, m.upstreamTTFB, m.chunkGap, m.inFlight, m.collectorFailures, m.eventsSpooled, m.realtimeUnparsed,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_queue_depth",
+			Help:      "Metering events waiting to be sent to the collector.",
+		}, func() float64 { return float64(len(s.events)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_queue_capacity",
+			Help:      "Size of the metering event queue (EVENT_QUEUE_SIZE).",
+		}, func() float64 { return float64(cap(s.events)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_dropped_total",
+			Help:      "Metering events dropped because the queue or the spool was full.",
+		}, func() float64 { return float64(atomic.LoadUint64(&s.dropped)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_spool_bytes",
+			Help:      "Disk space used by spooled metering events.",
+		}, func() float64 {
+			if s.spool == nil {
+				return 0
+			}
+			return float64(s.spool.Bytes())
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// otherTenant is the tenant label of tenants the configuration does not
+// name, which clients may pick freely in open mode.
+const otherTenant = "other"
+
+// tenantLabel returns tenant if it is the default tenant, listed in
+// MetricsTenants or a tenant of the key store, and otherTenant otherwise.
+func (s *Server) tenantLabel(tenant string) string {
+	if tenant == "" || tenant == defaultTenant || slices.Contains(s.cfg.MetricsTenants, tenant) ||
+		(s.keys != nil && s.keys.HasTenant(tenant)) {
+		return tenant
+	}
+	return otherTenant
+}
+
+// otherModel is the model label of models the configuration does not
+// name, which clients may pick freely.
+const otherModel = "other"
+
+// modelLabel returns model if it has an exact route, an exact price catalog
+// entry, is a non-glob allowed model of a key or is listed in MetricsModels,
+// and otherModel otherwise.
+func (s *Server) modelLabel(model string) string {
+	if model == "" || slices.Contains(s.cfg.MetricsModels, model) ||
+		(s.router != nil && s.router.HasModel(model)) ||
+		(s.prices != nil && s.prices.HasModel(model)) ||
+		(s.keys != nil && s.keys.HasModel(model)) {
+		return model
+	}
+	return otherModel
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// requestMetrics collects the labels of one request as the handler learns
+// them; observe records everything once the request is done. metered is set
+// once a metering event was enqueued for the request. The model and tenant
+// labels are bounded by the configuration, see modelLabel and tenantLabel.
+type requestMetrics struct {
+	tenant       string
+	keyID        string
+	model        string
+	route        string
+	upstream     string
+	usage        *Usage
+	metered      bool
+	upstreamTTFB time.Duration
+	streamStats  *StreamStats
+}
+
+// streamStats starts the statistics of a stream relayed for a routed
+// request. Its chunk gaps are observed as they occur since the stats only
+// keep a histogram of them.
+func (m *Metrics) streamStats(rm *requestMetrics) *StreamStats {
+	st := newStreamStats()
+	st.gapObserver = m.chunkGap.WithLabelValues(m.tenantLabel(rm.tenant), m.modelLabel(rm.model), rm.route, rm.upstream)
+	return st
+}
+
+func (m *Metrics) observe(rm *requestMetrics, sw *statusWriter, start time.Time) {
+	status := strconv.Itoa(sw.status)
+	tenant, model := m.tenantLabel(rm.tenant), m.modelLabel(rm.model)
+	m.requests.WithLabelValues(tenant, model, rm.route, rm.upstream, status).Inc()
+	m.duration.WithLabelValues(tenant, model, rm.route, rm.upstream, status).Observe(time.Since(start).Seconds())
+
+	if rm.upstreamTTFB > 0 {
+		m.upstreamTTFB.WithLabelValues(tenant, model, rm.route, rm.upstream).Observe(rm.upstreamTTFB.Seconds())
+	}
+	if st := rm.streamStats; st != nil && sw.status/100 == 2 && st.chunks > 0 {
+		m.ttft.WithLabelValues(tenant, model, rm.route, rm.upstream).Observe(st.first.Sub(start).Seconds())
+	}
+	if u := rm.usage; u != nil {
+		for typ, n := range map[string]int{
+			"prompt":     u.PromptTokens,
+			"completion": u.CompletionTokens,
+			"cached":     u.CachedTokens(),
+			"reasoning":  u.ReasoningTokens(),
+			"audio_in":   u.InputAudioTokens(),
+			"audio_out":  u.OutputAudioTokens(),
+		} {
+			if n > 0 {
+				m.tokens.WithLabelValues(tenant, model, rm.route, rm.upstream, typ).Add(float64(n))
+			}
+		}
+	}
+}
+
+// statusWriter records the response status, gateway error code and the
+// first failed write, on which it calls abort. It keeps http.Flusher
+// working for streaming responses.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// errCode is the code of a gateway error written with WriteOpenAIError.
+	errCode  string
+	writeErr error
+	abort    func()
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	if err != nil && sw.writeErr == nil {
+		sw.writeErr = err
+		if sw.abort != nil {
+			sw.abort()
+		}
+	}
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if fl, ok := sw.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack supports WebSocket upgrades; the request is recorded as 101.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
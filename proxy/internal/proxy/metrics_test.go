@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T, env *testEnv) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	env.srv.Mux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
+
+func TestMetrics_Requests(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { withKeys(t, cfg, testKeyFile) })
+
+	rec := env.do(t, "/v1/chat/completions", "gw_a", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	env.nextEvent(t)
+	rec = env.do(t, "/v1/chat/completions", "nope", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	env.nextEvent(t)
+
+	body := scrapeMetrics(t, env)
+	for _, want := range []string{
+		`llm_proxy_requests_total{model="other",route="*",status="200",tenant="a",upstream="default"} 1`,
+		`llm_proxy_requests_total{model="",route="",status="401",tenant="",upstream=""} 1`,
+		`llm_proxy_request_duration_seconds_count{model="other",route="*",status="200",tenant="a",upstream="default"} 1`,
+		`llm_proxy_tokens_total{model="other",route="*",tenant="a",type="prompt",upstream="default"} 3`,
+		`llm_proxy_tokens_total{model="other",route="*",tenant="a",type="completion",upstream="default"} 2`,
+		`llm_proxy_in_flight_requests 0`,
+		`llm_proxy_event_queue_depth 0`,
+		`llm_proxy_event_queue_capacity 16`,
+		`llm_proxy_events_dropped_total 0`,
+		`llm_proxy_collector_post_failures_total 0`,
+	} {
+		require.Contains(t, body, want)
+	}
+	require.NotContains(t, body, "llm_proxy_time_to_first_token_seconds_count")
+}
+
+func TestMetrics_LabelsAreBounded(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.MetricsTenants = []string{"team-x"}
+		cfg.MetricsModels = []string{"model-0"}
+	})
+
+	for i, tenant := range []string{"team-x", "random-1", "random-2"} {
+		model := fmt.Sprintf("model-%d", i)
+		rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"`+model+`"}`, map[string]string{"X-LLM-Tenant": tenant})
+		require.Equal(t, http.StatusOK, rec.Code)
+		ev := env.nextEvent(t)
+		require.Equal(t, tenant, ev.Tenant)
+	}
+
+	body := scrapeMetrics(t, env)
+	require.Contains(t, body, `llm_proxy_requests_total{model="model-0",route="*",status="200",tenant="team-x",upstream="default"} 1`)
+	require.Contains(t, body, `llm_proxy_requests_total{model="other",route="*",status="200",tenant="other",upstream="default"} 2`)
+	require.NotContains(t, body, "random-1")
+	require.NotContains(t, body, "model-1")
+}
+
+func TestModelLabel(t *testing.T) {
+	t.Setenv("TEST_ROUTES_OPENAI_KEY", "sk-test")
+	ks, err := ParseKeyStore([]byte(`keys: [{id: x, key: k, allowed_models: [gpt-4.1, "o4-*"]}]`))
+	require.NoError(t, err)
+	prices, err := ParsePriceCatalog([]byte(testPriceCatalog))
+	require.NoError(t, err)
+	s := &Server{
+		cfg:    Config{MetricsModels: []string{"text-embedding-3-small"}},
+		router: parseTestRoutes(t, testRoutes),
+		prices: prices,
+		keys:   ks,
+	}
+
+	for model, want := range map[string]string{
+		"":                       "",
+		"gpt-4o-special":         "gpt-4o-special", // exact route
+		"o3":                     "o3",             // price catalog
+		"gpt-4.1":                "gpt-4.1",        // allowed model
+		"text-embedding-3-small": "text-embedding-3-small",
+		"gpt-4o-mini":            otherModel, // pattern route only
+		"o4-mini":                otherModel, // allowed by a glob
+		"random":                 otherModel,
+	} {
+		require.Equal(t, want, s.modelLabel(model), model)
+	}
+}
+
+func TestMetrics_StreamTimeToFirstToken(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		for _, text := range []string{"Hel", "lo", "!"} {
+			_, _ = w.Write([]byte(`data: {"id":"1","model":"gpt-4o-mini","choices":[{"delta":{"content":"` + text + `"}}]}` + "\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	}, func(cfg *Config) { cfg.MetricsModels = []string{"gpt-4o-mini"} })
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, 3, ev.ChunkCount)
+	require.GreaterOrEqual(t, ev.TTFTMs, ev.UpstreamTTFBMs+20)
+	require.GreaterOrEqual(t, ev.StreamDurationMs, int64(30))
+	require.Positive(t, ev.ChunkGapP95Ms)
+
+	body := scrapeMetrics(t, env)
+	for _, want := range []string{
+		`llm_proxy_time_to_first_token_seconds_count{model="gpt-4o-mini",route="*",tenant="default",upstream="default"} 1`,
+		`llm_proxy_upstream_ttfb_seconds_count{model="gpt-4o-mini",route="*",tenant="default",upstream="default"} 1`,
+		`llm_proxy_stream_chunk_gap_seconds_count{model="gpt-4o-mini",route="*",tenant="default",upstream="default"} 2`,
+	} {
+		require.Contains(t, body, want)
+	}
+}
+
+func TestMetrics_CollectorFailures(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) { cfg.CollectorURL = "http://127.0.0.1:1/events" })
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(t, env), "llm_proxy_collector_post_failures_total 1")
+	}, 2*time.Second, 10*time.Millisecond)
+}
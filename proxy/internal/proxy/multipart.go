@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// multipartPrefixLimit bounds how much of a multipart body is read ahead to
+// find the form fields sent before the first file.
+const multipartPrefixLimit = 1 << 20
+
+// uploadStats is what was seen in a streamed multipart body.
+type uploadStats struct {
+	FileBytes    int64
+	AudioSeconds float64
+}
+
+func multipartBoundary(contentType string) (string, bool) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// forwardMultipart streams a multipart/form-data request (audio
+// transcriptions, file uploads) to the upstream without buffering the files.
+// The form fields before the first file are read ahead to route by model;
+// the rest of the body is copied as it arrives, so the request gets a single
+// attempt without retries or failover.
+func (s *Server) forwardMultipart(g *gatewayRequest, r *http.Request, boundary string) {
+	if r.ContentLength > s.cfg.PassthroughMaxBodyBytes {
+		_ = r.Body.Close()
+		WriteOpenAIError(g.w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+			"request body exceeds the configured maximum")
+		return
+	}
+	src := &maxBytesReader{r: r.Body, n: s.cfg.PassthroughMaxBodyBytes}
+	prefix, fields, err := readMultipartPrefix(src, boundary, multipartPrefixLimit)
+	if errors.Is(err, ErrBodyTooLarge) {
+		WriteOpenAIError(g.w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+			"request body exceeds the configured maximum")
+		return
+	}
+	if err != nil {
+		g.writeBodyReadError(r)
+		return
+	}
+
+	model := fields["model"]
+	targets, ok := s.routePassthrough(g, model)
+	if !ok {
+		return
+	}
+	adm, ok := s.admitRequest(g, 0)
+	if !ok {
+		return
+	}
+
+	meter := newMultipartMeter(boundary, strings.HasPrefix(r.URL.Path, "/v1/audio/"))
+	res, err := s.sendOnce(g.ctx, targets[0], func(t RouteTarget) (*http.Request, error) {
+		pp, err := passthroughProvider(t, r.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		head, size := prefix, r.ContentLength
+		if model != "" && t.Model != model {
+			head = replaceMultipartField(prefix, boundary, "model", t.Model)
+			if size >= 0 {
+				size += int64(len(head) - len(prefix))
+			}
+		}
+		body := meter.Reader(io.MultiReader(bytes.NewReader(head), src))
+		return pp.NewPassthroughRequest(g.ctx, t.Upstream, r.Method, r.URL.Path, r.URL.RawQuery, r.Header, body, size)
+	})
+	s.respondPassthrough(g, r, res, err, adm, meter.Close)
+}
+
+// maxBytesReader fails with ErrBodyTooLarge once more than n bytes were read.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// readMultipartPrefix reads form fields up to the first file part. It
+// returns every byte consumed from r, which may reach into the file, so
+// that prefix followed by the rest of r is the original body. A malformed
+// body is not an error here; it is forwarded for the upstream to reject.
+func readMultipartPrefix(r io.Reader, boundary string, limit int64) ([]byte, map[string]string, error) {
+	var rec bytes.Buffer
+	lr := &readErrRecorder{r: io.LimitReader(r, limit)}
+	mr := multipart.NewReader(io.TeeReader(lr, &rec), boundary)
+	fields := map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err != nil || part.FileName() != "" {
+			break
+		}
+		v, err := io.ReadAll(io.LimitReader(part, 64<<10))
+		if err != nil {
+			break
+		}
+		if name := part.FormName(); name != "" {
+			if _, seen := fields[name]; !seen {
+				fields[name] = string(v)
+			}
+		}
+	}
+	return rec.Bytes(), fields, lr.err
+}
+
+// readErrRecorder keeps the first error of r other than io.EOF, so that
+// client read failures are told apart from malformed multipart bodies.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// replaceMultipartField replaces the value of the first form field name in
+// the raw multipart prefix. The prefix is returned unchanged when the field
+// is not found in it.
+func replaceMultipartField(prefix []byte, boundary, name, value string) []byte {
+	// the first delimiter has no leading CRLF; add one so all parts look alike
+	buf := append([]byte("\r\n"), prefix...)
+	delim := []byte("\r\n--" + boundary)
+	for off := 0; ; {
+		i := bytes.Index(buf[off:], delim)
+		if i < 0 {
+			return prefix
+		}
+		hdrStart := off + i + len(delim)
+		hdrEnd := bytes.Index(buf[hdrStart:], []byte("\r\n\r\n"))
+		if hdrEnd < 0 {
+			return prefix
+		}
+		hdrEnd += hdrStart
+		valStart := hdrEnd + 4
+		valEnd := bytes.Index(buf[valStart:], delim)
+		if valEnd < 0 {
+			return prefix
+		}
+		valEnd += valStart
+		if partFormName(buf[hdrStart:hdrEnd]) == name {
+			out := make([]byte, 0, len(buf)+len(value))
+			out = append(out, buf[2:valStart]...)
+			out = append(out, value...)
+			return append(out, buf[valEnd:]...)
+		}
+		off = valEnd
+	}
+}
+
+// partFormName returns the form name from raw part headers.
+func partFormName(hdr []byte) string {
+	for _, line := range strings.Split(string(hdr), "\r\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Content-Disposition") {
+			continue
+		}
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err == nil {
+			return params["name"]
+		}
+	}
+	return ""
+}
+
+// multipartMeter parses a copy of the streamed body in the background to
+// measure the uploaded files.
+type multipartMeter struct {
+	pw    *io.PipeWriter
+	done  chan struct{}
+	stats uploadStats
+}
+
+func newMultipartMeter(boundary string, audio bool) *multipartMeter {
+	pr, pw := io.Pipe()
+	m := &multipartMeter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		// keep draining so the upload never blocks on the meter
+		defer func() { _, _ = io.Copy(io.Discard, pr) }()
+
+		mr := multipart.NewReader(pr, boundary)
+		for first := true; ; {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			head := NewLimitedCapture(audioHeaderBytes)
+			n, _ := io.Copy(head, part)
+			m.stats.FileBytes += n
+			if audio && first {
+				m.stats.AudioSeconds = estimateAudioSeconds(head.Bytes(), n)
+			}
+			first = false
+		}
+	}()
+	return m
+}
+
+// Reader returns r with everything read from it also fed to the meter.
+func (m *multipartMeter) Reader(r io.Reader) io.Reader {
+	return &meterReader{r: r, m: m}
+}
+
+// Close stops metering and returns the stats.
+func (m *multipartMeter) Close() uploadStats {
+	_ = m.pw.Close()
+	<-m.done
+	return m.stats
+}
+
+type meterReader struct {
+	r io.Reader
+	m *multipartMeter
+}
+
+func (mr *meterReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	if n > 0 {
+		_, _ = mr.m.pw.Write(p[:n])
+	}
+	if err == io.EOF {
+		_ = mr.m.pw.Close()
+	}
+	return n, err
+}
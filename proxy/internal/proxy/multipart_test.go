@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// wavFile returns a 16 kHz mono 16-bit WAV of the given length.
+func wavFile(seconds int) []byte {
+	const byteRate = 16000 * 2
+	data := make([]byte, seconds*byteRate)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(36+len(data)))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{uint32(16), uint16(1), uint16(1), uint32(16000), uint32(byteRate), uint16(2), uint16(16)} {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func multipartBody(t *testing.T, fields [][2]string, filename string, file []byte) (string, *bytes.Buffer) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, f := range fields {
+		require.NoError(t, mw.WriteField(f[0], f[1]))
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, _ = fw.Write(file)
+	require.NoError(t, mw.Close())
+	return mw.FormDataContentType(), &b
+}
+
+func TestEstimateAudioSeconds(t *testing.T) {
+	wav := wavFile(3)
+	require.InDelta(t, 3.0, estimateAudioSeconds(wav[:audioHeaderBytes], int64(len(wav))), 1e-9)
+
+	flac := make([]byte, 42)
+	copy(flac, "fLaC")
+	flac[4], flac[7] = 0x80, 34
+	// 44.1 kHz, 2 channels, 16 bit, 441000 samples
+	binary.BigEndian.PutUint64(flac[18:26], 44100<<44|1<<41|15<<36|441000)
+	require.InDelta(t, 10.0, estimateAudioSeconds(flac, 1<<20), 1e-9)
+
+	// MPEG-1 layer III, 128 kbit/s, 44.1 kHz behind a 100 byte ID3 tag
+	mp3 := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 90}, make([]byte, 90)...)
+	mp3 = append(mp3, 0xff, 0xfb, 0x90, 0x00)
+	mp3 = append(mp3, make([]byte, 200)...)
+	require.InDelta(t, 10.0, estimateAudioSeconds(mp3, 100+160000), 1e-9)
+
+	// Xing header with 100 frames of 1152 samples
+	xing := append([]byte{0xff, 0xfb, 0x90, 0x00}, make([]byte, 32)...)
+	xing = append(xing, "Xing"...)
+	xing = append(xing, 0, 0, 0, 1, 0, 0, 0, 100)
+	require.InDelta(t, 100*1152/44100.0, estimateAudioSeconds(xing, 1<<20), 1e-9)
+
+	require.Zero(t, estimateAudioSeconds([]byte("OggS\x00\x02"), 1<<20))
+}
+
+func TestReplaceMultipartField(t *testing.T) {
+	for _, fields := range [][][2]string{
+		{{"model", "team/whisper-1"}, {"language", "de"}},
+		{{"language", "de"}, {"model", "team/whisper-1"}},
+	} {
+		ct, body := multipartBody(t, fields, "a.wav", []byte("RIFF"))
+		boundary, ok := multipartBoundary(ct)
+		require.True(t, ok)
+
+		out := replaceMultipartField(body.Bytes(), boundary, "model", "whisper-1")
+		require.Equal(t, body.Len()-len("team/"), len(out))
+		mr := multipart.NewReader(bytes.NewReader(out), boundary)
+		form, err := mr.ReadForm(1 << 20)
+		require.NoError(t, err)
+		require.Equal(t, []string{"whisper-1"}, form.Value["model"])
+		require.Equal(t, []string{"de"}, form.Value["language"])
+	}
+
+	require.Equal(t, []byte("--b\r\n"), replaceMultipartField([]byte("--b\r\n"), "b", "model", "x"))
+}
+
+func TestReadMultipartPrefix(t *testing.T) {
+	file := bytes.Repeat([]byte("x"), 256<<10)
+	_, body := multipartBody(t, [][2]string{{"model", "whisper-1"}, {"response_format", "verbose_json"}}, "a.mp3", file)
+	raw := body.Bytes()
+	boundary := strings.TrimPrefix(string(raw[:bytes.IndexByte(raw, '\r')]), "--")
+
+	src := bytes.NewReader(raw)
+	prefix, fields, err := readMultipartPrefix(src, boundary, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, "whisper-1", fields["model"])
+	require.Equal(t, "verbose_json", fields["response_format"])
+	require.Less(t, len(prefix), len(raw))
+
+	rest, _ := io.ReadAll(src)
+	require.Equal(t, raw, append(prefix, rest...))
+}
+
+func TestPassthrough_MultipartTranscription(t *testing.T) {
+	wav := wavFile(4)
+	var respondVerbose bool
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/audio/transcriptions", r.URL.Path)
+		require.Equal(t, "Bearer team-key", r.Header.Get("Authorization"))
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		require.Equal(t, "whisper-1", r.FormValue("model"))
+		f, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		got, _ := io.ReadAll(f)
+		require.Equal(t, wav, got)
+
+		w.Header().Set("Content-Type", "application/json")
+		if respondVerbose {
+			_, _ = w.Write([]byte(`{"task":"transcribe","language":"english","duration":3.52,"text":"hi"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"text":"hi"}`))
+	}, func(cfg *Config) {
+		p := t.TempDir() + "/routes.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`
+upstreams:
+  - {name: team, provider: openai, base_url: "`+cfg.UpstreamBaseURL+`", api_key: team-key, retry: {max_attempts: 3}}
+routes:
+  - {match: "team/*", upstream: team, strip_prefix: "team/"}
+`), 0o600))
+		cfg.RoutesFile = p
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		ct, body := multipartBody(t, [][2]string{{"model", "team/whisper-1"}, {"response_format", "json"}}, "a.wav", wav)
+		return env.send(t, http.MethodPost, "/v1/audio/transcriptions", "dummy", ct, body.String())
+	}
+
+	rec := send()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ev := env.nextEvent(t)
+	require.Equal(t, "/v1/audio/transcriptions", ev.Endpoint)
+	require.Equal(t, "team", ev.Upstream)
+	require.Equal(t, "whisper-1", ev.Model)
+	require.Equal(t, int64(len(wav)), ev.FileBytes)
+	require.InDelta(t, 4.0, ev.AudioSeconds, 1e-9)
+	require.True(t, ev.AudioSecondsEstimated)
+
+	respondVerbose = true
+	rec = send()
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev = env.nextEvent(t)
+	require.InDelta(t, 3.52, ev.AudioSeconds, 1e-9)
+	require.False(t, ev.AudioSecondsEstimated)
+}
+
+func TestPassthrough_MultipartFileUpload(t *testing.T) {
+	file := bytes.Repeat([]byte(`{"custom_id":"1"}`+"\n"), 200<<10)
+	var received int64
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		require.Equal(t, "batch", r.FormValue("purpose"))
+		f, hdr, err := r.FormFile("file")
+		require.NoError(t, err)
+		received, _ = io.Copy(io.Discard, f)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": "file-1", "object": "file", "bytes": hdr.Size})
+	}, func(cfg *Config) {
+		withKeys(t, cfg, `keys: [{id: batch, key: gw_batch, tenant: a, allowed_paths: ["/v1/files*"]}]`)
+		cfg.PassthroughMaxBodyBytes = 8 << 20
+	})
+
+	ct, body := multipartBody(t, [][2]string{{"purpose", "batch"}}, "in.jsonl", file)
+	rec := env.send(t, http.MethodPost, "/v1/files", "gw_batch", ct, body.String())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, int64(len(file)), received)
+
+	ev := env.nextEvent(t)
+	require.Equal(t, int64(len(file)), ev.FileBytes)
+	require.Zero(t, ev.AudioSeconds)
+	require.Equal(t, "unknown", ev.Model)
+}
+
+func TestPassthrough_MultipartTooLarge(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}, func(cfg *Config) { cfg.PassthroughMaxBodyBytes = 64 << 10 })
+
+	ct, body := multipartBody(t, [][2]string{{"model", "whisper-1"}}, "a.wav", wavFile(3))
+	rec := env.send(t, http.MethodPost, "/v1/audio/transcriptions", "dummy", ct, body.String())
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Equal(t, "request_too_large", env.nextEvent(t).ErrorCode)
+
+	// without Content-Length the limit applies while streaming
+	req := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", io.MultiReader(body))
+	req.Header.Set("Authorization", "Bearer dummy")
+	req.Header.Set("Content-Type", ct)
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	env.srv.Mux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Equal(t, "request_too_large", env.nextEvent(t).ErrorCode)
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PassthroughProvider is implemented by providers that can forward the
+// OpenAI endpoints the gateway has no dedicated handler for.
+type PassthroughProvider interface {
+	NewPassthroughRequest(ctx context.Context, up *Upstream, method, path, rawQuery string, in http.Header, body io.Reader, size int64) (*http.Request, error)
+}
+
+// passthroughResult is what an extractor reads from a response body.
+type passthroughResult struct {
+	Model        string
+	Usage        *Usage
+	InputCount   int
+	ImageCount   int
+	AudioSeconds float64
+	// Stream is set for SSE responses.
+	Stream *StreamStats
+}
+
+type passthroughExtractor func(body []byte) passthroughResult
+
+// passthroughExtractors pick the usage extractor by endpoint family; paths
+// matching none use extractGeneric.
+var passthroughExtractors = []struct {
+	prefix  string
+	extract passthroughExtractor
+}{
+	// retrieving stored completions or responses must not meter them again
+	{"/v1/chat/completions/", extractNone},
+	{"/v1/responses/", extractNone},
+	{"/v1/completions", extractGeneric},
+	{"/v1/moderations", extractModerations},
+	{"/v1/images/", extractImages},
+	{"/v1/audio/", extractAudio},
+	{"/v1/files", extractNone},
+	{"/v1/batches", extractNone},
+}
+
+func extractorFor(path string) passthroughExtractor {
+	for _, e := range passthroughExtractors {
+		if strings.HasPrefix(path, e.prefix) {
+			return e.extract
+		}
+	}
+	return extractGeneric
+}
+
+// passthroughBody is the subset of response fields the extractors use.
+type passthroughBody struct {
+	Model   string            `json:"model"`
+	Usage   *rawUsage         `json:"usage"`
+	Data    []json.RawMessage `json:"data"`
+	Results []json.RawMessage `json:"results"`
+	// Duration is the audio length of verbose_json transcriptions.
+	Duration json.RawMessage `json:"duration"`
+}
+
+func decodePassthroughBody(body []byte) (passthroughBody, bool) {
+	var pb passthroughBody
+	if len(body) == 0 || json.Unmarshal(body, &pb) != nil {
+		return pb, false
+	}
+	return pb, true
+}
+
+func extractGeneric(body []byte) passthroughResult {
+	pb, _ := decodePassthroughBody(body)
+	return passthroughResult{Model: pb.Model, Usage: pb.Usage.normalize()}
+}
+
+func extractModerations(body []byte) passthroughResult {
+	pb, _ := decodePassthroughBody(body)
+	return passthroughResult{Model: pb.Model, Usage: pb.Usage.normalize(), InputCount: len(pb.Results)}
+}
+
+func extractImages(body []byte) passthroughResult {
+	pb, _ := decodePassthroughBody(body)
+	return passthroughResult{Model: pb.Model, Usage: pb.Usage.normalize(), ImageCount: len(pb.Data)}
+}
+
+// extractAudio takes the audio length from verbose_json responses or from
+// usage billed by duration.
+func extractAudio(body []byte) passthroughResult {
+	pb, _ := decodePassthroughBody(body)
+	out := passthroughResult{Model: pb.Model, Usage: pb.Usage.normalize()}
+	if pb.Usage != nil && pb.Usage.Seconds > 0 {
+		out.AudioSeconds = pb.Usage.Seconds
+	}
+	if d, err := strconv.ParseFloat(strings.Trim(string(pb.Duration), `"`), 64); err == nil && d > 0 {
+		out.AudioSeconds = d
+	}
+	return out
+}
+
+// extractNone is used for endpoints that do not consume tokens.
+func extractNone([]byte) passthroughResult { return passthroughResult{} }
+
+// rawUsage accepts both usage shapes of the OpenAI API: prompt/completion
+// tokens (chat, completions, embeddings) and input/output tokens (images,
+// audio, responses).
+type rawUsage struct {
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	InputTokens             int                      `json:"input_tokens"`
+	OutputTokens            int                      `json:"output_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details"`
+	InputTokensDetails      *PromptTokensDetails     `json:"input_tokens_details"`
+	OutputTokensDetails     *CompletionTokensDetails `json:"output_tokens_details"`
+	// the Realtime API spells the details "token" in the singular
+	InputTokenDetails  *PromptTokensDetails     `json:"input_token_details"`
+	OutputTokenDetails *CompletionTokensDetails `json:"output_token_details"`
+	// Seconds is set by audio models billed by duration.
+	Seconds float64 `json:"seconds"`
+}
+
+// normalize maps either shape onto Usage; it returns nil when no token
+// counts were reported (e.g. audio usage billed by duration).
+func (ru *rawUsage) normalize() *Usage {
+	if ru == nil {
+		return nil
+	}
+	u := &Usage{
+		PromptTokens:            FirstNonZero(ru.PromptTokens, ru.InputTokens),
+		CompletionTokens:        FirstNonZero(ru.CompletionTokens, ru.OutputTokens),
+		TotalTokens:             ru.TotalTokens,
+		PromptTokensDetails:     ru.PromptTokensDetails,
+		CompletionTokensDetails: ru.CompletionTokensDetails,
+	}
+	for _, d := range []*PromptTokensDetails{ru.InputTokensDetails, ru.InputTokenDetails} {
+		if u.PromptTokensDetails == nil {
+			u.PromptTokensDetails = d
+		}
+	}
+	for _, d := range []*CompletionTokensDetails{ru.OutputTokensDetails, ru.OutputTokenDetails} {
+		if u.CompletionTokensDetails == nil {
+			u.CompletionTokensDetails = d
+		}
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	if u.TotalTokens == 0 {
+		return nil
+	}
+	return u
+}
+
+// handlePassthrough forwards the /v1 endpoints without a dedicated handler.
+// JSON bodies are routed by their model; other requests take the catch-all
+// route. Multipart uploads are streamed (see forwardMultipart), everything
+// else is buffered so it can be retried. Usage is metered by the extractor
+// of the endpoint family.
+func (s *Server) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	g := s.beginRequest(w, r, r.URL.Path)
+	defer s.finishRequest(g)
+	w = g.w
+	if !s.authenticateRequest(g, r) {
+		return
+	}
+	if boundary, ok := multipartBoundary(r.Header.Get("Content-Type")); ok {
+		s.forwardMultipart(g, r, boundary)
+		return
+	}
+
+	body, ok := s.readRequestBody(g, r, s.cfg.PassthroughMaxBodyBytes)
+	if !ok {
+		return
+	}
+	defer body.Close()
+
+	var preq modelField
+	isJSON := isJSONContentType(r.Header.Get("Content-Type")) && body.Size() > 0
+	if isJSON {
+		var err error
+		if preq, err = scanRequestModel(body.Reader()); err != nil {
+			WriteOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request",
+				"invalid JSON body: "+err.Error())
+			return
+		}
+	}
+
+	targets, ok := s.routePassthrough(g, preq.Model)
+	if !ok {
+		return
+	}
+	estTokens := 0
+	if isJSON {
+		estTokens = int(body.Size()/4) + 1
+	}
+	adm, ok := s.admitRequest(g, estTokens)
+	if !ok {
+		return
+	}
+
+	res, err := s.sendWithFailover(g.ctx, targets, func(t RouteTarget) (*http.Request, error) {
+		pp, err := passthroughProvider(t, r.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		rd, n := body.Reader(), body.Size()
+		if preq.Model != "" && t.Model != preq.Model {
+			raw, _ := json.Marshal(t.Model)
+			rd, n = body.Replace(preq.start, preq.end, raw)
+		}
+		return pp.NewPassthroughRequest(g.ctx, t.Upstream, r.Method, r.URL.Path, r.URL.RawQuery, r.Header, rd, n)
+	})
+	s.respondPassthrough(g, r, res, err, adm, nil)
+}
+
+// routePassthrough routes requests by model; requests without one take the
+// catch-all route.
+func (s *Server) routePassthrough(g *gatewayRequest, model string) ([]RouteTarget, bool) {
+	if model != "" {
+		return s.routeRequest(g, model)
+	}
+	targets, ok := s.router.Resolve("")
+	if !ok {
+		WriteOpenAIError(g.w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			"no catch-all route is configured for requests without a model")
+	}
+	return targets, ok
+}
+
+func passthroughProvider(t RouteTarget, path string) (PassthroughProvider, error) {
+	pp, ok := t.Upstream.Provider.(PassthroughProvider)
+	if !ok {
+		return nil, fmt.Errorf("%w: upstream %q does not support %s", ErrTranslateRequest, t.Upstream.Name, path)
+	}
+	return pp, nil
+}
+
+// respondPassthrough relays the upstream response and meters the request.
+// upload, when set, is called once the response was relayed and returns
+// what was seen in a streamed request body.
+func (s *Server) respondPassthrough(g *gatewayRequest, r *http.Request, res upstreamResult, err error, adm *Admission, upload func() uploadStats) {
+	up := res.target.Upstream
+	g.rm.upstream = up.Name
+	if err != nil {
+		adm.Reconcile(0)
+		if upload != nil {
+			upload()
+		}
+		if errors.Is(err, ErrBodyTooLarge) {
+			WriteOpenAIError(g.w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+				fmt.Sprintf("request body exceeds %d bytes", s.cfg.PassthroughMaxBodyBytes))
+			return
+		}
+		s.failUpstream(g, r, res, err)
+		return
+	}
+	upResp := res.resp
+	defer upResp.Body.Close()
+
+	out, copyErr := s.relayPassthrough(g, upResp, r.URL.Path)
+
+	ev := g.event(up.Provider.Name(), up.Name, FirstNonEmpty(out.Model, res.target.Model, "unknown"))
+	ev.StatusCode = upResp.StatusCode
+	ev.ErrorClass = classifyUpstreamStatus(upResp.StatusCode)
+	ev.Attempts = attemptsForEvent(res.attempts)
+	g.recordResponse(&ev, res, out.Stream)
+	g.markAborted(&ev, r, copyErr)
+	ev.InputCount = out.InputCount
+	ev.ImageCount = out.ImageCount
+	ev.AudioSeconds = out.AudioSeconds
+	if upload != nil {
+		st := upload()
+		ev.FileBytes = st.FileBytes
+		if ev.AudioSeconds == 0 && st.AudioSeconds > 0 {
+			ev.AudioSeconds, ev.AudioSecondsEstimated = st.AudioSeconds, true
+		}
+	}
+	if u := out.Usage; u != nil {
+		ev.PromptTokens = u.PromptTokens
+		ev.CompletionTokens = u.CompletionTokens
+		ev.TotalTokens = u.TotalTokens
+		ev.CachedTokens = u.CachedTokens()
+		ev.ReasoningTokens = u.ReasoningTokens()
+	}
+	s.priceEvent(&ev, out.Usage)
+	g.rm.usage = out.Usage
+	reconcileUsage(adm, upResp.StatusCode, out.Usage)
+	s.meter(g, ev)
+
+	if copyErr != nil {
+		log.Printf("proxy copy error request_id=%s endpoint=%s status=%d class=%s err=%v",
+			g.id, r.URL.Path, upResp.StatusCode, ev.ErrorClass, copyErr)
+	}
+}
+
+// relayPassthrough copies the upstream response as is. SSE responses are
+// streamed event by event; other bodies are captured up to
+// MeteringCaptureBytes for the extractor, which only sees successful JSON.
+func (s *Server) relayPassthrough(g *gatewayRequest, resp *http.Response, path string) (passthroughResult, error) {
+	var w http.ResponseWriter = g.w
+	copyResponseHeaders(w, resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+
+	ct := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(ct, "text/event-stream") {
+		stream := StreamSSE
+		if path == "/v1/responses" {
+			stream = StreamResponsesSSE
+		}
+		stats := s.metrics.streamStats(g.rm)
+		model, usage, err := stream(w, resp.Body, stats)
+		return passthroughResult{Model: model, Usage: usage, Stream: stats}, err
+	}
+
+	capWriter := NewLimitedCapture(s.cfg.MeteringCaptureBytes)
+	var out io.Writer = w
+	if fl, ok := w.(http.Flusher); ok {
+		out = &flushWriter{w: w, fl: fl}
+	}
+	_, err := io.Copy(out, io.TeeReader(resp.Body, capWriter))
+
+	if resp.StatusCode/100 != 2 || !isJSONContentType(ct) {
+		return passthroughResult{}, err
+	}
+	return extractorFor(path)(capWriter.Bytes()), err
+}
+
+func isJSONContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// modelField is the top-level "model" of a JSON request body and the byte
+// offsets of its raw value, and whether a stream was requested.
+type modelField struct {
+	Model      string
+	Stream     bool
+	start, end int64
+}
+
+// scanRequestModel finds the top-level "model" and "stream" of a JSON
+// object without decoding the rest of the body.
+func scanRequestModel(r io.Reader) (modelField, error) {
+	var mf modelField
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return mf, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return mf, err
+		}
+		if key == "stream" {
+			if err := dec.Decode(&mf.Stream); err != nil {
+				return mf, fmt.Errorf("stream: %w", err)
+			}
+			continue
+		}
+		if key != "model" || mf.end > 0 {
+			if err := skipValue(dec); err != nil {
+				return mf, err
+			}
+			continue
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return mf, err
+		}
+		if err := json.Unmarshal(raw, &mf.Model); err != nil {
+			return mf, fmt.Errorf("model: %w", err)
+		}
+		mf.end = dec.InputOffset()
+		mf.start = mf.end - int64(len(raw))
+	}
+	return mf, expectDelim(dec, '}')
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawUsage_Normalize(t *testing.T) {
+	var ru *rawUsage
+	require.Nil(t, ru.normalize())
+
+	require.NoError(t, json.Unmarshal([]byte(`{"input_tokens":10,"output_tokens":4,"input_tokens_details":{"cached_tokens":6},"output_tokens_details":{"reasoning_tokens":2}}`), &ru))
+	u := ru.normalize()
+	require.Equal(t, 10, u.PromptTokens)
+	require.Equal(t, 4, u.CompletionTokens)
+	require.Equal(t, 14, u.TotalTokens)
+	require.Equal(t, 6, u.CachedTokens())
+	require.Equal(t, 2, u.ReasoningTokens())
+
+	ru = nil
+	require.NoError(t, json.Unmarshal([]byte(`{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}`), &ru))
+	require.Equal(t, &Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}, ru.normalize())
+
+	ru = nil
+	require.NoError(t, json.Unmarshal([]byte(`{"type":"duration","seconds":12}`), &ru))
+	require.Nil(t, ru.normalize())
+}
+
+func TestExtractors(t *testing.T) {
+	mod := extractorFor("/v1/moderations")([]byte(`{"model":"omni-moderation-latest","results":[{},{},{}]}`))
+	require.Equal(t, passthroughResult{Model: "omni-moderation-latest", InputCount: 3}, mod)
+
+	img := extractorFor("/v1/images/generations")([]byte(`{"data":[{},{}],"usage":{"input_tokens":50,"output_tokens":4160,"total_tokens":4210}}`))
+	require.Equal(t, 2, img.ImageCount)
+	require.Equal(t, 4210, img.Usage.TotalTokens)
+
+	require.Equal(t, passthroughResult{}, extractorFor("/v1/files")([]byte(`{"data":[{}]}`)))
+	require.Equal(t, passthroughResult{}, extractorFor("/v1/batches/b1")([]byte(`{"model":"x"}`)))
+	require.Equal(t, passthroughResult{}, extractorFor("/v1/completions")([]byte(`not json`)))
+}
+
+func TestScanRequestModel(t *testing.T) {
+	body := `{"prompt":{"x":[1,2]},"model" : "gpt-image-1","n":2}`
+	mf, err := scanRequestModel(strings.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, "gpt-image-1", mf.Model)
+	require.Equal(t, `"gpt-image-1"`, body[mf.start:mf.end])
+
+	mf, err = scanRequestModel(strings.NewReader(`{"input":"hi"}`))
+	require.NoError(t, err)
+	require.Empty(t, mf.Model)
+
+	_, err = scanRequestModel(strings.NewReader(`{"model":`))
+	require.Error(t, err)
+}
+
+func (e *testEnv) send(t *testing.T, method, target, token, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.srv.Mux().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPassthrough_Images(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/images/generations", r.URL.Path)
+		require.Equal(t, "Bearer sk-upstream", r.Header.Get("Authorization"))
+		require.Equal(t, "proj_1", r.Header.Get("OpenAI-Project"))
+		require.Empty(t, r.Header.Get("X-Tenant"))
+		b, _ := io.ReadAll(r.Body)
+		require.JSONEq(t, `{"model":"gpt-image-1","prompt":"a cat","n":2}`, string(b))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"created":1,"data":[{"b64_json":"AA=="},{"b64_json":"AA=="}],"usage":{"input_tokens":10,"output_tokens":20,"total_tokens":30,"input_tokens_details":{"text_tokens":10}}}`))
+	}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(`{"model":"gpt-image-1","prompt":"a cat","n":2}`))
+	req.Header.Set("Authorization", "Bearer dummy")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("OpenAI-Project", "proj_1")
+	req.Header.Set("X-Tenant", "acme")
+	rec := httptest.NewRecorder()
+	env.srv.Mux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"b64_json"`)
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "/v1/images/generations", ev.Endpoint)
+	require.Equal(t, "acme", ev.Tenant)
+	require.Equal(t, "gpt-image-1", ev.Model)
+	require.Equal(t, 2, ev.ImageCount)
+	require.Equal(t, 10, ev.PromptTokens)
+	require.Equal(t, 20, ev.CompletionTokens)
+	require.Equal(t, 30, ev.TotalTokens)
+}
+
+func TestPassthrough_ModelsWithoutBody(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method)
+		require.Equal(t, "/v1/models", r.URL.Path)
+		require.Equal(t, "limit=2", r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[]}`))
+	}, nil)
+
+	rec := env.send(t, http.MethodGet, "/v1/models?limit=2", "dummy", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"object":"list","data":[]}`, rec.Body.String())
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "/v1/models", ev.Endpoint)
+	require.Equal(t, "unknown", ev.Model)
+	require.Equal(t, http.StatusOK, ev.StatusCode)
+}
+
+func TestPassthrough_Moderations(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write([]byte(`{"id":"modr-1","model":"omni-moderation-latest","results":[{"flagged":false},{"flagged":true}]}`))
+	}, nil)
+
+	rec := env.send(t, http.MethodPost, "/v1/moderations", "dummy", "application/json", `{"model":"omni-moderation-latest","input":["a","b"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, 2, ev.InputCount)
+	require.Equal(t, "omni-moderation-latest", ev.Model)
+}
+
+func TestPassthrough_PathRules(t *testing.T) {
+	var hits int
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"file-1"}]}`))
+	}, func(cfg *Config) {
+		withKeys(t, cfg, `
+keys:
+  - id: app
+    key: gw_app
+    tenant: a
+  - id: batch-runner
+    key: gw_batch
+    tenant: a
+    allowed_paths: ["/v1/files*", "/v1/batches*"]
+    denied_paths: ["/v1/files/*/content"]
+`)
+	})
+
+	rejected := func(rec *httptest.ResponseRecorder, path string) {
+		t.Helper()
+		require.Equal(t, http.StatusForbidden, rec.Code)
+		require.Equal(t, "path_not_allowed", decodeOpenAIError(t, rec).Code)
+		ev := env.nextEvent(t)
+		require.Equal(t, path, ev.Endpoint)
+		require.Equal(t, ErrorClassAuth, ev.ErrorClass)
+	}
+
+	rejected(env.send(t, http.MethodGet, "/v1/files", "gw_app", "", ""), "/v1/files")
+	rejected(env.send(t, http.MethodGet, "/v1/files/file-1/content", "gw_batch", "", ""), "/v1/files/file-1/content")
+	rejected(env.do(t, "/v1/chat/completions", "gw_batch", `{"model":"gpt-4o-mini"}`, nil), "/v1/chat/completions")
+	require.Zero(t, hits)
+
+	rec := env.send(t, http.MethodGet, "/v1/files", "gw_batch", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, "batch-runner", ev.AppKeyID)
+	require.Zero(t, ev.TotalTokens)
+	require.Equal(t, 1, hits)
+}
+
+func TestPassthrough_InvalidJSON(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, nil)
+	rec := env.send(t, http.MethodPost, "/v1/completions", "dummy", "application/json", `{"model":`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "invalid_request", decodeOpenAIError(t, rec).Code)
+	require.Equal(t, ErrorClassInvalidRequest, env.nextEvent(t).ErrorClass)
+}
+
+func TestPassthrough_Stream(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"model\":\"gpt-3.5-turbo-instruct\",\"choices\":[{\"text\":\"hi\"}]}\n\n" +
+			"data: {\"model\":\"gpt-3.5-turbo-instruct\",\"choices\":[],\"usage\":{\"prompt_tokens\":2,\"completion_tokens\":1,\"total_tokens\":3}}\n\n" +
+			"data: [DONE]\n\n"))
+	}, nil)
+
+	rec := env.send(t, http.MethodPost, "/v1/completions", "dummy", "application/json", `{"model":"gpt-3.5-turbo-instruct","prompt":"x","stream":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "data: [DONE]")
+	ev := env.nextEvent(t)
+	require.Equal(t, 3, ev.TotalTokens)
+	require.Equal(t, "gpt-3.5-turbo-instruct", ev.Model)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ModelPrice is the price of a model in USD per million tokens, valid from
+// EffectiveFrom until a later entry for the same model takes over.
+// CachedInput and Reasoning fall back to Input and Output when unset.
+type ModelPrice struct {
+	Provider      string    `yaml:"provider" json:"provider"`
+	Upstream      string    `yaml:"upstream,omitempty" json:"upstream,omitempty"`
+	Model         string    `yaml:"model" json:"model"`
+	EffectiveFrom time.Time `yaml:"effective_from" json:"effective_from"`
+	Input         float64   `yaml:"input_per_mtok" json:"input_per_mtok"`
+	Output        float64   `yaml:"output_per_mtok" json:"output_per_mtok"`
+	CachedInput   *float64  `yaml:"cached_input_per_mtok,omitempty" json:"cached_input_per_mtok,omitempty"`
+	Reasoning     *float64  `yaml:"reasoning_per_mtok,omitempty" json:"reasoning_per_mtok,omitempty"`
+	AudioInput    *float64  `yaml:"audio_input_per_mtok,omitempty" json:"audio_input_per_mtok,omitempty"`
+	AudioOutput   *float64  `yaml:"audio_output_per_mtok,omitempty" json:"audio_output_per_mtok,omitempty"`
+}
+
+// PriceCatalog is a versioned list of model prices. Version is stamped on
+// every priced event so totals can be traced back to the catalog used.
+type PriceCatalog struct {
+	Version string       `yaml:"version" json:"version"`
+	Prices  []ModelPrice `yaml:"prices" json:"prices"`
+}
+
+func LoadPriceCatalog(filename string) (*PriceCatalog, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePriceCatalog(b)
+}
+
+func ParsePriceCatalog(b []byte) (*PriceCatalog, error) {
+	var c PriceCatalog
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parse price catalog: %w", err)
+	}
+	if c.Version == "" {
+		return nil, errors.New("price catalog: missing version")
+	}
+	type priceKey struct {
+		provider, upstream, model string
+		from                      time.Time
+	}
+	seen := map[priceKey]bool{}
+	for i, p := range c.Prices {
+		if p.Model == "" {
+			return nil, fmt.Errorf("prices[%d]: missing model", i)
+		}
+		if p.Input < 0 || p.Output < 0 || negative(p.CachedInput) || negative(p.Reasoning) || negative(p.AudioInput) || negative(p.AudioOutput) {
+			return nil, fmt.Errorf("prices[%d] %s: prices must not be negative", i, p.Model)
+		}
+		k := priceKey{p.Provider, p.Upstream, p.Model, p.EffectiveFrom}
+		if seen[k] {
+			return nil, fmt.Errorf("prices[%d] %s: duplicate entry for effective_from %s", i, p.Model, p.EffectiveFrom.Format(time.DateOnly))
+		}
+		seen[k] = true
+	}
+	return &c, nil
+}
+
+// Lookup returns the price in effect at the given time. Entries naming the
+// upstream win over provider-wide ones, exact model names over patterns
+// (longer prefixes first); among equally specific entries the latest
+// effective_from not after at applies. An empty or "*" provider matches
+// every provider.
+func (c *PriceCatalog) Lookup(provider, upstream, model string, at time.Time) (*ModelPrice, bool) {
+	var best *ModelPrice
+	bestScore := -1
+	for i := range c.Prices {
+		p := &c.Prices[i]
+		if p.Provider != "" && p.Provider != "*" && !strings.EqualFold(p.Provider, provider) {
+			continue
+		}
+		if p.Upstream != "" && p.Upstream != upstream {
+			continue
+		}
+		if p.EffectiveFrom.After(at) {
+			continue
+		}
+		score := priceSpecificity(p.Model, model)
+		if score < 0 {
+			continue
+		}
+		if p.Upstream != "" {
+			score += 1 << 20
+		}
+		if score > bestScore || (score == bestScore && p.EffectiveFrom.After(best.EffectiveFrom)) {
+			best, bestScore = p, score
+		}
+	}
+	return best, best != nil
+}
+
+// HasModel reports whether an entry names model exactly, not as a pattern.
+func (c *PriceCatalog) HasModel(model string) bool {
+	for _, p := range c.Prices {
+		if p.Model == model {
+			return true
+		}
+	}
+	return false
+}
+
+// priceSpecificity ranks how well pattern matches model, or returns -1.
+func priceSpecificity(pattern, model string) int {
+	if pattern == model {
+		return 1 << 16
+	}
+	if !matchModelPattern(pattern, model) {
+		return -1
+	}
+	return len(strings.TrimRight(pattern, "*"))
+}
+
+func negative(p *float64) bool { return p != nil && *p < 0 }
+
+// Cost returns the price of u in USD. Cached prompt tokens, reasoning
+// tokens and audio tokens are billed at their own rates and the rest of the
+// prompt and completion at the input and output rates. Cached tokens are
+// assumed to be text, so audio is billed only beyond them.
+func (p *ModelPrice) Cost(u *Usage) float64 {
+	cached, reasoning := u.CachedTokens(), u.ReasoningTokens()
+	audioIn := min(u.InputAudioTokens(), max(u.PromptTokens-cached, 0))
+	audioOut := u.OutputAudioTokens()
+	rate := func(r *float64, def float64) float64 {
+		if r != nil {
+			return *r
+		}
+		return def
+	}
+	cost := float64(max(u.PromptTokens-cached-audioIn, 0))*p.Input +
+		float64(cached)*rate(p.CachedInput, p.Input) +
+		float64(audioIn)*rate(p.AudioInput, p.Input) +
+		float64(max(u.CompletionTokens-reasoning-audioOut, 0))*p.Output +
+		float64(reasoning)*rate(p.Reasoning, p.Output) +
+		float64(audioOut)*rate(p.AudioOutput, p.Output)
+	// round away float noise; 1e-10 USD is far below any billing unit
+	return math.Round(cost/1e6*1e10) / 1e10
+}
+
+// priceEvent fills cost_usd and the catalog version when a price is known.
+func (s *Server) priceEvent(ev *MeteringEvent, u *Usage) {
+	if s.prices == nil || u == nil {
+		return
+	}
+	p, ok := s.prices.Lookup(ev.Provider, ev.Upstream, ev.Model, ev.At)
+	if !ok {
+		return
+	}
+	cost := p.Cost(u)
+	ev.CostUSD = &cost
+	ev.PriceCatalogVersion = s.prices.Version
+}
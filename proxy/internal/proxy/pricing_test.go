@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPriceCatalog = `
+version: "2025-06-01"
+prices:
+  - provider: openai
+    model: "gpt-4o*"
+    effective_from: 2024-05-13
+    input_per_mtok: 5
+    output_per_mtok: 15
+  - provider: openai
+    model: "gpt-4o*"
+    effective_from: 2024-10-01
+    input_per_mtok: 2.5
+    output_per_mtok: 10
+    cached_input_per_mtok: 1.25
+  - provider: openai
+    model: "gpt-4o-mini*"
+    effective_from: 2024-07-18
+    input_per_mtok: 0.15
+    output_per_mtok: 0.6
+  - provider: openai
+    upstream: azure-eu
+    model: "gpt-4o*"
+    effective_from: 2024-05-13
+    input_per_mtok: 2.75
+    output_per_mtok: 11
+  - provider: openai
+    model: o3
+    effective_from: 2025-04-16
+    input_per_mtok: 2
+    output_per_mtok: 8
+    reasoning_per_mtok: 4
+  - provider: openai
+    model: "gpt-4o-realtime*"
+    effective_from: 2024-12-17
+    input_per_mtok: 5
+    output_per_mtok: 20
+    cached_input_per_mtok: 2.5
+    audio_input_per_mtok: 40
+    audio_output_per_mtok: 80
+  - provider: anthropic
+    model: claude-sonnet-4-20250514
+    effective_from: 2025-05-22
+    input_per_mtok: 3
+    output_per_mtok: 15
+    cached_input_per_mtok: 0.3
+`
+
+func TestPriceCatalog_Lookup(t *testing.T) {
+	c, err := ParsePriceCatalog([]byte(testPriceCatalog))
+	require.NoError(t, err)
+	day := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		require.NoError(t, err)
+		return d
+	}
+
+	tests := []struct {
+		provider, upstream, model string
+		at                        time.Time
+		input                     float64
+		ok                        bool
+	}{
+		{"openai", "openai", "gpt-4o-2024-08-06", day("2024-09-01"), 5, true},
+		{"openai", "openai", "gpt-4o-2024-08-06", day("2025-01-01"), 2.5, true},
+		{"openai", "openai", "gpt-4o-mini", day("2025-01-01"), 0.15, true},
+		{"openai", "azure-eu", "gpt-4o", day("2025-01-01"), 2.75, true},
+		{"openai", "openai", "gpt-4o", day("2024-01-01"), 0, false},
+		{"anthropic", "claude", "gpt-4o", day("2025-01-01"), 0, false},
+		{"openai", "openai", "gpt-3.5-turbo", day("2025-01-01"), 0, false},
+	}
+	for _, tt := range tests {
+		p, ok := c.Lookup(tt.provider, tt.upstream, tt.model, tt.at)
+		require.Equal(t, tt.ok, ok, "%s/%s %s", tt.provider, tt.model, tt.at)
+		if ok {
+			require.Equal(t, tt.input, p.Input, "%s/%s %s", tt.provider, tt.model, tt.at)
+		}
+	}
+}
+
+func TestModelPrice_Cost(t *testing.T) {
+	c, err := ParsePriceCatalog([]byte(testPriceCatalog))
+	require.NoError(t, err)
+	at := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	p, ok := c.Lookup("openai", "openai", "gpt-4o", at)
+	require.True(t, ok)
+	u := &Usage{
+		PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500,
+		PromptTokensDetails: &PromptTokensDetails{CachedTokens: 400},
+	}
+	// 600*2.5 + 400*1.25 + 500*10 = 7000 per million
+	require.InDelta(t, 0.007, p.Cost(u), 1e-12)
+
+	p, ok = c.Lookup("openai", "openai", "o3", at)
+	require.True(t, ok)
+	u = &Usage{
+		PromptTokens: 100, CompletionTokens: 1000, TotalTokens: 1100,
+		CompletionTokensDetails: &CompletionTokensDetails{ReasoningTokens: 800},
+	}
+	// 100*2 + 200*8 + 800*4 = 5000 per million
+	require.InDelta(t, 0.005, p.Cost(u), 1e-12)
+
+	// without cached/reasoning prices those tokens use input/output rates
+	p, ok = c.Lookup("openai", "openai", "gpt-4o-mini", at)
+	require.True(t, ok)
+	u.PromptTokensDetails = &PromptTokensDetails{CachedTokens: 50}
+	require.InDelta(t, (100*0.15+1000*0.6)/1e6, p.Cost(u), 1e-12)
+
+	p, ok = c.Lookup("openai", "openai", "gpt-4o-realtime-preview", at)
+	require.True(t, ok)
+	u = &Usage{
+		PromptTokens: 1000, CompletionTokens: 300, TotalTokens: 1300,
+		PromptTokensDetails:     &PromptTokensDetails{CachedTokens: 200, AudioTokens: 500},
+		CompletionTokensDetails: &CompletionTokensDetails{AudioTokens: 200},
+	}
+	// 300*5 + 200*2.5 + 500*40 + 100*20 + 200*80 = 40000 per million
+	require.InDelta(t, 0.04, p.Cost(u), 1e-12)
+}
+
+func TestParsePriceCatalog_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"missing version": `prices: [{model: a, input_per_mtok: 1}]`,
+		"missing model":   `{version: v1, prices: [{input_per_mtok: 1}]}`,
+		"negative":        `{version: v1, prices: [{model: a, input_per_mtok: -1}]}`,
+		"duplicate": `{version: v1, prices: [
+			{model: a, effective_from: 2025-01-01, input_per_mtok: 1},
+			{model: a, effective_from: 2025-01-01, input_per_mtok: 2}]}`,
+	}
+	for name, content := range cases {
+		_, err := ParsePriceCatalog([]byte(content))
+		require.Error(t, err, name)
+	}
+}
+
+func TestChatCompletions_EventCost(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"c1","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500,` +
+			`"prompt_tokens_details":{"cached_tokens":400},"completion_tokens_details":{"reasoning_tokens":0}}}`))
+	}, func(cfg *Config) {
+		p := t.TempDir() + "/prices.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(testPriceCatalog), 0o600))
+		cfg.PriceCatalogFile = p
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, 400, ev.CachedTokens)
+	require.Equal(t, "2025-06-01", ev.PriceCatalogVersion)
+	require.NotNil(t, ev.CostUSD)
+	require.InDelta(t, 0.007, *ev.CostUSD, 1e-12)
+}
+
+func TestChatCompletions_UnpricedModelHasNoCost(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		p := t.TempDir() + "/prices.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`{version: v1, prices: [{provider: openai, model: gpt-4.1, input_per_mtok: 2, output_per_mtok: 8}]}`), 0o600))
+		cfg.PriceCatalogFile = p
+	})
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	ev := env.nextEvent(t)
+	require.Nil(t, ev.CostUSD)
+	require.Empty(t, ev.PriceCatalogVersion)
+}
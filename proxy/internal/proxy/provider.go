@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Provider adapts the OpenAI chat completions API exposed by the gateway to
+// an upstream backend. Clients always speak OpenAI; a provider translates the
+// request on the way out and the response (plain or SSE) on the way back.
+type Provider interface {
+	// Name is recorded as MeteringEvent.Provider.
+	Name() string
+	// NewChatRequest builds the upstream request for an OpenAI chat
+	// completion request body. in carries the client's request headers.
+	NewChatRequest(ctx context.Context, up *Upstream, in http.Header, body []byte, oreq *OpenAIRequest) (*http.Request, error)
+	// WriteResponse writes a non-streaming upstream response to w as an
+	// OpenAI chat completion and returns the model and usage it reported.
+	WriteResponse(w http.ResponseWriter, resp *http.Response, oreq *OpenAIRequest) (string, *Usage, error)
+	// WriteStream writes an upstream streaming response to w as OpenAI
+	// chat.completion.chunk SSE events and returns the model and usage seen.
+	// The content chunks written are timed in stats.
+	WriteStream(w http.ResponseWriter, resp *http.Response, oreq *OpenAIRequest, stats *StreamStats) (string, *Usage, error)
+	// ExtractUsage returns the model and usage from a non-streaming
+	// upstream response body in the provider's native format.
+	ExtractUsage(body []byte) (string, *Usage)
+}
+
+// Upstream is a backend the gateway forwards requests to.
+type Upstream struct {
+	Name     string
+	BaseURL  string
+	APIKey   string
+	Provider Provider
+	Client   *http.Client
+	Retry    RetryPolicy
+}
+
+func (u *Upstream) URL(path string) string {
+	return strings.TrimRight(u.BaseURL, "/") + path
+}
+
+// ErrTranslateRequest marks client requests a provider cannot translate.
+var ErrTranslateRequest = errors.New("cannot translate request")
+
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+)
+
+// NewProvider returns the provider implementation registered under name.
+func NewProvider(name string, cfg Config) (Provider, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", ProviderOpenAI:
+		return &openAIProvider{captureBytes: cfg.MeteringCaptureBytes, injectStreamUsage: !cfg.DisableStreamUsageInjection}, true
+	case ProviderAnthropic:
+		return &anthropicProvider{}, true
+	default:
+		return nil, false
+	}
+}
+
+// forwardedOpenAIHeaders are client headers passed through to OpenAI upstreams.
+var forwardedOpenAIHeaders = []string{"OpenAI-Organization", "OpenAI-Beta", "OpenAI-Project"}
+
+type openAIProvider struct {
+	captureBytes      int
+	injectStreamUsage bool
+}
+
+func (p *openAIProvider) Name() string { return ProviderOpenAI }
+
+// NewChatRequest asks for the usage chunk of streamed completions when the
+// client did not, so that they can be metered.
+func (p *openAIProvider) NewChatRequest(ctx context.Context, up *Upstream, in http.Header, body []byte, oreq *OpenAIRequest) (*http.Request, error) {
+	if p.injectsUsage(oreq) {
+		if b, err := withStreamUsage(body); err == nil {
+			body = b
+		}
+	}
+	return newOpenAIRequest(ctx, up, "/v1/chat/completions", in, bytes.NewReader(body), int64(len(body)))
+}
+
+func (p *openAIProvider) injectsUsage(oreq *OpenAIRequest) bool {
+	return p.injectStreamUsage && oreq != nil && oreq.Stream && !oreq.IncludesUsage()
+}
+
+// withStreamUsage sets stream_options.include_usage in a JSON request body,
+// keeping every other field and stream option as sent by the client.
+func withStreamUsage(body []byte) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	opts := map[string]json.RawMessage{}
+	if raw, ok := m["stream_options"]; ok && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return nil, err
+		}
+	}
+	opts["include_usage"] = json.RawMessage("true")
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	m["stream_options"] = b
+	return json.Marshal(m)
+}
+
+func (p *openAIProvider) NewEmbeddingsRequest(ctx context.Context, up *Upstream, in http.Header, body io.Reader, size int64) (*http.Request, error) {
+	return newOpenAIRequest(ctx, up, "/v1/embeddings", in, body, size)
+}
+
+// NewPassthroughRequest forwards any other /v1 request unchanged apart from
+// the credentials; client headers are kept except those the gateway owns.
+func (p *openAIProvider) NewPassthroughRequest(ctx context.Context, up *Upstream, method, path, rawQuery string, in http.Header, body io.Reader, size int64) (*http.Request, error) {
+	u := up.URL(path)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, vals := range in {
+		if IsHopByHopHeader(k) || isGatewayRequestHeader(k) {
+			continue
+		}
+		req.Header[k] = append([]string(nil), vals...)
+	}
+	req.Header.Set("Authorization", "Bearer "+up.APIKey)
+	return req, nil
+}
+
+// RealtimeDial targets the upstream's /v1/realtime with the upstream key.
+func (p *openAIProvider) RealtimeDial(up *Upstream, query url.Values, in http.Header) (string, http.Header) {
+	u := up.URL("/v1/realtime")
+	if rest, ok := strings.CutPrefix(u, "http"); ok {
+		u = "ws" + rest
+	}
+	hdr := http.Header{}
+	hdr.Set("Authorization", "Bearer "+up.APIKey)
+	for _, h := range forwardedOpenAIHeaders {
+		if v := in.Get(h); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+	return u + "?" + query.Encode(), hdr
+}
+
+// isGatewayRequestHeader reports client headers that are meant for the
+// gateway or that the transport sets itself.
+func isGatewayRequestHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case "Authorization", "Host", "Content-Length", "Accept-Encoding", "X-Llm-Tenant", "X-Tenant":
+		return true
+	default:
+		return false
+	}
+}
+
+func newOpenAIRequest(ctx context.Context, up *Upstream, path string, in http.Header, body io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, up.URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+up.APIKey)
+
+	for _, h := range forwardedOpenAIHeaders {
+		if v := in.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	return req, nil
+}
+
+// usageTailBytes is how much of the end of a response too large to capture
+// is kept to find its usage.
+const usageTailBytes = 4 << 10
+
+// WriteResponse relays the response; without usage in it, usage is
+// estimated from the request and the completion. The usage of a response
+// larger than the capture is read from its end and never estimated, as
+// the completion is incomplete.
+func (p *openAIProvider) WriteResponse(w http.ResponseWriter, resp *http.Response, oreq *OpenAIRequest) (string, *Usage, error) {
+	copyResponseHeaders(w, resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+
+	capWriter := NewLimitedCapture(p.captureBytes)
+	tail := &tailCapture{size: usageTailBytes}
+	tee := io.TeeReader(resp.Body, io.MultiWriter(capWriter, tail))
+
+	var out io.Writer = w
+	if fl, ok := w.(http.Flusher); ok {
+		out = &flushWriter{w: w, fl: fl}
+	}
+
+	_, copyErr := io.Copy(out, tee)
+
+	if capWriter.Truncated() {
+		return "", trailingUsage(tail.buf), copyErr
+	}
+	model, usage := p.ExtractUsage(capWriter.Bytes())
+	if usage == nil && resp.StatusCode/100 == 2 {
+		usage = estimateChatUsage(FirstNonEmpty(model, requestModel(oreq)), oreq, completionText(capWriter.Bytes()))
+	}
+	return model, usage, copyErr
+}
+
+// WriteStream relays the stream; when it ends without usage, usage is
+// estimated from the request and the streamed deltas.
+func (p *openAIProvider) WriteStream(w http.ResponseWriter, resp *http.Response, oreq *OpenAIRequest, stats *StreamStats) (string, *Usage, error) {
+	copyResponseHeaders(w, resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+
+	var completion strings.Builder
+	model, usage, err := streamChatSSE(w, resp.Body, p.injectsUsage(oreq), &completion, stats)
+	if usage == nil && resp.StatusCode/100 == 2 {
+		usage = estimateChatUsage(FirstNonEmpty(model, requestModel(oreq)), oreq, completion.String())
+	}
+	return model, usage, err
+}
+
+func requestModel(oreq *OpenAIRequest) string {
+	if oreq == nil {
+		return ""
+	}
+	return oreq.Model
+}
+
+func (p *openAIProvider) ExtractUsage(body []byte) (string, *Usage) {
+	if len(body) == 0 {
+		return "", nil
+	}
+	var oresp OpenAIResponse
+	_ = json.Unmarshal(body, &oresp)
+	return oresp.Model, oresp.Usage
+}
+
+// copyResponseHeaders copies upstream response headers to the client,
+// skipping hop-by-hop headers. Providers that rewrite the body drop the
+// upstream Content-Length and Content-Encoding.
+func copyResponseHeaders(w http.ResponseWriter, h http.Header, rewritesBody bool) {
+	for k, vals := range h {
+		if IsHopByHopHeader(k) {
+			continue
+		}
+		if rewritesBody && (strings.EqualFold(k, "Content-Length") || strings.EqualFold(k, "Content-Encoding")) {
+			continue
+		}
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+}
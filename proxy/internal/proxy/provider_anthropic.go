@@ -0,0 +1,741 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	anthropicVersion          = "2023-06-01"
+	anthropicDefaultMaxTokens = 4096
+	anthropicMaxResponseBytes = 32 << 20
+)
+
+// anthropicProvider translates OpenAI chat completions to and from the
+// Anthropic Messages API (/v1/messages).
+type anthropicProvider struct{}
+
+// OpenAI chat completion request, as far as the translation needs it.
+type chatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []chatMessage   `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Temperature         *float64        `json:"temperature"`
+	TopP                *float64        `json:"top_p"`
+	Stop                json.RawMessage `json:"stop"`
+	Stream              bool            `json:"stream"`
+	Tools               []chatTool      `json:"tools"`
+	ToolChoice          json.RawMessage `json:"tool_choice"`
+	User                string          `json:"user"`
+}
+
+type chatMessage struct {
+	Role       string          `json:"role"`
+	Name       string          `json:"name,omitempty"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  []chatToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+type chatContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL *struct {
+		URL    string `json:"url"`
+		Detail string `json:"detail,omitempty"`
+	} `json:"image_url"`
+}
+
+type chatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type chatToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolUse  `json:"tool_choice,omitempty"`
+	Metadata      *anthropicMetadata `json:"metadata,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   string                `json:"content,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolUse struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      *anthropicUsage  `json:"usage"`
+}
+
+type anthropicErrorBody struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// OpenAI chat completion response shapes produced by the translation.
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *Usage       `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int              `json:"index"`
+	Message      chatOutMessage   `json:"message"`
+	FinishReason string           `json:"finish_reason"`
+	Logprobs     *json.RawMessage `json:"logprobs"`
+}
+
+type chatOutMessage struct {
+	Role      string         `json:"role"`
+	Content   *string        `json:"content"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatChunk struct {
+	ID      string            `json:"id"`
+	Object  string            `json:"object"`
+	Created int64             `json:"created"`
+	Model   string            `json:"model"`
+	Choices []chatChunkChoice `json:"choices"`
+	Usage   *Usage            `json:"usage,omitempty"`
+}
+
+type chatChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        chatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+	// Text is the output of legacy completions streams.
+	Text string `json:"text,omitempty"`
+}
+
+type chatDelta struct {
+	Role      string              `json:"role,omitempty"`
+	Content   *string             `json:"content,omitempty"`
+	ToolCalls []chatToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+type chatToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+func (p *anthropicProvider) Name() string { return ProviderAnthropic }
+
+func (p *anthropicProvider) NewChatRequest(ctx context.Context, up *Upstream, _ http.Header, body []byte, _ *OpenAIRequest) (*http.Request, error) {
+	var creq chatRequest
+	if err := json.Unmarshal(body, &creq); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranslateRequest, err)
+	}
+	areq, err := translateChatToAnthropic(&creq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranslateRequest, err)
+	}
+	b, err := json.Marshal(areq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, up.URL("/v1/messages"), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", up.APIKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	return req, nil
+}
+
+func translateChatToAnthropic(creq *chatRequest) (*anthropicRequest, error) {
+	areq := &anthropicRequest{
+		Model:       creq.Model,
+		MaxTokens:   anthropicDefaultMaxTokens,
+		Temperature: creq.Temperature,
+		TopP:        creq.TopP,
+		Stream:      creq.Stream,
+	}
+	if creq.MaxCompletionTokens != nil {
+		areq.MaxTokens = *creq.MaxCompletionTokens
+	} else if creq.MaxTokens != nil {
+		areq.MaxTokens = *creq.MaxTokens
+	}
+	// OpenAI accepts temperatures up to 2, Anthropic up to 1.
+	if t := areq.Temperature; t != nil && *t > 1 {
+		one := 1.0
+		areq.Temperature = &one
+	}
+	if creq.User != "" {
+		areq.Metadata = &anthropicMetadata{UserID: creq.User}
+	}
+
+	if len(creq.Stop) > 0 && string(creq.Stop) != "null" {
+		var one string
+		if err := json.Unmarshal(creq.Stop, &one); err == nil {
+			areq.StopSequences = []string{one}
+		} else if err := json.Unmarshal(creq.Stop, &areq.StopSequences); err != nil {
+			return nil, errors.New("invalid stop")
+		}
+	}
+
+	for _, t := range creq.Tools {
+		schema := t.Function.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		areq.Tools = append(areq.Tools, anthropicTool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	if len(creq.ToolChoice) > 0 {
+		tc, dropTools := translateToolChoice(creq.ToolChoice)
+		if dropTools {
+			areq.Tools = nil
+		} else {
+			areq.ToolChoice = tc
+		}
+	}
+
+	var system []string
+	for _, m := range creq.Messages {
+		switch m.Role {
+		case "system", "developer":
+			text, _ := chatContentBlocks(m.Content)
+			for _, b := range text {
+				if b.Type == "text" {
+					system = append(system, b.Text)
+				}
+			}
+		case "user":
+			blocks, err := chatContentBlocks(m.Content)
+			if err != nil {
+				return nil, err
+			}
+			areq.Messages = appendAnthropicMessage(areq.Messages, "user", blocks)
+		case "assistant":
+			blocks, err := chatContentBlocks(m.Content)
+			if err != nil {
+				return nil, err
+			}
+			for _, tc := range m.ToolCalls {
+				input := json.RawMessage(tc.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage(`{}`)
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: tc.ID, Name: tc.Function.Name, Input: input})
+			}
+			areq.Messages = appendAnthropicMessage(areq.Messages, "assistant", blocks)
+		case "tool", "function":
+			text, _ := chatContentBlocks(m.Content)
+			var sb strings.Builder
+			for _, b := range text {
+				sb.WriteString(b.Text)
+			}
+			areq.Messages = appendAnthropicMessage(areq.Messages, "user", []anthropicBlock{{
+				Type:      "tool_result",
+				ToolUseID: m.ToolCallID,
+				Content:   sb.String(),
+			}})
+		default:
+			return nil, errors.New("unsupported message role: " + m.Role)
+		}
+	}
+	areq.System = strings.Join(system, "\n\n")
+	return areq, nil
+}
+
+// appendAnthropicMessage merges consecutive messages of the same role since
+// the Messages API requires alternating user/assistant turns.
+func appendAnthropicMessage(msgs []anthropicMessage, role string, blocks []anthropicBlock) []anthropicMessage {
+	if len(blocks) == 0 {
+		return msgs
+	}
+	if n := len(msgs); n > 0 && msgs[n-1].Role == role {
+		msgs[n-1].Content = append(msgs[n-1].Content, blocks...)
+		return msgs
+	}
+	return append(msgs, anthropicMessage{Role: role, Content: blocks})
+}
+
+func chatContentBlocks(raw json.RawMessage) ([]anthropicBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+
+	var parts []chatContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, errors.New("invalid message content")
+	}
+	var blocks []anthropicBlock
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			if part.Text != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: part.Text})
+			}
+		case "image_url":
+			if part.ImageURL == nil {
+				continue
+			}
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: anthropicImage(part.ImageURL.URL)})
+		}
+	}
+	return blocks, nil
+}
+
+// anthropicImage converts an OpenAI image_url (data: URL or remote URL).
+func anthropicImage(u string) *anthropicImageSource {
+	if rest, ok := strings.CutPrefix(u, "data:"); ok {
+		meta, data, found := strings.Cut(rest, ",")
+		if found && strings.HasSuffix(meta, ";base64") {
+			return &anthropicImageSource{Type: "base64", MediaType: strings.TrimSuffix(meta, ";base64"), Data: data}
+		}
+	}
+	return &anthropicImageSource{Type: "url", URL: u}
+}
+
+func translateToolChoice(raw json.RawMessage) (*anthropicToolUse, bool) {
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "none":
+			return nil, true
+		case "required":
+			return &anthropicToolUse{Type: "any"}, false
+		default:
+			return &anthropicToolUse{Type: "auto"}, false
+		}
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err == nil && named.Function.Name != "" {
+		return &anthropicToolUse{Type: "tool", Name: named.Function.Name}, false
+	}
+	return nil, false
+}
+
+func (p *anthropicProvider) WriteResponse(w http.ResponseWriter, resp *http.Response, _ *OpenAIRequest) (string, *Usage, error) {
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, anthropicMaxResponseBytes))
+
+	copyResponseHeaders(w, resp.Header, true)
+	if resp.StatusCode/100 != 2 {
+		writeAnthropicError(w, resp.StatusCode, body)
+		return "", nil, readErr
+	}
+
+	var aresp anthropicResponse
+	if err := json.Unmarshal(body, &aresp); err != nil {
+		WriteOpenAIError(w, http.StatusBadGateway, "api_error", "upstream_invalid_response",
+			"invalid response from upstream provider")
+		return "", nil, errors.Join(readErr, err)
+	}
+
+	out := translateAnthropicResponse(&aresp)
+	b, err := json.Marshal(out)
+	if err != nil {
+		return aresp.Model, out.Usage, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	_, werr := w.Write(b)
+	return aresp.Model, out.Usage, errors.Join(readErr, werr)
+}
+
+func (p *anthropicProvider) ExtractUsage(body []byte) (string, *Usage) {
+	var aresp anthropicResponse
+	if err := json.Unmarshal(body, &aresp); err != nil {
+		return "", nil
+	}
+	return aresp.Model, anthropicToOpenAIUsage(aresp.Usage)
+}
+
+func translateAnthropicResponse(aresp *anthropicResponse) *chatCompletion {
+	msg := chatOutMessage{Role: "assistant"}
+	var text strings.Builder
+	hasText := false
+	for _, b := range aresp.Content {
+		switch b.Type {
+		case "text":
+			text.WriteString(b.Text)
+			hasText = true
+		case "tool_use":
+			tc := chatToolCall{ID: b.ID, Type: "function"}
+			tc.Function.Name = b.Name
+			tc.Function.Arguments = string(b.Input)
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		}
+	}
+	if hasText || len(msg.ToolCalls) == 0 {
+		s := text.String()
+		msg.Content = &s
+	}
+
+	return &chatCompletion{
+		ID:      aresp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   aresp.Model,
+		Choices: []chatChoice{{
+			Index:        0,
+			Message:      msg,
+			FinishReason: anthropicFinishReason(aresp.StopReason),
+		}},
+		Usage: anthropicToOpenAIUsage(aresp.Usage),
+	}
+}
+
+func anthropicToOpenAIUsage(u *anthropicUsage) *Usage {
+	if u == nil {
+		return nil
+	}
+	prompt := u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+	out := &Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+	}
+	if u.CacheReadInputTokens > 0 {
+		out.PromptTokensDetails = &PromptTokensDetails{CachedTokens: u.CacheReadInputTokens}
+	}
+	return out
+}
+
+func anthropicFinishReason(stop string) string {
+	switch stop {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// writeAnthropicError re-shapes an Anthropic error body into the OpenAI
+// error envelope, keeping the upstream status (529 overloaded becomes 503).
+func writeAnthropicError(w http.ResponseWriter, status int, body []byte) {
+	var aerr anthropicErrorBody
+	_ = json.Unmarshal(body, &aerr)
+
+	if status == 529 {
+		status = http.StatusServiceUnavailable
+	}
+	errType := FirstNonEmpty(aerr.Error.Type, "api_error")
+	msg := FirstNonEmpty(aerr.Error.Message, strings.TrimSpace(string(body)), http.StatusText(status))
+	WriteOpenAIError(w, status, errType, errType, msg)
+}
+
+type anthropicStreamEvent struct {
+	Type         string            `json:"type"`
+	Message      anthropicResponse `json:"message"`
+	Index        int               `json:"index"`
+	ContentBlock anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicStream converts Messages API stream events into chat chunks.
+type anthropicStream struct {
+	w  io.Writer
+	fl http.Flusher
+
+	id      string
+	model   string
+	created int64
+	usage   anthropicUsage
+	seen    bool
+	stats   *StreamStats
+	// stopped is set by message_stop, failed by an error event.
+	stopped bool
+	failed  bool
+	// completion is the text relayed, for streams cut short.
+	completion strings.Builder
+
+	// toolIndex maps Anthropic content block indexes to OpenAI tool call indexes.
+	toolIndex map[int]int
+}
+
+func (p *anthropicProvider) WriteStream(w http.ResponseWriter, resp *http.Response, oreq *OpenAIRequest, stats *StreamStats) (string, *Usage, error) {
+	if resp.StatusCode/100 != 2 {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		copyResponseHeaders(w, resp.Header, true)
+		writeAnthropicError(w, resp.StatusCode, body)
+		return "", nil, err
+	}
+
+	copyResponseHeaders(w, resp.Header, true)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(resp.StatusCode)
+
+	st := &anthropicStream{w: w, created: time.Now().Unix(), stats: stats, toolIndex: map[int]int{}}
+	if f, ok := w.(http.Flusher); ok {
+		st.fl = f
+	}
+
+	err := st.run(resp.Body)
+	if err == nil && !st.stopped && !st.failed {
+		// the upstream closed the stream before message_stop
+		err = io.ErrUnexpectedEOF
+	}
+	usage := st.openAIUsage()
+	if err != nil || st.failed {
+		usage = st.abortedUsage(oreq, usage)
+	}
+
+	// a failed stream ends with the error, not [DONE], so that clients do
+	// not take it for a complete response
+	if err == nil && !st.failed {
+		if oreq != nil && oreq.IncludesUsage() && usage != nil {
+			err = st.emit(chatChunk{Choices: []chatChunkChoice{}, Usage: usage})
+		}
+		if err == nil {
+			err = st.writeRaw([]byte("data: [DONE]\n\n"))
+		}
+	}
+	stats.finish()
+	return st.model, usage, err
+}
+
+func (st *anthropicStream) openAIUsage() *Usage {
+	if !st.seen {
+		return nil
+	}
+	return anthropicToOpenAIUsage(&st.usage)
+}
+
+// abortedUsage completes the usage of a stream cut short. The output tokens
+// are only reported at the end of a stream, so the text relayed so far is
+// counted instead when that is more.
+func (st *anthropicStream) abortedUsage(oreq *OpenAIRequest, usage *Usage) *Usage {
+	est := estimateChatUsage(FirstNonEmpty(st.model, requestModel(oreq)), oreq, st.completion.String())
+	if usage == nil {
+		return est
+	}
+	if est.CompletionTokens > usage.CompletionTokens {
+		usage.CompletionTokens = est.CompletionTokens
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		usage.Estimated = true
+	}
+	return usage
+}
+
+func (st *anthropicStream) run(upstream io.Reader) error {
+	r := newSSEReader(upstream)
+	for {
+		sev, err := r.next()
+
+		if sev.hasData {
+			var ev anthropicStreamEvent
+			if jsonErr := json.Unmarshal(sev.data, &ev); jsonErr == nil {
+				done, herr := st.handle(&ev)
+				if herr != nil || done {
+					return herr
+				}
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (st *anthropicStream) handle(ev *anthropicStreamEvent) (bool, error) {
+	switch ev.Type {
+	case "message_start":
+		st.id = ev.Message.ID
+		st.model = ev.Message.Model
+		if u := ev.Message.Usage; u != nil {
+			st.usage = *u
+			st.seen = true
+		}
+		return false, st.emit(chatChunk{Choices: []chatChunkChoice{{Delta: chatDelta{Role: "assistant", Content: ptr("")}}}})
+
+	case "content_block_start":
+		if ev.ContentBlock.Type != "tool_use" {
+			return false, nil
+		}
+		idx := len(st.toolIndex)
+		st.toolIndex[ev.Index] = idx
+		tc := chatToolCallDelta{Index: idx, ID: ev.ContentBlock.ID, Type: "function"}
+		tc.Function.Name = ev.ContentBlock.Name
+		return false, st.emit(chatChunk{Choices: []chatChunkChoice{{Delta: chatDelta{ToolCalls: []chatToolCallDelta{tc}}}}})
+
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			return false, st.emit(chatChunk{Choices: []chatChunkChoice{{Delta: chatDelta{Content: ptr(ev.Delta.Text)}}}})
+		case "input_json_delta":
+			tc := chatToolCallDelta{Index: st.toolIndex[ev.Index]}
+			tc.Function.Arguments = ev.Delta.PartialJSON
+			return false, st.emit(chatChunk{Choices: []chatChunkChoice{{Delta: chatDelta{ToolCalls: []chatToolCallDelta{tc}}}}})
+		}
+		return false, nil
+
+	case "message_delta":
+		if u := ev.Usage; u != nil {
+			st.usage.OutputTokens = u.OutputTokens
+			if u.InputTokens > 0 {
+				st.usage.InputTokens = u.InputTokens
+			}
+			st.seen = true
+		}
+		if ev.Delta.StopReason == "" {
+			return false, nil
+		}
+		reason := anthropicFinishReason(ev.Delta.StopReason)
+		return false, st.emit(chatChunk{Choices: []chatChunkChoice{{Delta: chatDelta{}, FinishReason: &reason}}})
+
+	case "message_stop":
+		st.stopped = true
+		return true, nil
+
+	case "error":
+		st.failed = true
+		st.stats.upstreamError(classifyStreamError(ev.Error.Type))
+		b, _ := json.Marshal(openAIErrorEnvelope{Error: OpenAIError{
+			Message: ev.Error.Message,
+			Type:    FirstNonEmpty(ev.Error.Type, "api_error"),
+			Code:    FirstNonEmpty(ev.Error.Type, "api_error"),
+		}})
+		return true, st.writeRaw(append(append([]byte("data: "), b...), '\n', '\n'))
+	}
+	return false, nil
+}
+
+func (st *anthropicStream) emit(ch chatChunk) error {
+	ch.ID = st.id
+	ch.Object = "chat.completion.chunk"
+	ch.Created = st.created
+	ch.Model = st.model
+	b, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	if hasOutput(ch.Choices) {
+		st.stats.contentChunk()
+		appendDeltaText(&st.completion, ch.Choices)
+	}
+	return st.writeRaw(append(append([]byte("data: "), b...), '\n', '\n'))
+}
+
+func (st *anthropicStream) writeRaw(b []byte) error {
+	if _, err := st.w.Write(b); err != nil {
+		return err
+	}
+	if st.fl != nil {
+		st.fl.Flush()
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
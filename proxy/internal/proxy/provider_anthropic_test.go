@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateChatToAnthropic(t *testing.T) {
+	body := `{
+  "model": "claude-3-5-sonnet-latest",
+  "max_tokens": 256,
+  "temperature": 1.5,
+  "stop": "END",
+  "messages": [
+    {"role": "system", "content": "be brief"},
+    {"role": "user", "content": [
+      {"type": "text", "text": "what is this?"},
+      {"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}
+    ]},
+    {"role": "assistant", "content": null, "tool_calls": [
+      {"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"x\"}"}}
+    ]},
+    {"role": "tool", "tool_call_id": "call_1", "content": "42"},
+    {"role": "user", "content": "thanks"}
+  ],
+  "tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+  "tool_choice": "required"
+}`
+	var creq chatRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &creq))
+
+	areq, err := translateChatToAnthropic(&creq)
+	require.NoError(t, err)
+	require.Equal(t, "be brief", areq.System)
+	require.Equal(t, 256, areq.MaxTokens)
+	require.Equal(t, 1.0, *areq.Temperature)
+	require.Equal(t, []string{"END"}, areq.StopSequences)
+	require.Equal(t, "any", areq.ToolChoice.Type)
+	require.Len(t, areq.Tools, 1)
+
+	// tool result and the following user text merge into one user turn
+	require.Len(t, areq.Messages, 3)
+	require.Equal(t, "user", areq.Messages[0].Role)
+	require.Equal(t, "image", areq.Messages[0].Content[1].Type)
+	require.Equal(t, "image/png", areq.Messages[0].Content[1].Source.MediaType)
+	require.Equal(t, "tool_use", areq.Messages[1].Content[0].Type)
+	require.JSONEq(t, `{"q":"x"}`, string(areq.Messages[1].Content[0].Input))
+	require.Equal(t, "tool_result", areq.Messages[2].Content[0].Type)
+	require.Equal(t, "42", areq.Messages[2].Content[0].Content)
+	require.Equal(t, "thanks", areq.Messages[2].Content[1].Text)
+}
+
+func TestTranslateAnthropicResponse(t *testing.T) {
+	aresp := anthropicResponse{
+		ID:         "msg_1",
+		Model:      "claude-3-5-sonnet-20241022",
+		StopReason: "max_tokens",
+		Content:    []anthropicBlock{{Type: "text", Text: "hel"}, {Type: "text", Text: "lo"}},
+		Usage:      &anthropicUsage{InputTokens: 10, OutputTokens: 5, CacheReadInputTokens: 2},
+	}
+	out := translateAnthropicResponse(&aresp)
+	require.Equal(t, "chat.completion", out.Object)
+	require.Equal(t, "hello", *out.Choices[0].Message.Content)
+	require.Equal(t, "length", out.Choices[0].FinishReason)
+	require.Equal(t, &Usage{
+		PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17,
+		PromptTokensDetails: &PromptTokensDetails{CachedTokens: 2},
+	}, out.Usage)
+}
+
+const anthropicStreamBody = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-5-haiku-20241022","usage":{"input_tokens":9,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" there"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":4}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func anthropicUpstream(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/messages", r.URL.Path)
+		require.Equal(t, "sk-ant", r.Header.Get("x-api-key"))
+		require.Equal(t, anthropicVersion, r.Header.Get("anthropic-version"))
+
+		var areq anthropicRequest
+		b, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(b, &areq))
+
+		if strings.Contains(areq.Model, "bad") {
+			w.WriteHeader(529)
+			_, _ = w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+			return
+		}
+		if areq.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte(anthropicStreamBody))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-20241022",` +
+			`"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":9,"output_tokens":4}}`))
+	}
+}
+
+func TestChatCompletions_AnthropicUpstream(t *testing.T) {
+	env := newTestEnv(t, anthropicUpstream(t), func(cfg *Config) {
+		cfg.AnthropicBaseURL = cfg.UpstreamBaseURL
+		cfg.AnthropicAPIKey = "sk-ant"
+		cfg.AnthropicModelPrefixes = []string{"claude-"}
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"claude-3-5-haiku-latest","messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var out chatCompletion
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+	require.Equal(t, "Hi", *out.Choices[0].Message.Content)
+	ev := env.nextEvent(t)
+	require.Equal(t, ProviderAnthropic, ev.Provider)
+	require.Equal(t, "claude-3-5-haiku-20241022", ev.Model)
+	require.Equal(t, 13, ev.TotalTokens)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy",
+		`{"model":"claude-3-5-haiku-latest","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	require.Contains(t, body, `"object":"chat.completion.chunk"`)
+	require.Contains(t, body, `"content":" there"`)
+	require.Contains(t, body, `"finish_reason":"stop"`)
+	require.Contains(t, body, `"usage":{"prompt_tokens":9,"completion_tokens":4,"total_tokens":13}`)
+	require.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+	ev = env.nextEvent(t)
+	require.Equal(t, 4, ev.CompletionTokens)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"claude-bad","messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "overloaded_error", decodeOpenAIError(t, rec).Type)
+	env.nextEvent(t)
+
+	// other models keep going to the default OpenAI upstream
+	targets, ok := env.srv.router.Resolve("gpt-4o")
+	require.True(t, ok)
+	require.Equal(t, ProviderOpenAI, targets[0].Upstream.Provider.Name())
+}
+
+func TestChatCompletions_AnthropicStreamAborted(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-3-5-haiku-20241022\",\"usage\":{\"input_tokens\":9,\"output_tokens\":1}}}\n\n" +
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"tiktoken is great!\"}}\n\n"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}, func(cfg *Config) {
+		cfg.AnthropicBaseURL = cfg.UpstreamBaseURL
+		cfg.AnthropicAPIKey = "sk-ant"
+		cfg.AnthropicModelPrefixes = []string{"claude-"}
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"claude-3-5-haiku-latest","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), "[DONE]")
+
+	ev := env.nextEvent(t)
+	require.Equal(t, AbortedByUpstream, ev.AbortedBy)
+	// the prompt as reported, the output counted from the relayed text
+	require.Equal(t, 9, ev.PromptTokens)
+	require.Equal(t, 6, ev.CompletionTokens)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+}
+
+func TestChatCompletions_AnthropicInStreamError(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("event: message_start\r\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-3-5-haiku-20241022\",\"usage\":{\"input_tokens\":9,\"output_tokens\":1}}}\r\n\r\n" +
+			"event: content_block_delta\r\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"tiktoken is great!\"}}\r\n\r\n" +
+			"event: error\r\ndata: {\"type\":\"error\",\r\ndata: \"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\r\n\r\n"))
+	}, func(cfg *Config) {
+		cfg.AnthropicBaseURL = cfg.UpstreamBaseURL
+		cfg.AnthropicAPIKey = "sk-ant"
+		cfg.AnthropicModelPrefixes = []string{"claude-"}
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"claude-3-5-haiku-latest","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"code":"overloaded_error"`)
+	require.NotContains(t, rec.Body.String(), "[DONE]")
+
+	ev := env.nextEvent(t)
+	require.Equal(t, ErrorClassUpstream5xx, ev.ErrorClass)
+	require.Equal(t, 9, ev.PromptTokens)
+	require.Equal(t, 6, ev.CompletionTokens)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+}
+
+func TestChatCompletions_AnthropicStreamEndsBeforeMessageStop(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-3-5-haiku-20241022\",\"usage\":{\"input_tokens\":9,\"output_tokens\":1}}}\n\n" +
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"tiktoken is great!\"}}\n\n"))
+	}, func(cfg *Config) {
+		cfg.AnthropicBaseURL = cfg.UpstreamBaseURL
+		cfg.AnthropicAPIKey = "sk-ant"
+		cfg.AnthropicModelPrefixes = []string{"claude-"}
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"claude-3-5-haiku-latest","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), "[DONE]")
+
+	ev := env.nextEvent(t)
+	require.True(t, ev.Aborted)
+	require.Equal(t, AbortedByUpstream, ev.AbortedBy)
+	require.Equal(t, 6, ev.CompletionTokens)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+}
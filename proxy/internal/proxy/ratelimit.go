@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limit is a requests/minute and tokens/minute budget. Zero disables the
+// corresponding bucket.
+type Limit struct {
+	RequestsPerMinute int `yaml:"requests_per_minute" json:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute" json:"tokens_per_minute"`
+}
+
+// RateLimitConfig holds limits per gateway key ID, tenant and requested
+// model. The "*" entry of each map applies to every name not listed; each
+// key, tenant or model still gets its own buckets.
+type RateLimitConfig struct {
+	Keys    map[string]Limit `yaml:"keys" json:"keys"`
+	Tenants map[string]Limit `yaml:"tenants" json:"tenants"`
+	Models  map[string]Limit `yaml:"models" json:"models"`
+}
+
+func ParseRateLimitConfig(b []byte) (*RateLimitConfig, error) {
+	var c RateLimitConfig
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parse rate limit file: %w", err)
+	}
+	for scope, m := range map[string]map[string]Limit{"keys": c.Keys, "tenants": c.Tenants, "models": c.Models} {
+		for name, l := range m {
+			if l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 {
+				return nil, fmt.Errorf("%s.%s: limits must not be negative", scope, name)
+			}
+		}
+	}
+	return &c, nil
+}
+
+func lookupLimit(m map[string]Limit, name string) (Limit, bool) {
+	if l, ok := m[name]; ok {
+		return l, true
+	}
+	l, ok := m["*"]
+	return l, ok
+}
+
+// tokenBucket refills continuously at capacity per minute. The balance may
+// go negative when actual usage exceeds the up-front estimate; the debt is
+// paid back by refill before new requests are admitted.
+type tokenBucket struct {
+	capacity float64
+	balance  float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(perMinute), balance: float64(perMinute), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if dt := now.Sub(b.last); dt > 0 {
+		b.balance = math.Min(b.capacity, b.balance+dt.Minutes()*b.capacity)
+		b.last = now
+	}
+}
+
+// need returns the amount that must be available to admit cost: requests
+// larger than the whole bucket are admitted once the bucket is full.
+func (b *tokenBucket) need(cost float64) float64 {
+	return math.Min(cost, b.capacity)
+}
+
+// wait returns how long until cost can be admitted.
+func (b *tokenBucket) wait(cost float64) time.Duration {
+	missing := b.need(cost) - b.balance
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.capacity * float64(time.Minute))
+}
+
+// resetIn returns how long until the bucket is full again.
+func (b *tokenBucket) resetIn() time.Duration {
+	return time.Duration(math.Max(0, b.capacity-b.balance) / b.capacity * float64(time.Minute))
+}
+
+type limitBuckets struct {
+	id       string
+	limit    Limit
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// full reports whether both buckets are full; such buckets are the same as
+// new ones and can be dropped.
+func (lb *limitBuckets) full() bool {
+	return (lb.requests == nil || lb.requests.balance >= lb.requests.capacity) &&
+		(lb.tokens == nil || lb.tokens.balance >= lb.tokens.capacity)
+}
+
+// bucketSweepInterval is how often Admit drops full buckets, so that "*"
+// limits do not keep a bucket for every name a client ever sent.
+const bucketSweepInterval = time.Minute
+
+// RateLimiter enforces per key, per tenant and per model token buckets.
+type RateLimiter struct {
+	mu        sync.Mutex
+	cfg       *RateLimitConfig
+	buckets   map[string]*limitBuckets
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(cfg *RateLimitConfig) *RateLimiter {
+	return &RateLimiter{cfg: cfg, buckets: map[string]*limitBuckets{}, now: time.Now}
+}
+
+// Update swaps the limits. Existing buckets keep their balance, capped to
+// the new capacity, so a reload neither resets nor refills budgets.
+func (rl *RateLimiter) Update(cfg *RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+}
+
+// RateLimitRejection describes the bucket that rejected a request.
+type RateLimitRejection struct {
+	Scope      string // "key", "tenant" or "model"
+	Name       string
+	Kind       string // "requests" or "tokens"
+	RetryAfter time.Duration
+
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+}
+
+// Admission is a granted request. Reconcile must be called once the real
+// token usage is known.
+type Admission struct {
+	rl        *RateLimiter
+	buckets   []*limitBuckets
+	estimated int
+	once      sync.Once
+}
+
+type limitScope struct {
+	scope, name string
+	limits      map[string]Limit
+}
+
+// Admit charges one request and estTokens against every applicable bucket,
+// or charges nothing and returns the first rejection.
+func (rl *RateLimiter) Admit(keyID, tenant, model string, estTokens int) (*Admission, *RateLimitRejection) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.lastSweep) >= bucketSweepInterval {
+		rl.sweep(now)
+	}
+	scopes := []limitScope{
+		{"key", keyID, rl.cfg.Keys},
+		{"tenant", tenant, rl.cfg.Tenants},
+		{"model", model, rl.cfg.Models},
+	}
+
+	var active []*limitBuckets
+	var reject *RateLimitRejection
+	for _, sc := range scopes {
+		l, ok := lookupLimit(sc.limits, sc.name)
+		if !ok || (l.RequestsPerMinute == 0 && l.TokensPerMinute == 0) {
+			continue
+		}
+		lb := rl.bucketsFor(sc.scope+":"+sc.name, l, now)
+		active = append(active, lb)
+
+		var wait time.Duration
+		kind := ""
+		if lb.requests != nil {
+			if w := lb.requests.wait(1); w > 0 {
+				wait, kind = w, "requests"
+			}
+		}
+		if lb.tokens != nil {
+			if w := lb.tokens.wait(float64(estTokens)); w > wait {
+				wait, kind = w, "tokens"
+			}
+		}
+		if wait > 0 && (reject == nil || wait > reject.RetryAfter) {
+			reject = lb.rejection(sc.scope, sc.name, kind, wait)
+		}
+	}
+	if reject != nil {
+		return nil, reject
+	}
+
+	for _, lb := range active {
+		if lb.requests != nil {
+			lb.requests.balance--
+		}
+		if lb.tokens != nil {
+			lb.tokens.balance -= float64(estTokens)
+		}
+	}
+	return &Admission{rl: rl, buckets: active, estimated: estTokens}, nil
+}
+
+func (rl *RateLimiter) bucketsFor(id string, l Limit, now time.Time) *limitBuckets {
+	lb, ok := rl.buckets[id]
+	if !ok {
+		lb = &limitBuckets{id: id}
+		rl.buckets[id] = lb
+	}
+	if !ok || lb.limit != l {
+		lb.requests = resizeBucket(lb.requests, l.RequestsPerMinute, now)
+		lb.tokens = resizeBucket(lb.tokens, l.TokensPerMinute, now)
+		lb.limit = l
+	}
+	if lb.requests != nil {
+		lb.requests.refill(now)
+	}
+	if lb.tokens != nil {
+		lb.tokens.refill(now)
+	}
+	return lb
+}
+
+// sweep drops the buckets that refilled completely.
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+	for id, lb := range rl.buckets {
+		if lb.requests != nil {
+			lb.requests.refill(now)
+		}
+		if lb.tokens != nil {
+			lb.tokens.refill(now)
+		}
+		if lb.full() {
+			delete(rl.buckets, id)
+		}
+	}
+}
+
+func resizeBucket(b *tokenBucket, perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	if b == nil {
+		return newTokenBucket(perMinute, now)
+	}
+	b.refill(now)
+	b.capacity = float64(perMinute)
+	b.balance = math.Min(b.balance, b.capacity)
+	return b
+}
+
+func (lb *limitBuckets) rejection(scope, name, kind string, wait time.Duration) *RateLimitRejection {
+	r := &RateLimitRejection{Scope: scope, Name: name, Kind: kind, RetryAfter: wait}
+	if b := lb.requests; b != nil {
+		r.LimitRequests = lb.limit.RequestsPerMinute
+		r.RemainingRequests = int(math.Max(0, b.balance))
+		r.ResetRequests = b.resetIn()
+	}
+	if b := lb.tokens; b != nil {
+		r.LimitTokens = lb.limit.TokensPerMinute
+		r.RemainingTokens = int(math.Max(0, b.balance))
+		r.ResetTokens = b.resetIn()
+	}
+	return r
+}
+
+// Reconcile replaces the up-front estimate with the actual token count.
+// It is safe to call more than once; only the first call has an effect.
+func (a *Admission) Reconcile(actualTokens int) {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() {
+		delta := float64(actualTokens - a.estimated)
+		if delta == 0 {
+			return
+		}
+		a.rl.mu.Lock()
+		defer a.rl.mu.Unlock()
+		for _, lb := range a.buckets {
+			// a bucket swept while the request ran is put back, or the
+			// debt is charged to the one that replaced it
+			if cur, ok := a.rl.buckets[lb.id]; ok {
+				lb = cur
+			} else {
+				a.rl.buckets[lb.id] = lb
+			}
+			if lb.tokens != nil {
+				lb.tokens.balance = math.Min(lb.tokens.capacity, lb.tokens.balance-delta)
+			}
+		}
+	})
+}
+
+// WriteRateLimitError writes an OpenAI-compatible 429 with Retry-After and
+// x-ratelimit-* headers describing the bucket that rejected the request.
+func WriteRateLimitError(w http.ResponseWriter, rej *RateLimitRejection) {
+	h := w.Header()
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(rej.RetryAfter.Seconds()))))
+	h.Set("retry-after-ms", strconv.FormatInt(rej.RetryAfter.Milliseconds(), 10))
+	if rej.LimitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(rej.LimitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(rej.RemainingRequests))
+		h.Set("x-ratelimit-reset-requests", formatReset(rej.ResetRequests))
+	}
+	if rej.LimitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(rej.LimitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(rej.RemainingTokens))
+		h.Set("x-ratelimit-reset-tokens", formatReset(rej.ResetTokens))
+	}
+
+	msg := fmt.Sprintf("Rate limit reached for %s per minute on %s '%s'. Please try again in %s.",
+		rej.Kind, rej.Scope, rej.Name, formatReset(rej.RetryAfter))
+	WriteOpenAIError(w, http.StatusTooManyRequests, rej.Kind, "rate_limit_exceeded", msg)
+}
+
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// estimatePromptTokens is a cheap up-front estimate (about 4 bytes per
+// token) used to charge token buckets before the real usage is known.
+func estimatePromptTokens(body []byte) int {
+	return len(body)/4 + 1
+}
+
+// watchRateLimits polls the rate limit file and applies changes without a
+// restart until the server shuts down. Invalid files are logged and the
+// previous limits stay active.
+func (s *Server) watchRateLimits(filename string, every time.Duration) {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(filename); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			log.Printf("ratelimit: stat %s: %v", filename, err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			log.Printf("ratelimit: reload %s: %v", filename, err)
+			continue
+		}
+		cfg, err := ParseRateLimitConfig(b)
+		if err != nil {
+			log.Printf("ratelimit: reload %s: %v (keeping previous limits)", filename, err)
+			continue
+		}
+		s.limiter.Update(cfg)
+		log.Printf("ratelimit: reloaded limits from %s", filename)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestLimiter(t *testing.T, content string) (*RateLimiter, *fakeClock) {
+	t.Helper()
+	cfg, err := ParseRateLimitConfig([]byte(content))
+	require.NoError(t, err)
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rl := NewRateLimiter(cfg)
+	rl.now = clock.now
+	return rl, clock
+}
+
+func TestRateLimiter_Requests(t *testing.T) {
+	rl, clock := newTestLimiter(t, `
+keys:
+  "*": {requests_per_minute: 2}
+`)
+	_, rej := rl.Admit("k1", "t", "m", 10)
+	require.Nil(t, rej)
+	_, rej = rl.Admit("k1", "t", "m", 10)
+	require.Nil(t, rej)
+	_, rej = rl.Admit("k1", "t", "m", 10)
+	require.NotNil(t, rej)
+	require.Equal(t, "key", rej.Scope)
+	require.Equal(t, "requests", rej.Kind)
+	require.Equal(t, 30*time.Second, rej.RetryAfter)
+
+	// other keys have their own bucket
+	_, rej = rl.Admit("k2", "t", "m", 10)
+	require.Nil(t, rej)
+
+	clock.t = clock.t.Add(30 * time.Second)
+	_, rej = rl.Admit("k1", "t", "m", 10)
+	require.Nil(t, rej)
+}
+
+func TestRateLimiter_TokensReconcile(t *testing.T) {
+	rl, clock := newTestLimiter(t, `
+tenants:
+  team-a: {tokens_per_minute: 1000}
+`)
+	adm, rej := rl.Admit("k", "team-a", "m", 100)
+	require.Nil(t, rej)
+	// the response used far more than estimated: the bucket goes into debt
+	adm.Reconcile(1500)
+	adm.Reconcile(0) // no-op
+
+	_, rej = rl.Admit("k", "team-a", "m", 100)
+	require.NotNil(t, rej)
+	require.Equal(t, "tokens", rej.Kind)
+	require.Equal(t, "team-a", rej.Name)
+	require.Equal(t, 1000, rej.LimitTokens)
+	require.Equal(t, 0, rej.RemainingTokens)
+
+	// -500 + 1000 * 36s/60s = 100
+	clock.t = clock.t.Add(36 * time.Second)
+	_, rej = rl.Admit("k", "team-a", "m", 100)
+	require.Nil(t, rej)
+
+	// unlimited tenants are not tracked
+	_, rej = rl.Admit("k", "team-b", "m", 1e6)
+	require.Nil(t, rej)
+}
+
+func TestRateLimiter_RejectionChargesNothing(t *testing.T) {
+	rl, _ := newTestLimiter(t, `
+keys:
+  k: {requests_per_minute: 10}
+models:
+  gpt-4o: {requests_per_minute: 1}
+`)
+	_, rej := rl.Admit("k", "t", "gpt-4o", 1)
+	require.Nil(t, rej)
+	for i := 0; i < 5; i++ {
+		_, rej = rl.Admit("k", "t", "gpt-4o", 1)
+		require.NotNil(t, rej)
+		require.Equal(t, "model", rej.Scope)
+	}
+	// the key bucket was only charged once
+	for i := 0; i < 9; i++ {
+		_, rej = rl.Admit("k", "t", "gpt-4o-mini", 1)
+		require.Nil(t, rej)
+	}
+}
+
+func TestRateLimiter_UpdateKeepsBalance(t *testing.T) {
+	rl, _ := newTestLimiter(t, `keys: {"*": {requests_per_minute: 5}}`)
+	for i := 0; i < 5; i++ {
+		_, rej := rl.Admit("k", "t", "m", 1)
+		require.Nil(t, rej)
+	}
+	cfg, err := ParseRateLimitConfig([]byte(`keys: {"*": {requests_per_minute: 100}}`))
+	require.NoError(t, err)
+	rl.Update(cfg)
+
+	_, rej := rl.Admit("k", "t", "m", 1)
+	require.NotNil(t, rej)
+	require.Equal(t, 100, rej.LimitRequests)
+}
+
+func TestRateLimiter_SweepsFullBuckets(t *testing.T) {
+	rl, clock := newTestLimiter(t, `
+models:
+  "*": {requests_per_minute: 60, tokens_per_minute: 1000}
+`)
+	for _, model := range []string{"a", "b", "c"} {
+		_, rej := rl.Admit("k", "t", model, 10)
+		require.Nil(t, rej)
+	}
+	indebted, rej := rl.Admit("k", "t", "d", 10)
+	require.Nil(t, rej)
+	indebted.Reconcile(3000)
+	require.Len(t, rl.buckets, 4)
+
+	// one minute refills the buckets of a, b and c; d is still in debt
+	clock.t = clock.t.Add(bucketSweepInterval)
+	adm, rej := rl.Admit("k", "t", "e", 10)
+	require.Nil(t, rej)
+	require.Len(t, rl.buckets, 2)
+	require.Contains(t, rl.buckets, "model:d")
+
+	// a request admitted before its bucket was swept still settles its debt
+	clock.t = clock.t.Add(3 * bucketSweepInterval)
+	_, rej = rl.Admit("k", "t", "x", 10)
+	require.Nil(t, rej)
+	require.NotContains(t, rl.buckets, "model:e")
+	adm.Reconcile(2000)
+	_, rej = rl.Admit("k", "t", "e", 10)
+	require.NotNil(t, rej)
+	require.Equal(t, "tokens", rej.Kind)
+}
+
+func TestWriteRateLimitError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteRateLimitError(rec, &RateLimitRejection{
+		Scope: "key", Name: "k", Kind: "tokens", RetryAfter: 1500 * time.Millisecond,
+		LimitTokens: 1000, RemainingTokens: 3, ResetTokens: 30 * time.Second,
+	})
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+	require.Equal(t, "1000", rec.Header().Get("x-ratelimit-limit-tokens"))
+	require.Equal(t, "3", rec.Header().Get("x-ratelimit-remaining-tokens"))
+	require.Equal(t, "30s", rec.Header().Get("x-ratelimit-reset-tokens"))
+	require.Empty(t, rec.Header().Get("x-ratelimit-limit-requests"))
+	e := decodeOpenAIError(t, rec)
+	require.Equal(t, "rate_limit_exceeded", e.Code)
+	require.Equal(t, "tokens", e.Type)
+}
+
+func TestChatCompletions_RateLimited(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		p := t.TempDir() + "/limits.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`tenants: {demo: {requests_per_minute: 1}}`), 0o600))
+		cfg.RateLimitsFile = p
+	})
+	hdr := map[string]string{"X-LLM-Tenant": "demo"}
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, hdr)
+	require.Equal(t, http.StatusOK, rec.Code)
+	env.nextEvent(t)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, hdr)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+	require.Equal(t, "1", rec.Header().Get("x-ratelimit-limit-requests"))
+	ev := env.nextEvent(t)
+	require.Equal(t, ErrorClassRateLimit, ev.ErrorClass)
+	require.Equal(t, "demo", ev.Tenant)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
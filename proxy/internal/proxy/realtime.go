@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RealtimeProvider is implemented by providers that serve the Realtime API
+// over WebSocket.
+type RealtimeProvider interface {
+	// RealtimeDial returns the upstream WebSocket URL and handshake headers.
+	RealtimeDial(up *Upstream, query url.Values, in http.Header) (string, http.Header)
+}
+
+// realtimeKeyProtocol prefixes the gateway key in Sec-WebSocket-Protocol
+// for browser clients, which cannot set an Authorization header.
+const realtimeKeyProtocol = "openai-insecure-api-key."
+
+var realtimeUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"realtime"},
+	// handleRealtime checks the origin of browser clients, the only ones
+	// that send the gateway key without an Authorization header
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handleRealtime proxies a Realtime API WebSocket session. The upstream
+// connection is opened before the client's is upgraded so that upstream
+// rejections reach the client as plain HTTP errors. Usage from response.done
+// events is metered every RealtimeMeteringInterval and when the session ends.
+func (s *Server) handleRealtime(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		WriteOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request",
+			"/v1/realtime requires a WebSocket upgrade")
+		return
+	}
+
+	g := s.beginRequest(w, r, "/v1/realtime")
+	defer s.finishRequest(g)
+	offered := websocket.Subprotocols(r)
+	if r.Header.Get("Authorization") == "" {
+		for _, p := range offered {
+			token, ok := strings.CutPrefix(p, realtimeKeyProtocol)
+			if !ok {
+				continue
+			}
+			if !s.realtimeOriginAllowed(r.Header.Get("Origin")) {
+				WriteOpenAIError(g.w, http.StatusForbidden, "invalid_request_error", "origin_not_allowed",
+					"origin '"+r.Header.Get("Origin")+"' may not open Realtime sessions")
+				return
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if !s.authenticateRequest(g, r) {
+		return
+	}
+
+	model := r.URL.Query().Get("model")
+	targets, ok := s.routeRequest(g, model)
+	if !ok {
+		return
+	}
+	if _, ok := targets[0].Upstream.Provider.(RealtimeProvider); !ok {
+		WriteOpenAIError(g.w, http.StatusBadRequest, "invalid_request_error", "invalid_request",
+			"upstream "+targets[0].Upstream.Name+" does not support the Realtime API")
+		return
+	}
+	// usage is only known as the session goes on; admitting one token
+	// refuses sessions while a token bucket is drained or in debt
+	adm, ok := s.admitRequest(g, 1)
+	if !ok {
+		return
+	}
+
+	var protocols []string
+	for _, p := range offered {
+		if !strings.HasPrefix(p, realtimeKeyProtocol) {
+			protocols = append(protocols, p)
+		}
+	}
+	upConn, resp, res, err := s.dialRealtime(r, targets, protocols)
+	target := res.target
+	up := target.Upstream
+	g.rm.upstream = up.Name
+	if err != nil {
+		adm.Reconcile(0)
+		if resp != nil {
+			s.relayRealtimeRejection(g, resp, res)
+			return
+		}
+		s.failUpstream(g, r, res, err)
+		return
+	}
+	defer upConn.Close()
+
+	// the upgrade response is written on the hijacked connection
+	clientConn, err := realtimeUpgrader.Upgrade(g.w, r, http.Header{"X-LLM-Request-ID": {g.id}})
+	if err != nil {
+		adm.Reconcile(0)
+		return
+	}
+	defer clientConn.Close()
+
+	sess := &realtimeSession{model: target.Model, unparsed: s.metrics.realtimeUnparsed}
+	upstreamErr, clientErr := s.pumpRealtime(g, sess, clientConn, upConn, up)
+
+	total := sess.total()
+	g.rm.usage = total
+	reconcileUsage(adm, http.StatusOK, total)
+
+	ev := s.realtimeEvent(g, sess, up)
+	ev.Final = true
+	ev.Attempts = attemptsForEvent(res.attempts)
+	if upstreamErr != nil && !isNormalClose(upstreamErr) && clientErr == nil {
+		ev.ErrorClass = ErrorClassUpstreamError
+		log.Printf("realtime: upstream connection failed request_id=%s upstream=%s err=%v", g.id, up.Name, upstreamErr)
+	}
+	s.meter(g, ev)
+}
+
+// realtimeOriginAllowed reports whether a browser page on origin may open
+// sessions with the gateway key in Sec-WebSocket-Protocol.
+func (s *Server) realtimeOriginAllowed(origin string) bool {
+	return origin != "" && slices.ContainsFunc(s.cfg.RealtimeAllowedOrigins, func(o string) bool {
+		return strings.EqualFold(o, origin)
+	})
+}
+
+// dialRealtime connects to the first target that accepts the session. Like
+// sendWithFailover it moves on to the next target after a network error or
+// a retryable handshake status; targets without Realtime support are
+// skipped. Without a connection, resp is the last handshake rejection if
+// there was one, and err is set.
+func (s *Server) dialRealtime(r *http.Request, targets []RouteTarget, protocols []string) (*websocket.Conn, *http.Response, upstreamResult, error) {
+	var (
+		res     upstreamResult
+		resp    *http.Response
+		lastErr error
+	)
+	for _, target := range targets {
+		up := target.Upstream
+		rp, ok := up.Provider.(RealtimeProvider)
+		if !ok {
+			continue
+		}
+		if resp != nil {
+			discardResponse(resp)
+			resp = nil
+		}
+		res.target = target
+
+		query := r.URL.Query()
+		query.Set("model", target.Model)
+		wsURL, hdr := rp.RealtimeDial(up, query, r.Header)
+		dialer := websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: s.cfg.HTTPClientTimeout,
+			Subprotocols:     protocols,
+		}
+
+		started := time.Now()
+		conn, hresp, err := dialer.DialContext(r.Context(), wsURL, hdr)
+		attempt := UpstreamAttempt{Upstream: up.Name, LatencyMs: time.Since(started).Milliseconds()}
+		if err == nil {
+			attempt.StatusCode = http.StatusSwitchingProtocols
+			res.attempts = append(res.attempts, attempt)
+			return conn, nil, res, nil
+		}
+		lastErr = err
+		if hresp != nil {
+			attempt.StatusCode = hresp.StatusCode
+			resp = hresp
+		} else {
+			attempt.Error = err.Error()
+		}
+		res.attempts = append(res.attempts, attempt)
+		if r.Context().Err() != nil || (resp != nil && !up.Retry.retryableStatus(resp.StatusCode)) {
+			break
+		}
+	}
+	return nil, resp, res, lastErr
+}
+
+// pumpRealtime relays messages both ways until either side closes and
+// meters usage periodically. It returns the error that ended each reader;
+// the one that did not end the session is nil.
+func (s *Server) pumpRealtime(g *gatewayRequest, sess *realtimeSession, clientConn, upConn *websocket.Conn, up *Upstream) (upstreamErr, clientErr error) {
+	fromUpstream := make(chan error, 1)
+	fromClient := make(chan error, 1)
+	go func() { fromUpstream <- relayWebSocket(clientConn, upConn, sess.observe) }()
+	go func() { fromClient <- relayWebSocket(upConn, clientConn, nil) }()
+
+	var tick <-chan time.Time
+	if s.cfg.RealtimeMeteringInterval > 0 {
+		t := time.NewTicker(s.cfg.RealtimeMeteringInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-tick:
+			if ev := s.realtimeEvent(g, sess, up); ev.ResponseCount > 0 {
+				s.meter(g, ev)
+			}
+		case upstreamErr = <-fromUpstream:
+			// unblock the other reader
+			_ = upConn.Close()
+			_ = clientConn.Close()
+			<-fromClient
+			return upstreamErr, nil
+		case clientErr = <-fromClient:
+			_ = upConn.Close()
+			_ = clientConn.Close()
+			<-fromUpstream
+			return nil, clientErr
+		case <-s.closing:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			deadline := time.Now().Add(time.Second)
+			_ = clientConn.WriteControl(websocket.CloseMessage, msg, deadline)
+			_ = upConn.WriteControl(websocket.CloseMessage, msg, deadline)
+			_ = upConn.Close()
+			_ = clientConn.Close()
+			<-fromUpstream
+			<-fromClient
+			return nil, nil
+		}
+	}
+}
+
+// relayWebSocket copies messages from src to dst until src fails or closes;
+// a close frame is passed on to dst. observe sees every text message.
+func relayWebSocket(dst, src *websocket.Conn, observe func([]byte)) error {
+	for {
+		mt, msg, err := src.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, ""
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseNoStatusReceived {
+				code, text = ce.Code, ce.Text
+			}
+			_ = dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			return err
+		}
+		if observe != nil && mt == websocket.TextMessage {
+			observe(msg)
+		}
+		if err := dst.WriteMessage(mt, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func isNormalClose(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) || errors.Is(err, io.EOF)
+}
+
+// relayRealtimeRejection passes an upstream handshake rejection to the
+// client and meters it.
+func (s *Server) relayRealtimeRejection(g *gatewayRequest, resp *http.Response, res upstreamResult) {
+	defer resp.Body.Close()
+	copyResponseHeaders(g.w, resp.Header, false)
+	g.w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(g.w, io.LimitReader(resp.Body, 64<<10))
+
+	up := res.target.Upstream
+	ev := g.event(up.Provider.Name(), up.Name, FirstNonEmpty(res.target.Model, "unknown"))
+	ev.StatusCode = resp.StatusCode
+	ev.Attempts = attemptsForEvent(res.attempts)
+	ev.ErrorClass = classifyUpstreamStatus(resp.StatusCode)
+	if ev.ErrorClass == "" {
+		ev.ErrorClass = ErrorClassUpstreamError
+	}
+	s.meter(g, ev)
+}
+
+// realtimeEvent builds an event for the usage since the previous one.
+func (s *Server) realtimeEvent(g *gatewayRequest, sess *realtimeSession, up *Upstream) MeteringEvent {
+	model, u, responses, seq := sess.take()
+	ev := g.event(up.Provider.Name(), up.Name, FirstNonEmpty(model, "unknown"))
+	ev.StatusCode = http.StatusSwitchingProtocols
+	ev.Sequence = seq
+	ev.ResponseCount = responses
+	ev.PromptTokens = u.PromptTokens
+	ev.CompletionTokens = u.CompletionTokens
+	ev.TotalTokens = u.TotalTokens
+	ev.CachedTokens = u.CachedTokens()
+	ev.InputAudioTokens = u.InputAudioTokens()
+	ev.OutputAudioTokens = u.OutputAudioTokens()
+	if responses > 0 {
+		s.priceEvent(&ev, &u)
+	}
+	return ev
+}
+
+// realtimeSession accumulates usage from the upstream's response.done
+// events. Usage is handed out as deltas so that every event of a session
+// can be summed.
+type realtimeSession struct {
+	mu        sync.Mutex
+	model     string
+	pending   Usage
+	responses int
+	seq       int
+	sum       Usage
+	// unparsed counts response.done events that could not be decoded.
+	unparsed prometheus.Counter
+}
+
+type realtimeServerEvent struct {
+	Type    string `json:"type"`
+	Session *struct {
+		Model string `json:"model"`
+	} `json:"session"`
+	Response *struct {
+		Usage *rawUsage `json:"usage"`
+	} `json:"response"`
+}
+
+func (rs *realtimeSession) observe(msg []byte) {
+	// only session and response.done events are decoded, not audio deltas
+	// and other large events
+	typ := realtimeEventType(msg)
+	if !strings.HasPrefix(typ, "session.") && typ != "response.done" {
+		return
+	}
+	var ev realtimeServerEvent
+	if err := json.Unmarshal(msg, &ev); err != nil {
+		if typ == "response.done" {
+			if rs.unparsed != nil {
+				rs.unparsed.Inc()
+			}
+			log.Printf("realtime: cannot decode response.done event (usage lost): %v", err)
+		}
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	switch {
+	case ev.Type == "response.done" && ev.Response != nil:
+		if u := ev.Response.Usage.normalize(); u != nil {
+			rs.pending.add(u)
+			rs.sum.add(u)
+		}
+		rs.responses++
+	case ev.Session != nil && ev.Session.Model != "":
+		rs.model = ev.Session.Model
+	}
+}
+
+// realtimeEventType returns the type of a server event, reading the
+// object's fields only until "type"; it usually comes first. It returns ""
+// for anything else than a JSON object with a string type.
+func realtimeEventType(msg []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return ""
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if key == "type" {
+			typ, _ := dec.Token()
+			s, _ := typ.(string)
+			return s
+		}
+		var skip json.RawMessage
+		if dec.Decode(&skip) != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+// take returns the usage since the previous call and numbers the event.
+func (rs *realtimeSession) take() (string, Usage, int, int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	u, n := rs.pending, rs.responses
+	rs.pending, rs.responses = Usage{}, 0
+	rs.seq++
+	return rs.model, u, n, rs.seq
+}
+
+func (rs *realtimeSession) total() *Usage {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.sum.TotalTokens == 0 {
+		return nil
+	}
+	u := rs.sum
+	return &u
+}
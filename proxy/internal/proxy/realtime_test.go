@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// realtimeMock is a minimal Realtime API upstream: it announces the session
+// and answers every response.create with a response.done carrying usage.
+func realtimeMock(t *testing.T) http.HandlerFunc {
+	up := websocket.Upgrader{Subprotocols: []string{"realtime"}}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-upstream" {
+			http.Error(w, `{"error":{"message":"bad key","type":"invalid_request_error","code":"invalid_api_key"}}`, http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, "/v1/realtime", r.URL.Path)
+		require.Equal(t, "realtime=v1", r.Header.Get("OpenAI-Beta"))
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		model := r.URL.Query().Get("model")
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"session.created","event_id":"e0","session":{"model":"`+model+`-2024-12-17"}}`))
+		for n := 1; ; n++ {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt != websocket.TextMessage || !strings.Contains(string(msg), "response.create") {
+				_ = conn.WriteMessage(mt, msg)
+				continue
+			}
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"response.audio.delta","delta":"AAAA"}`))
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"response.done","event_id":"e%d","response":{"status":"completed","usage":{`+
+				`"total_tokens":150,"input_tokens":100,"output_tokens":50,`+
+				`"input_token_details":{"cached_tokens":20,"text_tokens":40,"audio_tokens":60},`+
+				`"output_token_details":{"text_tokens":10,"audio_tokens":40}}}}`, n)))
+		}
+	}
+}
+
+func dialRealtime(t *testing.T, gw *httptest.Server, hdr http.Header, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: 2 * time.Second}
+	return d.Dial("ws"+strings.TrimPrefix(gw.URL, "http")+"/v1/realtime?model=gpt-4o-realtime-preview", hdr)
+}
+
+func TestRealtime_Session(t *testing.T) {
+	env := newTestEnv(t, realtimeMock(t), nil)
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+
+	conn, resp, err := dialRealtime(t, gw, http.Header{
+		"Authorization": {"Bearer dummy"},
+		"Openai-Beta":   {"realtime=v1"},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.Header.Get("X-LLM-Request-ID"))
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), "session.created")
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3}))
+	mt, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, mt)
+	require.Equal(t, []byte{1, 2, 3}, msg)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"response.create"}`)))
+		for {
+			_, msg, err = conn.ReadMessage()
+			require.NoError(t, err)
+			if strings.Contains(string(msg), "response.done") {
+				break
+			}
+		}
+	}
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "%v", err)
+	conn.Close()
+
+	ev := env.nextEvent(t)
+	require.Equal(t, resp.Header.Get("X-LLM-Request-ID"), ev.RequestID)
+	require.Equal(t, "/v1/realtime", ev.Endpoint)
+	require.Equal(t, "gpt-4o-realtime-preview-2024-12-17", ev.Model)
+	require.Equal(t, http.StatusSwitchingProtocols, ev.StatusCode)
+	require.True(t, ev.Final)
+	require.Equal(t, 1, ev.Sequence)
+	require.Equal(t, 2, ev.ResponseCount)
+	require.Equal(t, 200, ev.PromptTokens)
+	require.Equal(t, 100, ev.CompletionTokens)
+	require.Equal(t, 300, ev.TotalTokens)
+	require.Equal(t, 40, ev.CachedTokens)
+	require.Equal(t, 120, ev.InputAudioTokens)
+	require.Equal(t, 80, ev.OutputAudioTokens)
+	require.Empty(t, ev.ErrorClass)
+
+	body := scrapeMetrics(t, env)
+	require.Contains(t, body, `llm_proxy_requests_total{model="other",route="*",status="101",tenant="default",upstream="default"} 1`)
+	require.Contains(t, body, `llm_proxy_tokens_total{model="other",route="*",tenant="default",type="audio_out",upstream="default"} 80`)
+}
+
+func TestRealtime_PeriodicEventsAndBrowserAuth(t *testing.T) {
+	env := newTestEnv(t, realtimeMock(t), func(cfg *Config) {
+		withKeys(t, cfg, testKeyFile)
+		cfg.RealtimeMeteringInterval = 50 * time.Millisecond
+		cfg.RealtimeAllowedOrigins = []string{"https://app.example.com"}
+	})
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+
+	conn, resp, err := dialRealtime(t, gw, http.Header{"Openai-Beta": {"realtime=v1"}, "Origin": {"https://app.example.com"}},
+		"realtime", realtimeKeyProtocol+"gw_a")
+	require.NoError(t, err)
+	require.Equal(t, "realtime", resp.Header.Get("Sec-WebSocket-Protocol"))
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"response.create"}`)))
+	ev := env.nextEvent(t)
+	require.Equal(t, "team-a", ev.AppKeyID)
+	require.Equal(t, 1, ev.Sequence)
+	require.False(t, ev.Final)
+	require.Equal(t, 1, ev.ResponseCount)
+	require.Equal(t, 150, ev.TotalTokens)
+
+	// the client going away ends the session
+	require.NoError(t, conn.Close())
+	ev = env.nextEvent(t)
+	require.True(t, ev.Final)
+	require.Equal(t, 2, ev.Sequence)
+	require.Zero(t, ev.TotalTokens)
+}
+
+func TestRealtime_Rejections(t *testing.T) {
+	env := newTestEnv(t, realtimeMock(t), func(cfg *Config) { withKeys(t, cfg, testKeyFile) })
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+
+	_, resp, err := dialRealtime(t, gw, http.Header{"Authorization": {"Bearer nope"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, ErrorClassAuth, env.nextEvent(t).ErrorClass)
+
+	// gw_a may only use gpt-4o*, which the realtime model matches
+	env2 := newTestEnv(t, realtimeMock(t), func(cfg *Config) { cfg.UpstreamAPIKey = "wrong" })
+	gw2 := httptest.NewServer(env2.srv.Mux())
+	defer gw2.Close()
+	_, resp, err = dialRealtime(t, gw2, http.Header{"Authorization": {"Bearer dummy"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	ev := env2.nextEvent(t)
+	require.Equal(t, ErrorClassUpstreamAuth, ev.ErrorClass)
+	require.Equal(t, http.StatusUnauthorized, ev.StatusCode)
+
+	// the key in the subprotocol is only accepted from allowed origins
+	for _, origin := range []string{"", "https://evil.example.com"} {
+		_, resp, err = dialRealtime(t, gw, http.Header{"Origin": {origin}}, "realtime", realtimeKeyProtocol+"gw_a")
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		ev = env.nextEvent(t)
+		require.Equal(t, ErrorClassAuth, ev.ErrorClass)
+		require.Equal(t, "origin_not_allowed", ev.ErrorCode)
+	}
+
+	rec := env.send(t, http.MethodGet, "/v1/realtime?model=gpt-4o-realtime-preview", "gw_a", "", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestRealtime_FailsOverWhenDialFails(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	env := newTestEnv(t, realtimeMock(t), func(cfg *Config) {
+		p := t.TempDir() + "/routes.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`
+upstreams:
+  - {name: down, base_url: "`+downURL+`", api_key: sk-upstream}
+  - {name: unavailable, base_url: "`+unavailable.URL+`", api_key: sk-upstream}
+  - {name: backup, base_url: "`+cfg.UpstreamBaseURL+`", api_key: sk-upstream}
+routes:
+  - {match: "*", upstream: down, fallbacks: [unavailable, backup]}
+`), 0o600))
+		cfg.RoutesFile = p
+	})
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+
+	conn, _, err := dialRealtime(t, gw, http.Header{"Authorization": {"Bearer dummy"}, "Openai-Beta": {"realtime=v1"}})
+	require.NoError(t, err)
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), "session.created")
+	require.NoError(t, conn.Close())
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "backup", ev.Upstream)
+	require.Len(t, ev.Attempts, 3)
+	require.NotEmpty(t, ev.Attempts[0].Error)
+	require.Equal(t, http.StatusServiceUnavailable, ev.Attempts[1].StatusCode)
+	require.Equal(t, http.StatusSwitchingProtocols, ev.Attempts[2].StatusCode)
+}
+
+func TestRealtime_RefusedWhileTokensAreInDebt(t *testing.T) {
+	env := newTestEnv(t, realtimeMock(t), func(cfg *Config) {
+		p := t.TempDir() + "/limits.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`tenants: {demo: {tokens_per_minute: 100}}`), 0o600))
+		cfg.RateLimitsFile = p
+	})
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+	hdr := http.Header{"Authorization": {"Bearer dummy"}, "Openai-Beta": {"realtime=v1"}, "X-Llm-Tenant": {"demo"}}
+
+	// one response uses 150 tokens, more than the bucket holds
+	conn, _, err := dialRealtime(t, gw, hdr)
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"response.create"}`)))
+	for {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		if strings.Contains(string(msg), "response.done") {
+			break
+		}
+	}
+	require.NoError(t, conn.Close())
+	require.Equal(t, 150, env.nextEvent(t).TotalTokens)
+
+	_, resp, err := dialRealtime(t, gw, hdr)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, ErrorClassRateLimit, env.nextEvent(t).ErrorClass)
+}
+
+func TestUsage_Add(t *testing.T) {
+	var sum Usage
+	sum.add(&Usage{PromptTokens: 3, TotalTokens: 3})
+	sum.add(&Usage{PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3,
+		PromptTokensDetails:     &PromptTokensDetails{CachedTokens: 1, AudioTokens: 1},
+		CompletionTokensDetails: &CompletionTokensDetails{AudioTokens: 1}})
+	b, _ := json.Marshal(sum)
+	require.JSONEq(t, `{"prompt_tokens":5,"completion_tokens":1,"total_tokens":6,
+		"prompt_tokens_details":{"cached_tokens":1,"audio_tokens":1},
+		"completion_tokens_details":{"reasoning_tokens":0,"audio_tokens":1}}`, string(b))
+}
+
+func TestRealtimeSession_ObserveFindsTypeAnywhere(t *testing.T) {
+	unparsed := prometheus.NewCounter(prometheus.CounterOpts{Name: "unparsed"})
+	rs := &realtimeSession{unparsed: unparsed}
+	usage := `"usage":{"total_tokens":15,"input_tokens":10,"output_tokens":5}`
+
+	rs.observe([]byte(`{"event_id":"` + strings.Repeat("x", 200) + `","response":{"status":"completed",` + usage + `},"type":"response.done"}`))
+	rs.observe([]byte(`{"type":"response.audio.delta","delta":"response.done"}`))
+	rs.observe([]byte(`{"response":{` + usage + `}}`))
+	_, u, n, _ := rs.take()
+	require.Equal(t, 1, n)
+	require.Equal(t, 15, u.TotalTokens)
+
+	rs.observe([]byte(`{"type":"response.done","response":{"usage":{"total_tokens":"many"}}}`))
+	require.Equal(t, 1.0, testutil.ToFloat64(unparsed))
+	_, _, n, _ = rs.take()
+	require.Zero(t, n)
+
+	require.Equal(t, "session.created", realtimeEventType([]byte(`{"session":{"type":"x"},"type":"session.created"}`)))
+	for _, msg := range []string{``, `[]`, `{"type":1}`, `{"type":`, `{"a":}`} {
+		require.Empty(t, realtimeEventType([]byte(msg)), msg)
+	}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// gatewayRequest is the per-request state shared by the endpoint handlers:
+// who is calling, which route was taken and what was written back.
+type gatewayRequest struct {
+	id       string
+	endpoint string
+	start    time.Time
+	w        *statusWriter
+	rm       *requestMetrics
+	key      *GatewayKey
+	// ctx is the context of upstream calls. It ends with the client's
+	// request or as soon as a write to the client fails, so that the
+	// upstream stops generating for nobody.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// beginRequest starts tracking a request. finishRequest must be deferred
+// right after; handlers write through g.w and call upstreams with g.ctx.
+func (s *Server) beginRequest(w http.ResponseWriter, r *http.Request, endpoint string) *gatewayRequest {
+	ctx, cancel := context.WithCancel(r.Context())
+	g := &gatewayRequest{
+		id:       NewReqID(),
+		endpoint: endpoint,
+		start:    time.Now(),
+		w:        &statusWriter{ResponseWriter: w, abort: cancel},
+		rm:       &requestMetrics{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	w.Header().Set("X-LLM-Request-ID", g.id)
+	s.requests.Add(1)
+	s.metrics.inFlight.Inc()
+	return g
+}
+
+// finishRequest records metrics and meters requests the gateway answered
+// without reaching the point where the handler enqueued an event.
+func (s *Server) finishRequest(g *gatewayRequest) {
+	defer s.requests.Done()
+	g.cancel()
+	s.metrics.inFlight.Dec()
+	s.metrics.observe(g.rm, g.w, g.start)
+	if g.rm.metered {
+		return
+	}
+	ev := g.event("", "", FirstNonEmpty(g.rm.model, "unknown"))
+	ev.Tenant = FirstNonEmpty(g.rm.tenant, "unknown")
+	ev.StatusCode = g.w.status
+	ev.ErrorClass = gatewayErrorClasses[g.w.errCode]
+	ev.ErrorCode = g.w.errCode
+	if g.w.status == StatusClientClosedRequest {
+		ev.ErrorClass = ErrorClassClientCancel
+		ev.Aborted, ev.AbortedBy = true, AbortedByClient
+	}
+	s.meter(g, ev)
+}
+
+// authenticateRequest resolves the gateway key and tenant, writing the
+// error response when the request is rejected.
+func (s *Server) authenticateRequest(g *gatewayRequest, r *http.Request) bool {
+	key, token, ok := s.authenticate(g.w, r)
+	if !ok {
+		return false
+	}
+	g.key = key
+	g.rm.keyID = s.appKeyID(key, token)
+	if !s.authorizePath(g.w, key, r.URL.Path) {
+		return false
+	}
+	tenant, ok := resolveTenant(g.w, r, key)
+	if !ok {
+		return false
+	}
+	g.rm.tenant = tenant
+	return true
+}
+
+// routeRequest checks that the key may use model and resolves its route.
+func (s *Server) routeRequest(g *gatewayRequest, model string) ([]RouteTarget, bool) {
+	if !authorizeModel(g.w, g.key, model) {
+		return nil, false
+	}
+	targets, ok := s.router.Resolve(model)
+	if !ok {
+		WriteOpenAIError(g.w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			"no upstream is configured for model '"+model+"'")
+		return nil, false
+	}
+	g.rm.model = model
+	g.rm.route = targets[0].Route
+	return targets, true
+}
+
+// admitRequest applies the rate limits; the returned admission is nil when
+// no limits are configured.
+func (s *Server) admitRequest(g *gatewayRequest, estTokens int) (*Admission, bool) {
+	if s.limiter == nil {
+		return nil, true
+	}
+	adm, rej := s.limiter.Admit(g.rm.keyID, g.rm.tenant, g.rm.model, estTokens)
+	if rej != nil {
+		log.Printf("ratelimit: rejected request_id=%s %s=%s kind=%s retry_after=%s",
+			g.id, rej.Scope, rej.Name, rej.Kind, rej.RetryAfter)
+		WriteRateLimitError(g.w, rej)
+		return nil, false
+	}
+	return adm, true
+}
+
+// failUpstream answers a request for which sendWithFailover returned no
+// response and meters the failure.
+func (s *Server) failUpstream(g *gatewayRequest, r *http.Request, res upstreamResult, err error) {
+	if errors.Is(err, ErrTranslateRequest) {
+		WriteOpenAIError(g.w, http.StatusBadRequest, "invalid_request_error", "invalid_request", err.Error())
+		return
+	}
+	up := res.target.Upstream
+	if len(res.attempts) == 0 {
+		log.Printf("proxy: building upstream request failed request_id=%s upstream=%s err=%v", g.id, up.Name, err)
+		WriteOpenAIError(g.w, http.StatusInternalServerError, "server_error", "gateway_internal_error",
+			"the gateway failed to build the upstream request")
+		return
+	}
+	status, class := writeUpstreamFailure(r.Context(), g.w, err)
+	if g.w.status == 0 {
+		g.w.status = status
+	}
+	ev := g.event(up.Provider.Name(), up.Name, FirstNonEmpty(res.target.Model, "unknown"))
+	ev.StatusCode = status
+	ev.ErrorClass = class
+	ev.ErrorCode = g.w.errCode
+	ev.Attempts = attemptsForEvent(res.attempts)
+	// calls the upstream failed are not aborted; the client going away or
+	// a timeout may have cut a generation short
+	if class == ErrorClassClientCancel || class == ErrorClassUpstreamTimeout {
+		ev.Aborted, ev.AbortedBy = true, abortedBy[class]
+	}
+	s.meter(g, ev)
+}
+
+// markAborted records on ev that relaying the upstream response failed
+// with err, classifying who cut it short. Failed writes mean the client
+// went away even when its context has not ended yet.
+func (g *gatewayRequest) markAborted(ev *MeteringEvent, r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	ev.ErrorClass = classifyTransportError(r.Context(), err)
+	if g.w.writeErr != nil {
+		ev.ErrorClass = ErrorClassClientCancel
+	}
+	ev.Aborted, ev.AbortedBy = true, abortedBy[ev.ErrorClass]
+}
+
+// readRequestBody buffers the request body up to maxSize bytes, answering
+// 413 beyond that. The caller must Close the returned buffer.
+func (s *Server) readRequestBody(g *gatewayRequest, r *http.Request, maxSize int64) (*bodyBuffer, bool) {
+	return s.bufferRequestBody(g, r, s.cfg.RequestMemoryBufferBytes, maxSize)
+}
+
+// readRequestBytes is readRequestBody for bodies the handler decodes and
+// rewrites; they are kept in memory.
+func (s *Server) readRequestBytes(g *gatewayRequest, r *http.Request, maxSize int64) ([]byte, bool) {
+	body, ok := s.bufferRequestBody(g, r, maxSize, maxSize)
+	if !ok {
+		return nil, false
+	}
+	return body.mem, true
+}
+
+func (s *Server) bufferRequestBody(g *gatewayRequest, r *http.Request, memLimit, maxSize int64) (*bodyBuffer, bool) {
+	body, err := readBody(r.Body, memLimit, maxSize)
+	if errors.Is(err, ErrBodyTooLarge) {
+		WriteOpenAIError(g.w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+			fmt.Sprintf("request body exceeds %d bytes", maxSize))
+		return nil, false
+	}
+	if err != nil {
+		g.writeBodyReadError(r)
+		return nil, false
+	}
+	_ = r.Body.Close()
+	return body, true
+}
+
+func (g *gatewayRequest) writeBodyReadError(r *http.Request) {
+	if r.Context().Err() != nil {
+		g.w.status = StatusClientClosedRequest
+		return
+	}
+	WriteOpenAIError(g.w, http.StatusBadRequest, "invalid_request_error", "request_body_unreadable",
+		"failed to read the request body")
+}
+
+// event returns a metering event with the request's identity filled in.
+func (g *gatewayRequest) event(provider, upstream, model string) MeteringEvent {
+	return MeteringEvent{
+		RequestID: g.id,
+		Tenant:    g.rm.tenant,
+		AppKeyID:  g.rm.keyID,
+		Endpoint:  g.endpoint,
+		Provider:  provider,
+		Upstream:  upstream,
+		Model:     model,
+		LatencyMs: time.Since(g.start).Milliseconds(),
+		At:        time.Now().UTC(),
+	}
+}
+
+// recordResponse adds what was seen of the upstream response to ev: the
+// upstream time to first byte and, for a streamed response (stats, nil
+// otherwise), its timings and in-stream error. The metrics observe the
+// same timings.
+func (g *gatewayRequest) recordResponse(ev *MeteringEvent, res upstreamResult, stats *StreamStats) {
+	ev.UpstreamTTFBMs = res.ttfb.Milliseconds()
+	stats.apply(ev, g.start)
+	g.rm.upstreamTTFB = res.ttfb
+	g.rm.streamStats = stats
+}
+
+// meter enqueues the request's event.
+func (s *Server) meter(g *gatewayRequest, ev MeteringEvent) {
+	ev.AppKey = s.legacyAppKey(ev.AppKeyID)
+	if ev.UsageSource == "" && ev.TotalTokens > 0 {
+		ev.UsageSource = UsageSourceUpstream
+	}
+	g.rm.metered = true
+	s.enqueue(ev)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed",
+		"method "+r.Method+" is not allowed, use POST")
+}
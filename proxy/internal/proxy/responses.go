@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// handleResponses serves POST /v1/responses. Requests are forwarded like
+// the other OpenAI endpoints; responses are metered from the response
+// object, or from the response.completed event when streaming.
+func (s *Server) handleResponses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	s.handlePassthrough(w, r)
+}
+
+// responsesStreamEvent is a typed event of a Responses API stream. Only
+// the lifecycle events (response.created, response.in_progress,
+// response.completed, response.incomplete, response.failed) carry the
+// response object.
+type responsesStreamEvent struct {
+	Type     string `json:"type"`
+	Response *struct {
+		Model string               `json:"model"`
+		Usage *rawUsage            `json:"usage"`
+		Error *upstreamStreamError `json:"error"`
+	} `json:"response"`
+	// Code is set on error events.
+	Code string `json:"code"`
+}
+
+// StreamResponsesSSE relays a Responses API stream and returns the model
+// and the usage of the final response event. Output deltas (the
+// response.*.delta events) are timed in stats as content chunks; error
+// events and failed responses are recorded as in-stream errors.
+func StreamResponsesSSE(w http.ResponseWriter, upstream io.Reader, stats *StreamStats) (string, *Usage, error) {
+	var model string
+	var usage *Usage
+
+	err := relaySSE(w, upstream, func(sev *sseEvent) sseAction {
+		var ev responsesStreamEvent
+		if json.Unmarshal(sev.data, &ev) != nil {
+			return sseRelay
+		}
+		switch {
+		case strings.HasSuffix(ev.Type, ".delta"):
+			stats.contentChunk()
+		case ev.Type == "error":
+			stats.upstreamError(classifyStreamError(ev.Code))
+		case ev.Type == "response.failed" && ev.Response != nil:
+			stats.upstreamError(ev.Response.Error.class())
+		}
+		if ev.Response == nil {
+			return sseRelay
+		}
+		if ev.Response.Model != "" {
+			model = ev.Response.Model
+		}
+		switch ev.Type {
+		case "response.completed", "response.incomplete", "response.failed":
+			if u := ev.Response.Usage.normalize(); u != nil {
+				usage = u
+			}
+		}
+		return sseRelay
+	})
+	stats.finish()
+	return model, usage, err
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const responsesStream = "event: response.created\n" +
+	"data: {\"type\":\"response.created\",\"sequence_number\":0,\"response\":{\"id\":\"resp_1\",\"model\":\"o4-mini-2025-04-16\",\"status\":\"in_progress\",\"usage\":null}}\n\n" +
+	"event: response.output_text.delta\n" +
+	"data: {\"type\":\"response.output_text.delta\",\"sequence_number\":1,\"item_id\":\"msg_1\",\"output_index\":0,\"content_index\":0,\"delta\":\"Hi\"}\n\n" +
+	"event: response.completed\n" +
+	"data: {\"type\":\"response.completed\",\"sequence_number\":2,\"response\":{\"id\":\"resp_1\",\"model\":\"o4-mini-2025-04-16\",\"status\":\"completed\"," +
+	"\"usage\":{\"input_tokens\":120,\"input_tokens_details\":{\"cached_tokens\":64},\"output_tokens\":40,\"output_tokens_details\":{\"reasoning_tokens\":32},\"total_tokens\":160}}}\n\n"
+
+func TestStreamResponsesSSE(t *testing.T) {
+	rec := httptest.NewRecorder()
+	stats := newStreamStats()
+	model, usage, err := StreamResponsesSSE(rec, bytes.NewBufferString(responsesStream), stats)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.chunks)
+	require.Equal(t, responsesStream, rec.Body.String())
+	require.Equal(t, "o4-mini-2025-04-16", model)
+	require.Equal(t, 120, usage.PromptTokens)
+	require.Equal(t, 40, usage.CompletionTokens)
+	require.Equal(t, 160, usage.TotalTokens)
+	require.Equal(t, 64, usage.CachedTokens())
+	require.Equal(t, 32, usage.ReasoningTokens())
+
+	// no usage before the final event
+	rec = httptest.NewRecorder()
+	_, usage, err = StreamResponsesSSE(rec, bytes.NewBufferString("event: response.created\ndata: {\"type\":\"response.created\",\"response\":{\"model\":\"m\",\"usage\":null}}\n\n"), nil)
+	require.NoError(t, err)
+	require.Nil(t, usage)
+}
+
+func TestStreamResponsesSSE_Errors(t *testing.T) {
+	for in, want := range map[string]string{
+		"event: error\ndata: {\"type\":\"error\",\"code\":\"rate_limit_exceeded\",\"message\":\"slow down\",\"param\":null}\n\n":                                                                          ErrorClassUpstreamRateLimit,
+		"event: response.failed\ndata: {\"type\":\"response.failed\",\"response\":{\"model\":\"m\",\"status\":\"failed\",\"error\":{\"code\":\"server_error\",\"message\":\"boom\"},\"usage\":null}}\n\n": ErrorClassUpstream5xx,
+	} {
+		stats := newStreamStats()
+		_, _, err := StreamResponsesSSE(httptest.NewRecorder(), strings.NewReader(in), stats)
+		require.NoError(t, err)
+		require.Equal(t, want, stats.errorClass)
+	}
+}
+
+func TestResponses_Stream(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/responses", r.URL.Path)
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(responsesStream))
+	}, nil)
+
+	rec := env.send(t, http.MethodPost, "/v1/responses", "dummy", "application/json", `{"model":"o4-mini","input":"hi","stream":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, responsesStream, rec.Body.String())
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "/v1/responses", ev.Endpoint)
+	require.Equal(t, "o4-mini-2025-04-16", ev.Model)
+	require.Equal(t, 120, ev.PromptTokens)
+	require.Equal(t, 40, ev.CompletionTokens)
+	require.Equal(t, 64, ev.CachedTokens)
+	require.Equal(t, 32, ev.ReasoningTokens)
+
+	body := scrapeMetrics(t, env)
+	require.Contains(t, body, `llm_proxy_time_to_first_token_seconds_count{model="other",route="*",tenant="default",upstream="default"} 1`)
+}
+
+func TestResponses_NonStreamAndRetrieve(t *testing.T) {
+	const resp = `{"id":"resp_1","object":"response","model":"gpt-4.1-2025-04-14","status":"completed",` +
+		`"usage":{"input_tokens":10,"input_tokens_details":{"cached_tokens":0},"output_tokens":5,"output_tokens_details":{"reasoning_tokens":0},"total_tokens":15}}`
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(resp))
+	}, func(cfg *Config) {
+		cfg.AllowedPaths = append([]string{"/v1/responses/*"}, DefaultAllowedPaths...)
+	})
+
+	rec := env.send(t, http.MethodPost, "/v1/responses", "dummy", "application/json", `{"model":"gpt-4.1","input":"hi"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := env.nextEvent(t)
+	require.Equal(t, "gpt-4.1-2025-04-14", ev.Model)
+	require.Equal(t, 15, ev.TotalTokens)
+
+	// retrieving a stored response is forwarded but not metered as usage
+	rec = env.send(t, http.MethodGet, "/v1/responses/resp_1", "dummy", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev = env.nextEvent(t)
+	require.Equal(t, "/v1/responses/resp_1", ev.Endpoint)
+	require.Zero(t, ev.TotalTokens)
+
+	rec = env.send(t, http.MethodGet, "/v1/responses", "dummy", "", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
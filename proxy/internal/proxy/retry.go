@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how often a single upstream is retried before the
+// gateway fails over to the next upstream of the route.
+type RetryPolicy struct {
+	MaxAttempts         int      `yaml:"max_attempts" json:"max_attempts"`
+	RetryOnStatus       []int    `yaml:"retry_on_status" json:"retry_on_status"`
+	RetryOnNetworkError bool     `yaml:"retry_on_network_error" json:"retry_on_network_error"`
+	InitialBackoff      Duration `yaml:"initial_backoff" json:"initial_backoff"`
+	MaxBackoff          Duration `yaml:"max_backoff" json:"max_backoff"`
+	// Jitter randomly shortens each backoff by up to this fraction (0..1).
+	Jitter            float64 `yaml:"jitter" json:"jitter"`
+	RespectRetryAfter bool    `yaml:"respect_retry_after" json:"respect_retry_after"`
+	// MaxRetryAfter caps how long a Retry-After is honored; longer waits
+	// fail over to the next upstream instead.
+	MaxRetryAfter Duration `yaml:"max_retry_after" json:"max_retry_after"`
+}
+
+func DefaultRetryPolicy(cfg Config) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:         max(cfg.UpstreamMaxAttempts, 1),
+		RetryOnStatus:       []int{http.StatusTooManyRequests, 500, 502, 503, 504},
+		RetryOnNetworkError: true,
+		InitialBackoff:      Duration(250 * time.Millisecond),
+		MaxBackoff:          Duration(5 * time.Second),
+		Jitter:              0.2,
+		RespectRetryAfter:   true,
+		MaxRetryAfter:       Duration(20 * time.Second),
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("max_attempts must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (p RetryPolicy) retryableStatus(code int) bool {
+	return slices.Contains(p.RetryOnStatus, code)
+}
+
+// backoff returns the wait before retry number n (1-based).
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := time.Duration(p.InitialBackoff)
+	for i := 1; i < n && d < time.Duration(p.MaxBackoff); i++ {
+		d *= 2
+	}
+	d = min(d, time.Duration(p.MaxBackoff))
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// RetryAfter parses Retry-After (seconds or HTTP date) and OpenAI's
+// retry-after-ms. It returns 0 when no usable hint is present.
+func RetryAfter(h http.Header, now time.Time) time.Duration {
+	if v := strings.TrimSpace(h.Get("retry-after-ms")); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms > 0 {
+			return time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// UpstreamAttempt records one upstream call made for a client request.
+type UpstreamAttempt struct {
+	Upstream   string `json:"upstream"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+}
+
+type upstreamResult struct {
+	resp     *http.Response
+	target   RouteTarget
+	attempts []UpstreamAttempt
+	// ttfb is how long resp took from sending the request to its headers.
+	ttfb time.Duration
+}
+
+// buildRequest creates the upstream request for one attempt against target.
+type buildRequest func(target RouteTarget) (*http.Request, error)
+
+// sendWithFailover sends the request to the route's targets in order,
+// retrying each according to its upstream's policy. Nothing is written to
+// the client here, so failing over is always safe. The returned response
+// is the first acceptable one, or the last retryable one when every
+// attempt failed. err is set only when no response was obtained at all.
+func (s *Server) sendWithFailover(ctx context.Context, targets []RouteTarget, build buildRequest) (upstreamResult, error) {
+	var res upstreamResult
+	var lastErr error
+
+	for ti, target := range targets {
+		res.target = target
+		policy := target.Upstream.Retry
+		lastTarget := ti == len(targets)-1
+
+		for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+			req, err := build(target)
+			if err != nil {
+				return res, err
+			}
+
+			started := time.Now()
+			resp, err := target.Upstream.Client.Do(req)
+			ttfb := time.Since(started)
+			a := UpstreamAttempt{Upstream: target.Upstream.Name, LatencyMs: ttfb.Milliseconds()}
+
+			if err != nil {
+				a.Error = err.Error()
+				res.attempts = append(res.attempts, a)
+				lastErr = err
+				if ctx.Err() != nil {
+					return res.abandon(ctx.Err())
+				}
+				if !policy.RetryOnNetworkError {
+					break
+				}
+				if attempt < policy.MaxAttempts && !sleepCtx(ctx, policy.backoff(attempt)) {
+					return res.abandon(ctx.Err())
+				}
+				continue
+			}
+
+			a.StatusCode = resp.StatusCode
+			res.attempts = append(res.attempts, a)
+			if res.resp != nil {
+				discardResponse(res.resp)
+			}
+			res.resp, res.ttfb = resp, ttfb
+			lastErr = nil
+
+			if !policy.retryableStatus(resp.StatusCode) {
+				return res, nil
+			}
+			if attempt == policy.MaxAttempts {
+				break
+			}
+
+			wait := policy.backoff(attempt)
+			if policy.RespectRetryAfter {
+				if ra := RetryAfter(resp.Header, time.Now()); ra > 0 {
+					if ra > time.Duration(policy.MaxRetryAfter) {
+						break
+					}
+					wait = max(wait, ra)
+				}
+			}
+			if !sleepCtx(ctx, wait) {
+				return res.abandon(ctx.Err())
+			}
+		}
+
+		if !lastTarget && res.resp != nil {
+			discardResponse(res.resp)
+			res.resp = nil
+		}
+	}
+
+	if res.resp != nil {
+		return res, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream attempted")
+	}
+	return res, lastErr
+}
+
+// sendOnce makes a single attempt against target. It is used for request
+// bodies that are streamed through and cannot be sent again.
+func (s *Server) sendOnce(ctx context.Context, target RouteTarget, build buildRequest) (upstreamResult, error) {
+	res := upstreamResult{target: target}
+	req, err := build(target)
+	if err != nil {
+		return res, err
+	}
+
+	started := time.Now()
+	resp, err := target.Upstream.Client.Do(req)
+	ttfb := time.Since(started)
+	a := UpstreamAttempt{Upstream: target.Upstream.Name, LatencyMs: ttfb.Milliseconds()}
+	if err != nil {
+		a.Error = err.Error()
+		res.attempts = append(res.attempts, a)
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		return res, err
+	}
+	a.StatusCode = resp.StatusCode
+	res.attempts = append(res.attempts, a)
+	res.resp, res.ttfb = resp, ttfb
+	return res, nil
+}
+
+func (res upstreamResult) abandon(err error) (upstreamResult, error) {
+	if res.resp != nil {
+		discardResponse(res.resp)
+		res.resp = nil
+	}
+	return res, err
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// discardResponse drains a small amount of an abandoned response so the
+// connection can be reused, then closes it.
+func discardResponse(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+}
+
+// attemptsForEvent omits the attempt list for the common single-attempt case.
+func attemptsForEvent(attempts []UpstreamAttempt) []UpstreamAttempt {
+	if len(attempts) < 2 {
+		return nil
+	}
+	return attempts
+}
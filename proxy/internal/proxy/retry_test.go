@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.Equal(t, 2*time.Second, RetryAfter(http.Header{"Retry-After": {"2"}}, now))
+	require.Equal(t, 1500*time.Millisecond, RetryAfter(http.Header{"Retry-After-Ms": {"1500"}, "Retry-After": {"9"}}, now))
+	require.Equal(t, 10*time.Second, RetryAfter(http.Header{"Retry-After": {now.Add(10 * time.Second).Format(http.TimeFormat)}}, now))
+	require.Zero(t, RetryAfter(http.Header{"Retry-After": {"soon"}}, now))
+	require.Zero(t, RetryAfter(http.Header{}, now))
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second), Jitter: 0.5}
+	for i := 0; i < 50; i++ {
+		d := p.backoff(2)
+		require.GreaterOrEqual(t, d, 100*time.Millisecond)
+		require.LessOrEqual(t, d, 200*time.Millisecond)
+	}
+	p.Jitter = 0
+	require.Equal(t, time.Second, p.backoff(10))
+}
+
+func TestRouter_RetryPolicyOverrides(t *testing.T) {
+	rt := parseTestRoutes(t, `
+retry:
+  max_attempts: 3
+  retry_on_status: [503]
+upstreams:
+  - name: a
+    base_url: http://a
+  - name: b
+    base_url: http://b
+    retry:
+      max_attempts: 1
+      respect_retry_after: false
+routes:
+  - match: "*"
+    upstream: a
+    fallbacks: [b, {upstream: a, model: other}]
+`)
+	a, _ := rt.Upstream("a")
+	b, _ := rt.Upstream("b")
+	require.Equal(t, 3, a.Retry.MaxAttempts)
+	require.Equal(t, []int{503}, a.Retry.RetryOnStatus)
+	require.True(t, a.Retry.RespectRetryAfter)
+	require.Equal(t, 1, b.Retry.MaxAttempts)
+	require.Equal(t, []int{503}, b.Retry.RetryOnStatus)
+	require.False(t, b.Retry.RespectRetryAfter)
+
+	targets, ok := rt.Resolve("gpt-4o")
+	require.True(t, ok)
+	require.Len(t, targets, 3)
+	require.Equal(t, "b", targets[1].Upstream.Name)
+	require.Equal(t, "gpt-4o", targets[1].Model)
+	require.Equal(t, "other", targets[2].Model)
+}
+
+func TestChatCompletions_RetryAndFailover(t *testing.T) {
+	var primaryCalls atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(primary.Close)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		p := t.TempDir() + "/routes.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`
+retry:
+  max_attempts: 2
+  initial_backoff: 1ms
+  max_backoff: 5ms
+upstreams:
+  - {name: primary, base_url: "`+primary.URL+`", api_key: k}
+  - {name: down, base_url: "`+downURL+`", api_key: k}
+  - {name: backup, base_url: "`+cfg.UpstreamBaseURL+`", api_key: k}
+routes:
+  - {match: "gpt-4o*", upstream: primary, fallbacks: [down, backup]}
+  - {match: "only-primary", upstream: primary}
+`), 0o600))
+		cfg.RoutesFile = p
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.EqualValues(t, 2, primaryCalls.Load())
+
+	ev := env.nextEvent(t)
+	require.Equal(t, "backup", ev.Upstream)
+	require.Equal(t, http.StatusOK, ev.StatusCode)
+	require.Len(t, ev.Attempts, 5)
+	require.Equal(t, http.StatusServiceUnavailable, ev.Attempts[0].StatusCode)
+	require.Equal(t, "down", ev.Attempts[2].Upstream)
+	require.NotEmpty(t, ev.Attempts[2].Error)
+	require.Equal(t, "backup", ev.Attempts[4].Upstream)
+
+	// without fallbacks the last retryable response reaches the client
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"only-primary"}`, nil)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	ev = env.nextEvent(t)
+	require.Equal(t, http.StatusServiceUnavailable, ev.StatusCode)
+	require.Len(t, ev.Attempts, 2)
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpstreamConfig describes a named upstream in the routes file.
+type UpstreamConfig struct {
+	Name     string `yaml:"name" json:"name"`
+	Provider string `yaml:"provider" json:"provider"`
+	BaseURL  string `yaml:"base_url" json:"base_url"`
+	// APIKeyEnv names the environment variable holding the credential so
+	// that the routes file itself carries no secrets. APIKey is accepted
+	// for local setups.
+	APIKeyEnv             string   `yaml:"api_key_env,omitempty" json:"api_key_env,omitempty"`
+	APIKey                string   `yaml:"api_key,omitempty" json:"api_key,omitempty"`
+	Timeout               Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	ResponseHeaderTimeout Duration `yaml:"response_header_timeout,omitempty" json:"response_header_timeout,omitempty"`
+	// Retry overrides fields of the file-level retry policy.
+	Retry yaml.Node `yaml:"retry,omitempty" json:"-"`
+}
+
+// RouteConfig maps a model name or pattern to an upstream. Match is an exact
+// model name, a prefix ending in "*" ("gpt-4o*", "azure/*") or a path.Match
+// glob. The forwarded model can be replaced (Model) or have StripPrefix removed.
+type RouteConfig struct {
+	Match       string `yaml:"match" json:"match"`
+	Upstream    string `yaml:"upstream" json:"upstream"`
+	Model       string `yaml:"model,omitempty" json:"model,omitempty"`
+	StripPrefix string `yaml:"strip_prefix,omitempty" json:"strip_prefix,omitempty"`
+	// Fallbacks are tried in order when the upstream keeps failing with
+	// retryable errors after its retry policy is exhausted.
+	Fallbacks []FallbackConfig `yaml:"fallbacks,omitempty" json:"fallbacks,omitempty"`
+}
+
+// FallbackConfig names a fallback upstream, optionally with its own model
+// name. A plain string is accepted as the upstream name.
+type FallbackConfig struct {
+	Upstream string `yaml:"upstream" json:"upstream"`
+	Model    string `yaml:"model,omitempty" json:"model,omitempty"`
+}
+
+func (f *FallbackConfig) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&f.Upstream)
+	}
+	type plain FallbackConfig
+	return n.Decode((*plain)(f))
+}
+
+type RoutesFile struct {
+	// Retry is the default retry policy of every upstream; unset fields
+	// keep DefaultRetryPolicy values.
+	Retry     yaml.Node        `yaml:"retry,omitempty" json:"-"`
+	Upstreams []UpstreamConfig `yaml:"upstreams" json:"upstreams"`
+	Routes    []RouteConfig    `yaml:"routes" json:"routes"`
+}
+
+// Duration accepts Go duration strings ("30s") in YAML and JSON files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type route struct {
+	RouteConfig
+	upstream  *Upstream
+	fallbacks []RouteTarget
+}
+
+// RouteTarget is an upstream together with the model name sent to it.
+// Route is the match of the route that selected it.
+type RouteTarget struct {
+	Upstream *Upstream
+	Model    string
+	Route    string
+}
+
+// Router resolves the upstream for a requested model. Exact matches win,
+// then patterns in file order.
+type Router struct {
+	upstreams map[string]*Upstream
+	exact     map[string]*route
+	patterns  []*route
+}
+
+func LoadRoutes(filename string, cfg Config, transport http.RoundTripper) (*Router, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rf RoutesFile
+	if err := yaml.Unmarshal(b, &rf); err != nil {
+		return nil, fmt.Errorf("parse routes file: %w", err)
+	}
+	return NewRouter(rf, cfg, transport)
+}
+
+func NewRouter(rf RoutesFile, cfg Config, transport http.RoundTripper) (*Router, error) {
+	rt := &Router{
+		upstreams: make(map[string]*Upstream, len(rf.Upstreams)),
+		exact:     map[string]*route{},
+	}
+
+	defaultRetry := DefaultRetryPolicy(cfg)
+	if !rf.Retry.IsZero() {
+		if err := rf.Retry.Decode(&defaultRetry); err != nil {
+			return nil, fmt.Errorf("retry: %w", err)
+		}
+	}
+	if err := defaultRetry.validate(); err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+
+	for _, uc := range rf.Upstreams {
+		if uc.Name == "" {
+			return nil, errors.New("upstream: missing name")
+		}
+		if _, dup := rt.upstreams[uc.Name]; dup {
+			return nil, fmt.Errorf("upstream %q: duplicate name", uc.Name)
+		}
+		if uc.BaseURL == "" {
+			return nil, fmt.Errorf("upstream %q: missing base_url", uc.Name)
+		}
+		p, ok := NewProvider(uc.Provider, cfg)
+		if !ok {
+			return nil, fmt.Errorf("upstream %q: unknown provider %q", uc.Name, uc.Provider)
+		}
+		apiKey := uc.APIKey
+		if uc.APIKeyEnv != "" {
+			apiKey = os.Getenv(uc.APIKeyEnv)
+			if apiKey == "" {
+				return nil, fmt.Errorf("upstream %q: %s is empty", uc.Name, uc.APIKeyEnv)
+			}
+		}
+
+		retry := defaultRetry
+		if !uc.Retry.IsZero() {
+			if err := uc.Retry.Decode(&retry); err != nil {
+				return nil, fmt.Errorf("upstream %q: retry: %w", uc.Name, err)
+			}
+			if err := retry.validate(); err != nil {
+				return nil, fmt.Errorf("upstream %q: retry: %w", uc.Name, err)
+			}
+		}
+
+		timeout := time.Duration(uc.Timeout)
+		if timeout <= 0 {
+			timeout = cfg.HTTPClientTimeout
+		}
+		rt.upstreams[uc.Name] = &Upstream{
+			Name:     uc.Name,
+			BaseURL:  uc.BaseURL,
+			APIKey:   apiKey,
+			Provider: p,
+			Client:   upstreamClient(transport, timeout, time.Duration(uc.ResponseHeaderTimeout)),
+			Retry:    retry,
+		}
+	}
+
+	for _, rc := range rf.Routes {
+		if rc.Match == "" {
+			return nil, errors.New("route: missing match")
+		}
+		up, ok := rt.upstreams[rc.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("route %q: unknown upstream %q", rc.Match, rc.Upstream)
+		}
+		r := &route{RouteConfig: rc, upstream: up}
+		for _, fb := range rc.Fallbacks {
+			fup, ok := rt.upstreams[fb.Upstream]
+			if !ok {
+				return nil, fmt.Errorf("route %q: unknown fallback upstream %q", rc.Match, fb.Upstream)
+			}
+			r.fallbacks = append(r.fallbacks, RouteTarget{Upstream: fup, Model: fb.Model})
+		}
+		if strings.ContainsAny(rc.Match, "*?[") {
+			if _, err := path.Match(rc.Match, ""); err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.Match, err)
+			}
+			rt.patterns = append(rt.patterns, r)
+			continue
+		}
+		if _, dup := rt.exact[rc.Match]; dup {
+			return nil, fmt.Errorf("route %q: duplicate match", rc.Match)
+		}
+		rt.exact[rc.Match] = r
+	}
+	return rt, nil
+}
+
+// DefaultRouter builds the routing table from the environment-only
+// configuration: Anthropic model prefixes (when configured) and a catch-all
+// route to the default upstream.
+func DefaultRouter(cfg Config, transport http.RoundTripper) (*Router, error) {
+	rf := RoutesFile{
+		Upstreams: []UpstreamConfig{{
+			Name:     "default",
+			Provider: cfg.UpstreamProvider,
+			BaseURL:  cfg.UpstreamBaseURL,
+			APIKey:   cfg.UpstreamAPIKey,
+		}},
+	}
+	if cfg.AnthropicAPIKey != "" {
+		rf.Upstreams = append(rf.Upstreams, UpstreamConfig{
+			Name:     ProviderAnthropic,
+			Provider: ProviderAnthropic,
+			BaseURL:  cfg.AnthropicBaseURL,
+			APIKey:   cfg.AnthropicAPIKey,
+		})
+		for _, prefix := range cfg.AnthropicModelPrefixes {
+			rf.Routes = append(rf.Routes, RouteConfig{Match: prefix + "*", Upstream: ProviderAnthropic})
+		}
+	}
+	rf.Routes = append(rf.Routes, RouteConfig{Match: "*", Upstream: "default"})
+	return NewRouter(rf, cfg, transport)
+}
+
+// Resolve returns the upstream for model followed by the route's fallbacks,
+// each with the model name to forward.
+func (rt *Router) Resolve(model string) ([]RouteTarget, bool) {
+	r, ok := rt.exact[model]
+	if !ok {
+		for _, p := range rt.patterns {
+			if matchModelPattern(p.Match, model) {
+				r, ok = p, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+
+	forward := model
+	switch {
+	case r.Model != "":
+		forward = r.Model
+	case r.StripPrefix != "":
+		forward = strings.TrimPrefix(model, r.StripPrefix)
+	}
+	targets := make([]RouteTarget, 0, 1+len(r.fallbacks))
+	targets = append(targets, RouteTarget{Upstream: r.upstream, Model: forward, Route: r.Match})
+	for _, fb := range r.fallbacks {
+		targets = append(targets, RouteTarget{Upstream: fb.Upstream, Model: FirstNonEmpty(fb.Model, forward), Route: r.Match})
+	}
+	return targets, true
+}
+
+func (rt *Router) Upstream(name string) (*Upstream, bool) {
+	up, ok := rt.upstreams[name]
+	return up, ok
+}
+
+// HasModel reports whether a route matches model by its exact name.
+func (rt *Router) HasModel(model string) bool {
+	_, ok := rt.exact[model]
+	return ok
+}
+
+func (rt *Router) Len() int {
+	return len(rt.upstreams)
+}
+
+// matchModelPattern treats a single trailing "*" as a prefix match so that
+// "azure/*" and "gpt-4o*" also cover names containing "/"; other patterns
+// use path.Match.
+func matchModelPattern(pattern, model string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(model, prefix)
+	}
+	ok, err := path.Match(pattern, model)
+	return err == nil && ok
+}
+
+func upstreamClient(transport http.RoundTripper, timeout, headerTimeout time.Duration) *http.Client {
+	if t, ok := transport.(*http.Transport); ok && headerTimeout > 0 {
+		t = t.Clone()
+		t.ResponseHeaderTimeout = headerTimeout
+		transport = t
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// rewriteModel replaces the "model" field of a JSON request body, keeping
+// every other field as sent by the client.
+func rewriteModel(body []byte, model string) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	m["model"] = b
+	return json.Marshal(m)
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const testRoutes = `
+upstreams:
+  - name: openai
+    provider: openai
+    base_url: https://api.openai.com
+    api_key_env: TEST_ROUTES_OPENAI_KEY
+  - name: azure
+    provider: openai
+    base_url: https://example.openai.azure.com
+    api_key: az-key
+    timeout: 30s
+    response_header_timeout: 10s
+  - name: claude
+    provider: anthropic
+    base_url: https://api.anthropic.com
+    api_key: sk-ant
+routes:
+  - match: "azure/*"
+    upstream: azure
+    strip_prefix: "azure/"
+  - match: "gpt-4o*"
+    upstream: openai
+  - match: "gpt-4o-special"
+    upstream: azure
+    model: gpt-4o-2024-08-06
+  - match: "claude-*"
+    upstream: claude
+`
+
+func parseTestRoutes(t *testing.T, content string) *Router {
+	t.Helper()
+	var rf RoutesFile
+	require.NoError(t, yaml.Unmarshal([]byte(content), &rf))
+	rt, err := NewRouter(rf, Config{HTTPClientTimeout: time.Minute}, http.DefaultTransport)
+	require.NoError(t, err)
+	return rt
+}
+
+func resolveOne(rt *Router, model string) (*Upstream, string, bool) {
+	targets, ok := rt.Resolve(model)
+	if !ok {
+		return nil, "", false
+	}
+	return targets[0].Upstream, targets[0].Model, true
+}
+
+func TestRouter_Resolve(t *testing.T) {
+	t.Setenv("TEST_ROUTES_OPENAI_KEY", "sk-env")
+	rt := parseTestRoutes(t, testRoutes)
+
+	up, model, ok := resolveOne(rt, "azure/gpt-4o-mini")
+	require.True(t, ok)
+	require.Equal(t, "azure", up.Name)
+	require.Equal(t, "gpt-4o-mini", model)
+	require.Equal(t, 30*time.Second, up.Client.Timeout)
+
+	up, model, ok = resolveOne(rt, "gpt-4o-mini")
+	require.True(t, ok)
+	require.Equal(t, "openai", up.Name)
+	require.Equal(t, "sk-env", up.APIKey)
+	require.Equal(t, "gpt-4o-mini", model)
+	require.Equal(t, time.Minute, up.Client.Timeout)
+
+	// exact match wins over the earlier gpt-4o* prefix
+	up, model, ok = resolveOne(rt, "gpt-4o-special")
+	require.True(t, ok)
+	require.Equal(t, "azure", up.Name)
+	require.Equal(t, "gpt-4o-2024-08-06", model)
+
+	up, _, ok = resolveOne(rt, "claude-3-5-sonnet-latest")
+	require.True(t, ok)
+	require.Equal(t, ProviderAnthropic, up.Provider.Name())
+
+	_, ok = rt.Resolve("llama-3")
+	require.False(t, ok)
+}
+
+func TestRouter_Invalid(t *testing.T) {
+	cases := []string{
+		`upstreams: [{name: a, base_url: http://a}, {name: a, base_url: http://b}]`,
+		`upstreams: [{name: a, provider: nope, base_url: http://a}]`,
+		`upstreams: [{name: a, base_url: http://a, api_key_env: TEST_ROUTES_UNSET}]`,
+		`{upstreams: [{name: a, base_url: http://a}], routes: [{match: x, upstream: b}]}`,
+		`{upstreams: [{name: a, base_url: http://a}], routes: [{match: "[", upstream: a}]}`,
+	}
+	for _, c := range cases {
+		var rf RoutesFile
+		require.NoError(t, yaml.Unmarshal([]byte(c), &rf), c)
+		_, err := NewRouter(rf, Config{}, http.DefaultTransport)
+		require.Error(t, err, c)
+	}
+}
+
+func TestMatchModelPattern(t *testing.T) {
+	require.True(t, matchModelPattern("azure/*", "azure/deploy/x"))
+	require.True(t, matchModelPattern("gpt-4o*", "gpt-4o"))
+	require.True(t, matchModelPattern("gpt-?o", "gpt-4o"))
+	require.False(t, matchModelPattern("gpt-4o*", "gpt-4"))
+}
+
+func TestRewriteModel(t *testing.T) {
+	b, err := rewriteModel([]byte(`{"model":"azure/gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`), "gpt-4o")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, string(b))
+}
+
+func TestChatCompletions_RoutesFile(t *testing.T) {
+	var seenModel string
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		b, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(b, &body)
+		seenModel = body.Model
+		require.Equal(t, "Bearer team-key", r.Header.Get("Authorization"))
+		okChatUpstream(w, r)
+	}, func(cfg *Config) {
+		p := t.TempDir() + "/routes.yaml"
+		require.NoError(t, os.WriteFile(p, []byte(`
+upstreams:
+  - {name: team, provider: openai, base_url: "`+cfg.UpstreamBaseURL+`", api_key: team-key}
+routes:
+  - {match: "team/*", upstream: team, strip_prefix: "team/"}
+`), 0o600))
+		cfg.RoutesFile = p
+	})
+
+	rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"team/gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "gpt-4o-mini", seenModel)
+	ev := env.nextEvent(t)
+	require.Equal(t, "team", ev.Upstream)
+
+	rec = env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "model_not_found", decodeOpenAIError(t, rec).Code)
+}
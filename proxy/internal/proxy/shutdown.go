@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// handleReady serves /readyz, which fails once the server is draining so
+// that load balancers stop sending new requests.
+func (s *Server) handleReady(w http.ResponseWriter, _ *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// StartDrain makes /readyz fail. The server keeps serving requests.
+func (s *Server) StartDrain() {
+	s.draining.Store(true)
+}
+
+// Shutdown drains the server once the HTTP server stopped accepting
+// connections (http.Server.Shutdown). It waits for in-flight requests until
+// ctx is done, then ends Realtime sessions, which http.Server.Shutdown does
+// not track. Queued events are then flushed to the collector, or the spool,
+// for up to ShutdownFlushTimeout, and the spool is closed: failed posts are
+// not retried, and posts still running near the deadline are cancelled so
+// that their events are spooled. The Server cannot be used afterwards.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.StartDrain()
+
+	requestsDone := make(chan struct{})
+	go func() {
+		s.requests.Wait()
+		close(requestsDone)
+	}()
+	select {
+	case <-requestsDone:
+	case <-ctx.Done():
+		log.Printf("shutdown: grace period over; closing Realtime sessions")
+		close(s.closing)
+		select {
+		case <-requestsDone:
+		case <-time.After(s.cfg.ShutdownFlushTimeout):
+			log.Printf("shutdown: requests still running; their events may be lost")
+		}
+	}
+
+	sendersDone := make(chan struct{})
+	go func() {
+		s.senders.Wait()
+		close(sendersDone)
+	}()
+	close(s.stop)
+	// leave a tenth of the flush timeout to spool what was not delivered
+	cancelPosts := time.AfterFunc(s.cfg.ShutdownFlushTimeout-s.cfg.ShutdownFlushTimeout/10, s.cancelDelivery)
+	defer cancelPosts.Stop()
+	defer s.cancelDelivery()
+	select {
+	case <-sendersDone:
+	case <-time.After(s.cfg.ShutdownFlushTimeout):
+		log.Printf("shutdown: event flush timed out; events still in flight are lost")
+	}
+
+	if s.spool != nil {
+		if err := s.spool.Close(); err != nil {
+			log.Printf("shutdown: closing spool: %v", err)
+		}
+	}
+}
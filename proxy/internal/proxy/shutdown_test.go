@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown_FlushesQueuedEvents(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.EventBatchSize = 100
+		cfg.EventBatchMaxAge = time.Hour
+	})
+	mux := env.srv.Mux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	for i := 0; i < 2; i++ {
+		env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	}
+	select {
+	case <-env.events:
+		t.Fatal("batch was sent before it was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	env.srv.Shutdown(context.Background())
+	require.Equal(t, "gpt-4o-mini", env.nextEvent(t).Model)
+	require.Equal(t, "gpt-4o-mini", env.nextEvent(t).Model)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestShutdown_SpoolsEventsTheCollectorDoesNotTake(t *testing.T) {
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	dir := t.TempDir()
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = hanging.URL + "/events"
+		cfg.CollectorTimeout = 5 * time.Second
+		cfg.EventBatchMaxAttempts = 3
+		cfg.ShutdownFlushTimeout = 500 * time.Millisecond
+		cfg.EventSpoolDir = dir
+		cfg.EventSpoolMaxBytes = 1 << 20
+		cfg.EventSpoolSegmentBytes = 1 << 20
+		cfg.EventSpoolFsync = SpoolFsyncNever
+	})
+	for i := 0; i < 2; i++ {
+		rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	start := time.Now()
+	env.srv.Shutdown(context.Background())
+	require.Less(t, time.Since(start), time.Second)
+
+	sp, err := OpenSpool(dir, testSpoolOptions())
+	require.NoError(t, err)
+	defer sp.Close()
+	for _, rec := range drainSpool(t, sp, 2) {
+		require.Contains(t, rec, `"model":"gpt-4o-mini"`)
+	}
+}
+
+func TestShutdown_WaitsForRequestsThenClosesRealtime(t *testing.T) {
+	release := make(chan struct{})
+	realtime := realtimeMock(t)
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/realtime" {
+			realtime(w, r)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-release
+		okChatUpstream(w, r)
+	}, nil)
+	gw := httptest.NewServer(env.srv.Mux())
+	defer gw.Close()
+
+	conn, _, err := dialRealtime(t, gw, http.Header{"Authorization": {"Bearer dummy"}, "Openai-Beta": {"realtime=v1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), "session.created")
+
+	chat := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, gw.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini"}`))
+		req.Header.Set("Authorization", "Bearer dummy")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			chat <- 0
+			return
+		}
+		resp.Body.Close()
+		chat <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(t, env), "llm_proxy_in_flight_requests 2")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		env.srv.Shutdown(ctx)
+		close(done)
+	}()
+
+	// the chat request finishes within the grace period
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.Equal(t, http.StatusOK, <-chat)
+
+	// the Realtime session is closed once the grace period is over
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+	<-done
+
+	var final MeteringEvent
+	for i := 0; i < 2; i++ {
+		if ev := env.nextEvent(t); ev.Endpoint == "/v1/realtime" {
+			final = ev
+		}
+	}
+	require.True(t, final.Final)
+	require.Empty(t, final.ErrorClass)
+}
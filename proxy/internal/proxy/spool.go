@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Spool fsync policies.
+const (
+	SpoolFsyncAlways   = "always"
+	SpoolFsyncInterval = "interval"
+	SpoolFsyncNever    = "never"
+)
+
+// ErrSpoolFull is returned by Append when the spool reached its size cap.
+var ErrSpoolFull = errors.New("event spool is full")
+
+var errSpoolClosed = errors.New("event spool is closed")
+
+const (
+	spoolSegmentExt  = ".ndjson"
+	spoolCursorFile  = "cursor"
+	spoolCursorTemp  = "cursor.tmp"
+	spoolSegmentName = "%020d" + spoolSegmentExt
+)
+
+// SpoolOptions bounds a Spool. MaxBytes caps the disk space of all segments;
+// a new segment is started once the current one reaches SegmentBytes.
+type SpoolOptions struct {
+	MaxBytes     int64
+	SegmentBytes int64
+	Fsync        string
+}
+
+// Spool is an on-disk FIFO of metering events. Records are appended as
+// NDJSON lines to numbered segment files and read back in order; a segment
+// is deleted once every record in it was acknowledged. The read position
+// is saved in a cursor file on Sync, so a restart replays at most the
+// records acknowledged since the last Sync.
+type Spool struct {
+	dir  string
+	opts SpoolOptions
+
+	mu       sync.Mutex
+	segments []spoolSegment // oldest first
+	nextID   uint64
+	w        *os.File // last segment while it is written to
+	r        *bufio.Reader
+	rf       *os.File
+	rOff     int64   // offset of the next record in segments[0]
+	peeked   []int64 // lengths of the records returned by Next
+	bytes    int64
+	unsynced bool
+	moved    bool // rOff changed since the cursor was saved
+	closed   bool
+
+	appended chan struct{}
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+// OpenSpool opens or creates the spool in dir. Existing segments are kept
+// for replay; appends always start a new segment.
+func OpenSpool(dir string, opts SpoolOptions) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	sp := &Spool{dir: dir, opts: opts, appended: make(chan struct{}, 1)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		sp.segments = append(sp.segments, spoolSegment{id: id, size: info.Size()})
+	}
+	sort.Slice(sp.segments, func(i, j int) bool { return sp.segments[i].id < sp.segments[j].id })
+
+	id, off, err := sp.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	// segments before the cursor were fully acknowledged
+	for len(sp.segments) > 0 && sp.segments[0].id < id {
+		if err := os.Remove(sp.segmentPath(sp.segments[0].id)); err != nil {
+			return nil, err
+		}
+		sp.segments = sp.segments[1:]
+	}
+	if len(sp.segments) > 0 && sp.segments[0].id == id {
+		sp.rOff = min(off, sp.segments[0].size)
+	}
+	// segment IDs never go back, or a stale cursor could skip new segments
+	sp.nextID = id + 1
+	for _, seg := range sp.segments {
+		sp.bytes += seg.size
+		sp.nextID = max(sp.nextID, seg.id+1)
+	}
+	return sp, nil
+}
+
+func (sp *Spool) segmentPath(id uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf(spoolSegmentName, id))
+}
+
+func (sp *Spool) readCursor() (uint64, int64, error) {
+	b, err := os.ReadFile(filepath.Join(sp.dir, spoolCursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var id uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &id, &off); err != nil {
+		log.Printf("spool: ignoring invalid cursor file %q", b)
+		return 0, 0, nil
+	}
+	return id, off, nil
+}
+
+// Append adds one record, which must not contain a newline.
+func (sp *Spool) Append(rec []byte) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.closed {
+		return errSpoolClosed
+	}
+	n := int64(len(rec)) + 1
+	if sp.bytes+n > sp.opts.MaxBytes {
+		return ErrSpoolFull
+	}
+	if sp.w == nil || sp.segments[len(sp.segments)-1].size >= sp.opts.SegmentBytes {
+		if err := sp.rotate(); err != nil {
+			return err
+		}
+	}
+	line := make([]byte, 0, n)
+	line = append(append(line, rec...), '\n')
+	written, err := sp.w.Write(line)
+	sp.segments[len(sp.segments)-1].size += int64(written)
+	sp.bytes += int64(written)
+	if err != nil {
+		// continue in a new segment after a possibly torn record
+		_ = sp.w.Close()
+		sp.w = nil
+		return err
+	}
+	switch sp.opts.Fsync {
+	case SpoolFsyncAlways:
+		if err := sp.w.Sync(); err != nil {
+			return err
+		}
+	case SpoolFsyncInterval:
+		sp.unsynced = true
+	}
+
+	select {
+	case sp.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate closes the segment being written and starts the next one.
+func (sp *Spool) rotate() error {
+	if sp.w != nil {
+		if sp.opts.Fsync != SpoolFsyncNever {
+			_ = sp.w.Sync()
+		}
+		if err := sp.w.Close(); err != nil {
+			return err
+		}
+		sp.w, sp.unsynced = nil, false
+	}
+	id := sp.nextID
+	f, err := os.OpenFile(sp.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	sp.w = f
+	sp.nextID++
+	sp.segments = append(sp.segments, spoolSegment{id: id})
+	return nil
+}
+
+// Next returns up to n of the oldest unacknowledged records, or io.EOF
+// when the spool is empty. Records come from one segment at a time; repeated
+// calls return the same records until Ack.
+func (sp *Spool) Next(n int) ([][]byte, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.closed {
+		return nil, errSpoolClosed
+	}
+	if len(sp.peeked) > 0 {
+		// read the unacknowledged records again
+		sp.closeReader()
+	}
+	for len(sp.segments) > 0 {
+		seg := sp.segments[0]
+		writing := sp.w != nil && len(sp.segments) == 1
+		if sp.rf == nil {
+			f, err := os.Open(sp.segmentPath(seg.id))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := f.Seek(sp.rOff, io.SeekStart); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			sp.rf, sp.r = f, bufio.NewReader(f)
+		}
+
+		var (
+			recs  [][]byte
+			sizes []int64
+			line  []byte
+			err   error
+		)
+		for len(recs) < n {
+			line, err = sp.r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			sizes = append(sizes, int64(len(line)))
+			recs = append(recs, line[:len(line)-1])
+		}
+		if err != nil {
+			sp.closeReader()
+		}
+		if len(recs) > 0 {
+			sp.peeked = sizes
+			return recs, nil
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+		if writing {
+			// appends write whole lines, so the write segment has no torn tail
+			return nil, io.EOF
+		}
+		if len(line) > 0 {
+			log.Printf("spool: discarding incomplete record at the end of segment %d (%d bytes)", seg.id, len(line))
+		}
+		if err := sp.dropFirst(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// Ack acknowledges the first n records returned by the last Next; the
+// next call to Next returns the others again.
+func (sp *Spool) Ack(n int) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	n = min(n, len(sp.peeked))
+	if n == 0 || len(sp.segments) == 0 {
+		return nil
+	}
+	for _, size := range sp.peeked[:n] {
+		sp.rOff += size
+	}
+	sp.peeked = sp.peeked[n:]
+	sp.moved = true
+	if sp.rOff < sp.segments[0].size {
+		return nil
+	}
+	sp.closeReader()
+	if sp.w != nil && len(sp.segments) == 1 {
+		// caught up with the writer: the next Append starts a new segment
+		_ = sp.w.Close()
+		sp.w, sp.unsynced = nil, false
+	}
+	return sp.dropFirst()
+}
+
+func (sp *Spool) closeReader() {
+	if sp.rf != nil {
+		_ = sp.rf.Close()
+		sp.rf, sp.r = nil, nil
+	}
+	sp.peeked = nil
+}
+
+// dropFirst deletes the oldest segment.
+func (sp *Spool) dropFirst() error {
+	seg := sp.segments[0]
+	sp.segments = sp.segments[1:]
+	sp.bytes -= seg.size
+	sp.rOff = 0
+	sp.moved = true
+	if err := os.Remove(sp.segmentPath(seg.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Sync flushes appended records to disk, unless the fsync policy is
+// SpoolFsyncNever, and saves the read position.
+func (sp *Spool) Sync() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.sync()
+}
+
+func (sp *Spool) sync() error {
+	if sp.unsynced && sp.w != nil {
+		if err := sp.w.Sync(); err != nil {
+			return err
+		}
+		sp.unsynced = false
+	}
+	if !sp.moved {
+		return nil
+	}
+	id := sp.nextID
+	if len(sp.segments) > 0 {
+		id = sp.segments[0].id
+	}
+	tmp := filepath.Join(sp.dir, spoolCursorTemp)
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", id, sp.rOff)), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(sp.dir, spoolCursorFile)); err != nil {
+		return err
+	}
+	sp.moved = false
+	return nil
+}
+
+// Pending reports whether the spool holds unacknowledged records.
+func (sp *Spool) Pending() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.segments) > 0
+}
+
+// Bytes is the disk space used by the spool's segments.
+func (sp *Spool) Bytes() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.bytes
+}
+
+// Appended is signalled after records were appended.
+func (sp *Spool) Appended() <-chan struct{} {
+	return sp.appended
+}
+
+// Close syncs and closes the spool.
+func (sp *Spool) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.closed {
+		return nil
+	}
+	sp.closed = true
+	err := sp.sync()
+	sp.closeReader()
+	if sp.w != nil {
+		if cerr := sp.w.Close(); err == nil {
+			err = cerr
+		}
+		sp.w = nil
+	}
+	return err
+}
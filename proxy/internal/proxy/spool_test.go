@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSpoolOptions() SpoolOptions {
+	return SpoolOptions{MaxBytes: 1 << 20, SegmentBytes: 32, Fsync: SpoolFsyncInterval}
+}
+
+func drainSpool(t *testing.T, sp *Spool, n int) []string {
+	t.Helper()
+	var out []string
+	for len(out) < n {
+		recs, err := sp.Next(n - len(out))
+		require.NoError(t, err)
+		for _, b := range recs {
+			out = append(out, string(b))
+		}
+		require.NoError(t, sp.Ack(len(recs)))
+	}
+	return out
+}
+
+func TestSpool_OrderAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := OpenSpool(dir, testSpoolOptions())
+	require.NoError(t, err)
+	defer sp.Close()
+
+	_, err = sp.Next(1)
+	require.ErrorIs(t, err, io.EOF)
+	require.False(t, sp.Pending())
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		rec := fmt.Sprintf(`{"n":%d,"pad":"xxxxxxxx"}`, i)
+		want = append(want, rec)
+		require.NoError(t, sp.Append([]byte(rec)))
+	}
+	require.True(t, sp.Pending())
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	require.Len(t, segs, 5)
+
+	// Next without Ack returns the same records, from one segment at a time
+	recs, err := sp.Next(10)
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	recs2, err := sp.Next(1)
+	require.NoError(t, err)
+	require.Equal(t, recs[:1], recs2)
+
+	got := drainSpool(t, sp, 5)
+	require.NoError(t, sp.Append([]byte(`{"n":10}`)))
+	want = append(want, `{"n":10}`)
+	got = append(got, drainSpool(t, sp, 6)...)
+	require.Equal(t, want, got)
+
+	_, err = sp.Next(1)
+	require.ErrorIs(t, err, io.EOF)
+	require.False(t, sp.Pending())
+	require.Zero(t, sp.Bytes())
+	segs, _ = filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	require.Empty(t, segs)
+}
+
+func TestSpool_ReopenResumesAtCursor(t *testing.T) {
+	dir := t.TempDir()
+	opts := testSpoolOptions()
+	opts.SegmentBytes = 1 << 10
+	sp, err := OpenSpool(dir, opts)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sp.Append([]byte(fmt.Sprintf(`{"n":%d}`, i))))
+	}
+	require.Equal(t, []string{`{"n":0}`, `{"n":1}`}, drainSpool(t, sp, 2))
+	require.NoError(t, sp.Sync())
+	// acknowledged but not synced before a crash: replayed again
+	drainSpool(t, sp, 1)
+
+	sp, err = OpenSpool(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, sp.Append([]byte(`{"n":5}`)))
+	require.Equal(t, []string{`{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`}, drainSpool(t, sp, 4))
+	_, err = sp.Next(1)
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, sp.Close())
+
+	// a stale cursor must not skip segments created after it
+	sp, err = OpenSpool(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, sp.Append([]byte(`{"n":6}`)))
+	require.NoError(t, sp.Close())
+	sp, err = OpenSpool(dir, opts)
+	require.NoError(t, err)
+	defer sp.Close()
+	require.Equal(t, []string{`{"n":6}`}, drainSpool(t, sp, 1))
+}
+
+func TestSpool_PartialAck(t *testing.T) {
+	opts := testSpoolOptions()
+	opts.SegmentBytes = 1 << 10
+	sp, err := OpenSpool(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer sp.Close()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sp.Append([]byte(fmt.Sprintf(`{"n":%d}`, i))))
+	}
+
+	recs, err := sp.Next(3)
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	require.NoError(t, sp.Ack(1))
+	require.Equal(t, []string{`{"n":1}`, `{"n":2}`}, drainSpool(t, sp, 2))
+	require.False(t, sp.Pending())
+}
+
+func TestSpool_TornRecordAndCap(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf(spoolSegmentName, 1)), []byte("{\"n\":0}\n{\"n\":"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf(spoolSegmentName, 2)), []byte("{\"n\":1}\n"), 0o600))
+
+	opts := testSpoolOptions()
+	opts.MaxBytes = 40
+	sp, err := OpenSpool(dir, opts)
+	require.NoError(t, err)
+	defer sp.Close()
+	require.EqualValues(t, 21, sp.Bytes())
+
+	require.NoError(t, sp.Append([]byte(`{"n":2}`)))
+	require.ErrorIs(t, sp.Append([]byte(`{"n":3,"too":"large"}`)), ErrSpoolFull)
+	require.Equal(t, []string{`{"n":0}`, `{"n":1}`, `{"n":2}`}, drainSpool(t, sp, 3))
+	require.Zero(t, sp.Bytes())
+}
+
+func TestServer_SpoolsUntilCollectorRecovers(t *testing.T) {
+	testSpoolReplay(t, SpoolFsyncInterval)
+}
+
+// The replay position is saved even when spooled events are never synced.
+func TestServer_SpoolFsyncNeverSavesCursor(t *testing.T) {
+	testSpoolReplay(t, SpoolFsyncNever)
+}
+
+func testSpoolReplay(t *testing.T, fsync string) {
+	t.Helper()
+	var healthy atomic.Bool
+	events := make(chan MeteringEvent, 16)
+	accept := testCollector(events)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		accept(w, r)
+	}))
+	defer collector.Close()
+
+	dir := t.TempDir()
+	env := newTestEnv(t, okChatUpstream, func(cfg *Config) {
+		cfg.CollectorURL = collector.URL + "/events"
+		cfg.EventSpoolDir = dir
+		cfg.EventSpoolMaxBytes = 1 << 20
+		cfg.EventSpoolSegmentBytes = 1 << 20
+		cfg.EventSpoolFsync = fsync
+		cfg.EventSpoolFsyncInterval = 10 * time.Millisecond
+	})
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		rec := env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		ids = append(ids, rec.Header().Get("X-LLM-Request-ID"))
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(t, env), "llm_proxy_events_spooled_total 3")
+	}, 2*time.Second, 10*time.Millisecond)
+	segs, err := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	require.NoError(t, err)
+	require.NotEmpty(t, segs)
+
+	healthy.Store(true)
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-events:
+			got = append(got, ev.RequestID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("spooled event was not replayed")
+		}
+	}
+	// concurrent senders may spool events out of order
+	require.ElementsMatch(t, ids, got)
+	require.Eventually(t, func() bool { return !env.srv.spool.Pending() }, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, spoolCursorFile))
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
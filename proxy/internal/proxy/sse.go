@@ -7,56 +7,253 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 )
 
-func StreamSSE(w http.ResponseWriter, upstream io.Reader) (string, *Usage, error) {
-	br := bufio.NewReaderSize(upstream, 32*1024)
+// StreamSSE relays a chat or legacy completions stream and returns the
+// model and usage seen; content chunks and in-stream errors are recorded
+// in stats.
+func StreamSSE(w http.ResponseWriter, upstream io.Reader, stats *StreamStats) (string, *Usage, error) {
+	return streamChatSSE(w, upstream, false, nil, stats)
+}
 
+// streamChatSSE relays a chat completions stream and returns the model and
+// usage seen. With stripUsage, the usage-only chunk (empty choices) is not
+// relayed; it is the chunk the gateway asked for with include_usage. The
+// text of the deltas is added to completion unless it is nil.
+func streamChatSSE(w http.ResponseWriter, upstream io.Reader, stripUsage bool, completion *strings.Builder, stats *StreamStats) (string, *Usage, error) {
 	var model string
 	var usage *Usage
 
+	err := relaySSE(w, upstream, func(ev *sseEvent) sseAction {
+		payload := bytes.TrimSpace(ev.data)
+		if bytes.Equal(payload, []byte("[DONE]")) {
+			return sseStop
+		}
+		var ch StreamChunk
+		if len(payload) == 0 || payload[0] != '{' || json.Unmarshal(payload, &ch) != nil {
+			if ev.name == "error" {
+				stats.upstreamError(ErrorClassUpstreamError)
+			}
+			return sseRelay
+		}
+		if ch.Error != nil || ev.name == "error" {
+			stats.upstreamError(ch.Error.class())
+		}
+		if ch.Model != "" {
+			model = ch.Model
+		}
+		if hasOutput(ch.Choices) {
+			stats.contentChunk()
+		}
+		if completion != nil {
+			appendDeltaText(completion, ch.Choices)
+		}
+		if ch.Usage != nil {
+			usage = ch.Usage
+			if stripUsage && len(ch.Choices) == 0 {
+				return sseDrop
+			}
+		}
+		return sseRelay
+	})
+	stats.finish()
+	return model, usage, err
+}
+
+// sseAction tells relaySSE what to do with an event.
+type sseAction int
+
+const (
+	sseRelay sseAction = iota
+	// sseStop relays the event and ends the stream.
+	sseStop
+	// sseDrop leaves out the event.
+	sseDrop
+)
+
+// relaySSE copies an SSE stream event by event, flushing after each, and
+// calls onEvent with every event carrying data before relaying it. Events
+// are relayed byte for byte; comments and blank lines go through as well.
+// It stops when onEvent returns sseStop or the stream ends.
+func relaySSE(w http.ResponseWriter, upstream io.Reader, onEvent func(ev *sseEvent) sseAction) error {
+	r := newSSEReader(upstream)
+
 	var fl http.Flusher
 	if f, ok := w.(http.Flusher); ok {
 		fl = f
 	}
 
 	for {
-		line, err := br.ReadBytes('\n')
+		ev, err := r.next()
 
-		if len(line) > 0 {
-			if _, werr := w.Write(line); werr != nil {
-				return model, usage, werr
+		action := sseRelay
+		if ev.hasData {
+			action = onEvent(&ev)
+		}
+		if action != sseDrop && len(ev.raw) > 0 {
+			if _, werr := w.Write(ev.raw); werr != nil {
+				return werr
 			}
 			if fl != nil {
 				fl.Flush()
 			}
+		}
+		if action == sseStop {
+			return nil
+		}
 
-			trim := bytes.TrimSpace(line)
-			if bytes.HasPrefix(trim, []byte("data:")) {
-				payload := bytes.TrimSpace(bytes.TrimPrefix(trim, []byte("data:")))
-
-				if bytes.Equal(payload, []byte("[DONE]")) {
-					return model, usage, nil
-				}
-				if len(payload) > 0 && payload[0] == '{' {
-					var ch StreamChunk
-					if jsonErr := json.Unmarshal(payload, &ch); jsonErr == nil {
-						if ch.Model != "" {
-							model = ch.Model
-						}
-						if ch.Usage != nil {
-							usage = ch.Usage
-						}
-					}
-				}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
 			}
+			return err
+		}
+	}
+}
+
+// sseEvent is an event of a text/event-stream as the HTML standard defines
+// it: the lines up to a blank line. Multi-line data fields are joined with
+// "\n". raw holds the bytes the event was read from, comments and line
+// endings included, so that it can be relayed unchanged. data and raw are
+// only valid until the next event is read.
+type sseEvent struct {
+	name    string
+	data    []byte
+	id      string
+	hasData bool
+	raw     []byte
+}
+
+// field applies a line of the event. Lines starting with a colon are
+// comments; retry and unknown fields are ignored.
+func (ev *sseEvent) field(line []byte) {
+	if len(line) == 0 || line[0] == ':' {
+		return
+	}
+	name, value, found := bytes.Cut(line, []byte(":"))
+	if found {
+		value = bytes.TrimPrefix(value, []byte(" "))
+	}
+	switch string(name) {
+	case "event":
+		ev.name = string(value)
+	case "data":
+		if ev.hasData {
+			ev.data = append(ev.data, '\n')
 		}
+		ev.data = append(ev.data, value...)
+		ev.hasData = true
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 {
+			ev.id = string(value)
+		}
+	}
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Limits of a single SSE line and event (all its lines), so that an upstream
+// cannot make the gateway buffer without bound. Responses API events carry
+// whole responses and base64 images, hence the generous sizes.
+const (
+	sseMaxLineBytes  = 16 << 20
+	sseMaxEventBytes = 32 << 20
+)
+
+// errSSETooLarge ends a stream with a line or event over the limits.
+var errSSETooLarge = errors.New("upstream stream event exceeds the size limit")
+
+// sseReader splits a stream into events. Lines may end in CRLF, LF or CR,
+// also when the terminator is split across reads, and a leading UTF-8 BOM
+// is skipped.
+type sseReader struct {
+	br      *bufio.Reader
+	raw     []byte
+	line    []byte
+	data    []byte
+	started bool
+	// skipLF is set after a CR; a LF right after it ends the same line.
+	skipLF bool
 
+	maxLine, maxEvent int
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{br: bufio.NewReaderSize(r, 32*1024), maxLine: sseMaxLineBytes, maxEvent: sseMaxEventBytes}
+}
+
+// next reads the next event. When the stream ends, the lines read since
+// the last event are returned with the error (io.EOF at a clean end). Such
+// an unterminated event is not dispatched by clients, but it is still
+// reported with hasData so usage sent just before a cut is not lost. An
+// event over the limits is not returned; the error is errSSETooLarge.
+func (r *sseReader) next() (sseEvent, error) {
+	r.raw = r.raw[:0]
+	ev := sseEvent{data: r.data[:0]}
+	if !r.started {
+		r.started = true
+		if b, _ := r.br.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+			r.consume(len(utf8BOM))
+		}
+	}
+	for {
+		line, err := r.readLine()
+		if errors.Is(err, errSSETooLarge) {
+			return sseEvent{}, err
+		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return model, usage, nil
+			ev.field(line)
+			ev.raw, r.data = r.raw, ev.data
+			return ev, err
+		}
+		if len(line) == 0 {
+			ev.raw, r.data = r.raw, ev.data
+			return ev, nil
+		}
+		ev.field(line)
+	}
+}
+
+// readLine returns the next line without its terminator. err is set when
+// the stream ended before a terminator; line then holds what was read.
+func (r *sseReader) readLine() ([]byte, error) {
+	r.line = r.line[:0]
+	for {
+		buf, err := r.br.Peek(max(r.br.Buffered(), 1))
+		if len(buf) == 0 {
+			return r.line, err
+		}
+		if r.skipLF {
+			r.skipLF = false
+			if buf[0] == '\n' {
+				r.consume(1)
+				continue
 			}
-			return model, usage, err
 		}
+		i := bytes.IndexAny(buf, "\r\n")
+		n := i
+		if i < 0 {
+			n = len(buf)
+		}
+		if len(r.line)+n > r.maxLine || len(r.raw)+n > r.maxEvent {
+			return nil, errSSETooLarge
+		}
+		if i < 0 {
+			r.line = append(r.line, buf...)
+			r.consume(len(buf))
+			continue
+		}
+		r.line = append(r.line, buf[:i]...)
+		r.skipLF = buf[i] == '\r'
+		r.consume(i + 1)
+		return r.line, nil
 	}
 }
+
+// consume moves n peeked bytes to raw.
+func (r *sseReader) consume(n int) {
+	b, _ := r.br.Peek(n)
+	r.raw = append(r.raw, b...)
+	_, _ = r.br.Discard(n)
+}
@@ -2,8 +2,13 @@ package proxy
 
 import (
 	"bytes"
+	"io"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -16,7 +21,7 @@ data: [DONE]
 `
 	rec := httptest.NewRecorder()
 
-	model, usage, err := StreamSSE(rec, bytes.NewBufferString(input))
+	model, usage, err := StreamSSE(rec, bytes.NewBufferString(input), nil)
 	require.NoError(t, err)
 	require.Equal(t, "gpt-4", model)
 	require.NotNil(t, usage)
@@ -32,8 +37,253 @@ data: [DONE]
 `
 	rec := httptest.NewRecorder()
 
-	model, usage, err := StreamSSE(rec, bytes.NewBufferString(input))
+	model, usage, err := StreamSSE(rec, bytes.NewBufferString(input), nil)
 	require.NoError(t, err)
 	require.Equal(t, "gpt-3.5", model)
 	require.Nil(t, usage)
 }
+
+func TestStreamSSE_StripsUsageChunk(t *testing.T) {
+	input := "data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+		"data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":1,\"total_tokens\":6}}\n\n" +
+		"data: [DONE]\n\n"
+	rec := httptest.NewRecorder()
+
+	model, usage, err := streamChatSSE(rec, bytes.NewBufferString(input), true, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gpt-4o", model)
+	require.Equal(t, 6, usage.TotalTokens)
+	require.Equal(t, "data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\ndata: [DONE]\n\n", rec.Body.String())
+}
+
+func TestStreamSSE_StreamStats(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, ev := range []string{
+			`{"model":"gpt-4o","choices":[{"delta":{"role":"assistant","content":""}}]}`,
+			`{"model":"gpt-4o","choices":[{"delta":{"content":"Hel"}}]}`,
+			`{"model":"gpt-4o","choices":[{"delta":{"content":"lo"}}]}`,
+			`{"model":"gpt-4o","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{}"}}]}}]}`,
+			`{"model":"gpt-4o","choices":[{"delta":{},"finish_reason":"stop"}]}`,
+			`[DONE]`,
+		} {
+			time.Sleep(5 * time.Millisecond)
+			_, _ = io.WriteString(pw, "data: "+ev+"\n\n")
+		}
+		_ = pw.Close()
+	}()
+
+	start := time.Now()
+	stats := newStreamStats()
+	_, _, err := StreamSSE(httptest.NewRecorder(), pr, stats)
+	require.NoError(t, err)
+
+	var ev MeteringEvent
+	stats.apply(&ev, start.Add(-time.Second))
+	require.Equal(t, 3, ev.ChunkCount)
+	require.GreaterOrEqual(t, ev.TTFTMs, int64(1010))
+	require.GreaterOrEqual(t, ev.StreamDurationMs, int64(30))
+	require.GreaterOrEqual(t, ev.ChunkGapMeanMs, 4.0)
+	require.GreaterOrEqual(t, ev.ChunkGapP95Ms, ev.ChunkGapMeanMs)
+}
+
+func TestStreamStats_GapStats(t *testing.T) {
+	st := &StreamStats{chunks: 21}
+	for i := 1; i <= 20; i++ {
+		st.addGap(time.Duration(21-i)*time.Millisecond + 250*time.Microsecond)
+	}
+	mean, p95 := st.gapStats()
+	require.Equal(t, 10.75, mean)
+	require.Equal(t, 20.25, p95) // the 25ms bucket, capped by the longest gap
+	require.Len(t, st.gaps, len(gapBuckets)+1)
+
+	st = &StreamStats{chunks: 21}
+	for i := 1; i <= 19; i++ {
+		st.addGap(3 * time.Millisecond)
+	}
+	st.addGap(time.Second)
+	mean, p95 = st.gapStats()
+	require.Equal(t, 52.85, mean)
+	require.Equal(t, 5.0, p95)
+
+	st = &StreamStats{chunks: 2}
+	st.addGap(4 * time.Second)
+	mean, p95 = st.gapStats()
+	require.Equal(t, 4000.0, mean)
+	require.Equal(t, 4000.0, p95)
+
+	// nil stats record nothing
+	var none *StreamStats
+	none.contentChunk()
+	none.finish()
+	ev := MeteringEvent{}
+	none.apply(&ev, time.Now())
+	require.Zero(t, ev)
+}
+
+type testSSEEvent struct {
+	Name, Data, ID string
+}
+
+// readSSEEvents reads every event of r and the raw bytes they came from.
+func readSSEEvents(t *testing.T, r io.Reader) ([]testSSEEvent, string) {
+	t.Helper()
+	sr := newSSEReader(r)
+	var events []testSSEEvent
+	var raw strings.Builder
+	for {
+		ev, err := sr.next()
+		raw.Write(ev.raw)
+		if ev.hasData {
+			events = append(events, testSSEEvent{ev.name, string(ev.data), ev.id})
+		}
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			return events, raw.String()
+		}
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	for name, tc := range map[string]struct {
+		in   string
+		want []testSSEEvent
+	}{
+		"multi-line data": {"data: {\"a\":\ndata:1}\n\n", []testSSEEvent{{Data: "{\"a\":\n1}"}}},
+		"crlf":            {"event: delta\r\ndata: x\r\nid: 7\r\n\r\ndata: y\r\n\r\n", []testSSEEvent{{"delta", "x", "7"}, {Data: "y"}}},
+		"cr":              {"data: x\rdata: y\r\rdata: z\r\r", []testSSEEvent{{Data: "x\ny"}, {Data: "z"}}},
+		"comments":        {": keep-alive\n\n:\ndata: x\n: inline\n\n", []testSSEEvent{{Data: "x"}}},
+		"no colon":        {"data\n\nevent\ndata:x\n\n", []testSSEEvent{{Data: ""}, {Data: "x"}}},
+		"one space":       {"data:  x \n\n", []testSSEEvent{{Data: " x "}}},
+		"bom":             {"\xef\xbb\xbfdata: x\n\n", []testSSEEvent{{Data: "x"}}},
+		"ignored fields":  {"retry: 10\nfoo: bar\nid: a\x00b\ndata: x\n\n", []testSSEEvent{{Data: "x"}}},
+		"no data":         {"event: ping\n\nid: 1\n\n", nil},
+		"unterminated":    {"data: x\n\ndata: {\"usage\"", []testSSEEvent{{Data: "x"}, {Data: "{\"usage\""}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, raw := readSSEEvents(t, strings.NewReader(tc.in))
+			require.Equal(t, tc.want, got)
+			require.Equal(t, tc.in, raw)
+
+			// one byte at a time, splitting every CRLF
+			got, raw = readSSEEvents(t, iotest.OneByteReader(strings.NewReader(tc.in)))
+			require.Equal(t, tc.want, got)
+			require.Equal(t, tc.in, raw)
+		})
+	}
+}
+
+func TestSSEReader_Limits(t *testing.T) {
+	for name, in := range map[string]string{
+		"line":  "data: 0123456789abcdef\n\n",
+		"event": "data: 0123456789\ndata: 0123456789\ndata: 0123456789\n\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			sr := newSSEReader(strings.NewReader("data: ok\n\n" + in + "data: after\n\n"))
+			sr.maxLine, sr.maxEvent = 16, 40
+
+			ev, err := sr.next()
+			require.NoError(t, err)
+			require.Equal(t, "ok", string(ev.data))
+			ev, err = sr.next()
+			require.ErrorIs(t, err, errSSETooLarge)
+			require.False(t, ev.hasData)
+			require.Empty(t, ev.raw)
+		})
+	}
+}
+
+func TestStreamSSE_EventTooLarge(t *testing.T) {
+	chunk := "data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	huge := "data: " + strings.Repeat("x", sseMaxLineBytes) + "\n\n"
+	rec := httptest.NewRecorder()
+	_, _, err := StreamSSE(rec, strings.NewReader(chunk+huge+chunk), nil)
+	require.ErrorIs(t, err, errSSETooLarge)
+	require.Equal(t, chunk, rec.Body.String())
+}
+
+func TestStreamSSE_InStreamErrors(t *testing.T) {
+	chunk := "data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	for in, want := range map[string]string{
+		chunk + "data: {\"error\":{\"message\":\"The server had an error\",\"type\":\"server_error\",\"param\":null,\"code\":null}}\n\n": ErrorClassUpstream5xx,
+		chunk + "event: error\ndata: {\"error\":{\"type\":\"invalid_request_error\",\"code\":\"context_length_exceeded\"}}\n\n":          ErrorClassInvalidRequest,
+		chunk + "data: {\"error\":{\"message\":\"slow down\",\"code\":\"rate_limit_exceeded\"}}\n\n":                                     ErrorClassUpstreamRateLimit,
+		chunk + "event: error\ndata: upstream went away\n\n":                                                                             ErrorClassUpstreamError,
+		chunk + "data: [DONE]\n\n": "",
+	} {
+		stats := newStreamStats()
+		rec := httptest.NewRecorder()
+		_, _, err := StreamSSE(rec, strings.NewReader(in), stats)
+		require.NoError(t, err)
+		require.Equal(t, in, rec.Body.String())
+		require.Equal(t, want, stats.errorClass, in)
+	}
+}
+
+// splitReader returns the stream in reads of the sizes in splits, cycled.
+type splitReader struct {
+	b      []byte
+	splits []byte
+	i      int
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := 1
+	if len(r.splits) > 0 {
+		n = int(r.splits[r.i%len(r.splits)])%8 + 1
+		r.i++
+	}
+	n = copy(p, r.b[:min(n, len(r.b))])
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// parseSSE is a straightforward parser of a whole stream, to check
+// sseReader against.
+func parseSSE(b []byte) []testSSEEvent {
+	b = bytes.TrimPrefix(b, utf8BOM)
+	lines := regexp.MustCompile("\r\n|\r|\n").Split(string(b), -1)
+	var events []testSSEEvent
+	var ev sseEvent
+	for i, line := range lines {
+		if line == "" && i < len(lines)-1 {
+			if ev.hasData {
+				events = append(events, testSSEEvent{ev.name, string(ev.data), ev.id})
+			}
+			ev = sseEvent{}
+			continue
+		}
+		ev.field([]byte(line))
+	}
+	if ev.hasData {
+		events = append(events, testSSEEvent{ev.name, string(ev.data), ev.id})
+	}
+	return events
+}
+
+func FuzzSSEReader(f *testing.F) {
+	f.Add([]byte("data: {\"a\":1}\n\ndata: [DONE]\n\n"), []byte{0})
+	f.Add([]byte("event: delta\r\ndata: x\r\ndata: y\r\n\r\n: ping\r\n\r\n"), []byte{1, 3})
+	f.Add([]byte("\xef\xbb\xbfdata: x\rid: 1\r\rdata"), []byte{2, 0, 5})
+	f.Add([]byte("data:\n\n\n\r\n\rdata: z"), []byte{7})
+	f.Fuzz(func(t *testing.T, stream, splits []byte) {
+		got, raw := readSSEEvents(t, &splitReader{b: stream, splits: splits})
+		require.Equal(t, parseSSE(stream), got)
+		require.Equal(t, string(stream), raw)
+	})
+}
+
+func FuzzStreamSSE(f *testing.F) {
+	f.Add([]byte("data: {\"model\":\"m\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: {\"usage\":{\"total_tokens\":3}}\n\ndata: [DONE]\n\ndata: after\n\n"), []byte{3})
+	f.Add([]byte("event: error\r\ndata: {\"error\":{\"code\":\"server_error\"}}\r\n\r\n"), []byte{1})
+	f.Fuzz(func(t *testing.T, stream, splits []byte) {
+		rec := httptest.NewRecorder()
+		_, _, err := StreamSSE(rec, &splitReader{b: stream, splits: splits}, newStreamStats())
+		require.NoError(t, err)
+		// events are relayed unchanged up to [DONE]
+		require.True(t, bytes.HasPrefix(stream, rec.Body.Bytes()))
+	})
+}
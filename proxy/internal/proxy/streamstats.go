@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StreamStats records a streamed response while it is relayed: when the
+// first content chunk arrived, the gaps between content chunks and the
+// first error the upstream sent in the stream. The gaps are kept as a
+// histogram over gapBuckets, so long streams take no more memory. Only chunks carrying output
+// (text, tool calls) count; role announcements, usage chunks and
+// keep-alives do not. A nil *StreamStats records nothing.
+type StreamStats struct {
+	start  time.Time
+	first  time.Time
+	last   time.Time
+	end    time.Time
+	chunks int
+	// gaps counts the gaps per gapBuckets bucket, the last element those
+	// longer than all buckets; gapSum and gapMax complete it.
+	gaps   []int
+	gapSum time.Duration
+	gapMax time.Duration
+	// gapObserver, if set, observes every gap as it occurs.
+	gapObserver prometheus.Observer
+	// errorClass classifies the upstream's in-stream error.
+	errorClass string
+}
+
+// newStreamStats starts timing a stream whose upstream response headers
+// just arrived.
+func newStreamStats() *StreamStats {
+	return &StreamStats{start: time.Now()}
+}
+
+// contentChunk records a chunk carrying output.
+func (st *StreamStats) contentChunk() {
+	if st == nil {
+		return
+	}
+	now := time.Now()
+	if st.chunks == 0 {
+		st.first = now
+	} else {
+		st.addGap(now.Sub(st.last))
+	}
+	st.last = now
+	st.chunks++
+}
+
+func (st *StreamStats) addGap(d time.Duration) {
+	if st.gaps == nil {
+		st.gaps = make([]int, len(gapBuckets)+1)
+	}
+	st.gaps[sort.SearchFloat64s(gapBuckets, d.Seconds())]++
+	st.gapSum += d
+	st.gapMax = max(st.gapMax, d)
+	if st.gapObserver != nil {
+		st.gapObserver.Observe(d.Seconds())
+	}
+}
+
+// upstreamError records the class of an error event of the upstream.
+func (st *StreamStats) upstreamError(class string) {
+	if st != nil && st.errorClass == "" {
+		st.errorClass = class
+	}
+}
+
+// finish marks the end of the stream; later calls are ignored.
+func (st *StreamStats) finish() {
+	if st != nil && st.end.IsZero() {
+		st.end = time.Now()
+	}
+}
+
+// apply adds the timings to ev, and the in-stream error class unless ev
+// already has one. TTFT is measured from start, when the gateway received
+// the request.
+func (st *StreamStats) apply(ev *MeteringEvent, start time.Time) {
+	if st == nil {
+		return
+	}
+	st.finish()
+	if ev.ErrorClass == "" {
+		ev.ErrorClass = st.errorClass
+	}
+	ev.StreamDurationMs = st.end.Sub(st.start).Milliseconds()
+	ev.ChunkCount = st.chunks
+	if st.chunks > 0 {
+		ev.TTFTMs = st.first.Sub(start).Milliseconds()
+	}
+	if st.chunks > 1 {
+		ev.ChunkGapMeanMs, ev.ChunkGapP95Ms = st.gapStats()
+	}
+}
+
+// gapStats returns the mean and the 95th percentile of the gaps between
+// content chunks, in milliseconds. The percentile is the upper bound of the
+// bucket holding the nearest rank, but no more than the longest gap.
+func (st *StreamStats) gapStats() (mean, p95 float64) {
+	n := st.chunks - 1
+	rank := int(math.Ceil(0.95 * float64(n)))
+	p := st.gapMax
+	for i, seen := 0, 0; i < len(gapBuckets); i++ {
+		if seen += st.gaps[i]; seen >= rank {
+			p = min(p, time.Duration(gapBuckets[i]*float64(time.Second)))
+			break
+		}
+	}
+	return roundMs(st.gapSum / time.Duration(n)), roundMs(p)
+}
+
+// roundMs converts d to milliseconds with two decimals.
+func roundMs(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+// hasOutput reports whether a streamed chunk carries completion text or
+// tool calls.
+func hasOutput(choices []chatChunkChoice) bool {
+	for _, c := range choices {
+		if (c.Delta.Content != nil && *c.Delta.Content != "") || len(c.Delta.ToolCalls) > 0 || c.Text != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Token estimation for chat completions the upstream reported no usage for
+// (aborted streams, compatible servers without usage). Messages are counted
+// the way OpenAI documents it for its chat models; images and tool
+// definitions are approximations.
+
+// Values of MeteringEvent.UsageSource.
+const (
+	UsageSourceUpstream  = "upstream"
+	UsageSourceEstimated = "estimated"
+)
+
+const (
+	encodingO200k  = "o200k_base"
+	encodingCl100k = "cl100k_base"
+)
+
+// o200kModelPrefixes are the model families tokenized with o200k_base;
+// every other model, including non-OpenAI ones, is estimated with
+// cl100k_base.
+var o200kModelPrefixes = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+// Per-message overhead of the chat format and the tokens priming the reply.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// Image inputs: low detail costs a flat 85 tokens; other images are assumed
+// to be 1024x1024 at high detail (85 plus 170 per 512px tile).
+const (
+	imageTokensLow  = 85
+	imageTokensHigh = 85 + 4*170
+)
+
+type tokenEncoder struct {
+	once sync.Once
+	enc  *tiktoken.Tiktoken
+}
+
+var (
+	loaderOnce sync.Once
+	encoders   = map[string]*tokenEncoder{encodingO200k: {}, encodingCl100k: {}}
+)
+
+// encodingForModel picks the tokenizer of a model, ignoring any
+// "provider/" prefix.
+func encodingForModel(model string) string {
+	if i := strings.LastIndexByte(model, '/'); i >= 0 {
+		model = model[i+1:]
+	}
+	for _, p := range o200kModelPrefixes {
+		if strings.HasPrefix(model, p) {
+			return encodingO200k
+		}
+	}
+	return encodingCl100k
+}
+
+// countTokens counts the tokens of text; special tokens are counted as
+// text. The encodings are embedded and loaded on first use. Should that
+// fail, four bytes count as a token.
+func countTokens(encoding, text string) int {
+	if text == "" {
+		return 0
+	}
+	te := encoders[encoding]
+	te.once.Do(func() {
+		loaderOnce.Do(func() { tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader()) })
+		enc, err := tiktoken.GetEncoding(encoding)
+		if err != nil {
+			log.Printf("tokenizer: cannot load %s (estimating from length): %v", encoding, err)
+			return
+		}
+		te.enc = enc
+	})
+	if te.enc == nil {
+		return (len(text) + 3) / 4
+	}
+	return len(te.enc.EncodeOrdinary(text))
+}
+
+// estimateChatUsage estimates the usage of a chat completion from the
+// request and the completion text. The result is marked Estimated.
+func estimateChatUsage(model string, oreq *OpenAIRequest, completion string) *Usage {
+	encoding := encodingForModel(model)
+	u := &Usage{Estimated: true}
+	if oreq != nil {
+		u.PromptTokens = estimateChatPromptTokens(encoding, oreq)
+	}
+	u.CompletionTokens = countTokens(encoding, completion)
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+func estimateChatPromptTokens(encoding string, oreq *OpenAIRequest) int {
+	n := tokensPerReply
+	for _, m := range oreq.Messages {
+		n += tokensPerMessage + countTokens(encoding, m.Role)
+		if m.Name != "" {
+			n += tokensPerName + countTokens(encoding, m.Name)
+		}
+		n += estimateContentTokens(encoding, m.Content)
+		for _, tc := range m.ToolCalls {
+			n += tokensPerMessage + countTokens(encoding, tc.Function.Name) + countTokens(encoding, tc.Function.Arguments)
+		}
+	}
+	// tool definitions are counted as their JSON
+	for _, raw := range []json.RawMessage{oreq.Tools, oreq.Functions} {
+		if len(raw) > 0 && string(raw) != "null" {
+			n += countTokens(encoding, string(raw))
+		}
+	}
+	return n
+}
+
+// estimateContentTokens counts a message content: a string or an array of
+// text and image parts. Audio and file parts are not counted.
+func estimateContentTokens(encoding string, content json.RawMessage) int {
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		return countTokens(encoding, s)
+	}
+	var parts []chatContentPart
+	if json.Unmarshal(content, &parts) != nil {
+		return 0
+	}
+	n := 0
+	for _, p := range parts {
+		switch {
+		case p.Type == "text":
+			n += countTokens(encoding, p.Text)
+		case p.Type == "image_url" && p.ImageURL != nil && p.ImageURL.Detail == "low":
+			n += imageTokensLow
+		case p.Type == "image_url":
+			n += imageTokensHigh
+		}
+	}
+	return n
+}
+
+// appendDeltaText adds the text of a streamed chunk's deltas to sb.
+func appendDeltaText(sb *strings.Builder, choices []chatChunkChoice) {
+	for _, c := range choices {
+		if c.Delta.Content != nil {
+			sb.WriteString(*c.Delta.Content)
+		}
+		for _, tc := range c.Delta.ToolCalls {
+			sb.WriteString(tc.Function.Name)
+			sb.WriteString(tc.Function.Arguments)
+		}
+	}
+}
+
+// completionText returns the text of a chat completion response body.
+func completionText(body []byte) string {
+	var cc chatCompletion
+	if json.Unmarshal(body, &cc) != nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, c := range cc.Choices {
+		if c.Message.Content != nil {
+			sb.WriteString(*c.Message.Content)
+		}
+		for _, tc := range c.Message.ToolCalls {
+			sb.WriteString(tc.Function.Name)
+			sb.WriteString(tc.Function.Arguments)
+		}
+	}
+	return sb.String()
+}
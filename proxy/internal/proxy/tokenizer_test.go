@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountTokens(t *testing.T) {
+	require.Equal(t, encodingO200k, encodingForModel("gpt-4o-mini"))
+	require.Equal(t, encodingO200k, encodingForModel("azure/o3-mini"))
+	require.Equal(t, encodingCl100k, encodingForModel("gpt-4-turbo"))
+	require.Equal(t, encodingCl100k, encodingForModel("llama-3.1-70b"))
+
+	require.Equal(t, 6, countTokens(encodingCl100k, "tiktoken is great!"))
+	require.Equal(t, 5, countTokens(encodingCl100k, "こんにちは、世界"))
+	require.Equal(t, 3, countTokens(encodingO200k, "こんにちは、世界"))
+	// special tokens in user text are plain text
+	require.Greater(t, countTokens(encodingCl100k, "<|endoftext|>"), 1)
+	require.Zero(t, countTokens(encodingCl100k, ""))
+}
+
+func TestEstimateChatUsage(t *testing.T) {
+	var oreq OpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model":"gpt-4o","messages":[
+		{"role":"system","content":"tiktoken is great!"},
+		{"role":"user","name":"bob","content":[{"type":"text","text":"tiktoken is great!"},{"type":"image_url","image_url":{"url":"https://x/a.png","detail":"low"}},{"type":"image_url","image_url":{"url":"https://x/b.png"}}]},
+		{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function","function":{"name":"lookup","arguments":"{}"}}]}
+	]}`), &oreq))
+
+	u := estimateChatUsage("gpt-4o", &oreq, "tiktoken is great!")
+	require.True(t, u.Estimated)
+	// reply priming, three messages with their role, the name, two texts,
+	// two images and the tool call
+	want := tokensPerReply + 3*(tokensPerMessage+1) + tokensPerName + 1 + 2*6 +
+		imageTokensLow + imageTokensHigh + tokensPerMessage + countTokens(encodingO200k, "lookup") + countTokens(encodingO200k, "{}")
+	require.Equal(t, want, u.PromptTokens)
+	require.Equal(t, 6, u.CompletionTokens)
+	require.Equal(t, want+6, u.TotalTokens)
+
+	// tool definitions count
+	oreq.Tools = json.RawMessage(`[{"type":"function","function":{"name":"lookup","parameters":{"type":"object"}}}]`)
+	require.Greater(t, estimateChatUsage("gpt-4o", &oreq, "").PromptTokens, want)
+}
+
+func TestChatCompletions_EstimatesMissingUsage(t *testing.T) {
+	env := newTestEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["stream"] == true {
+			// an upstream that ignores include_usage
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: {\"id\":\"1\",\"model\":\"gpt-4o-mini\",\"choices\":[{\"delta\":{\"content\":\"tiktoken \"}}]}\n\n" +
+				"data: {\"id\":\"1\",\"model\":\"gpt-4o-mini\",\"choices\":[{\"delta\":{\"content\":\"is great!\"}}]}\n\n" +
+				"data: [DONE]\n\n"))
+			return
+		}
+		if body["model"] == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"c1","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"tiktoken is great!"}}]}`))
+	}, nil)
+	prompt := `"messages":[{"role":"user","content":"tiktoken is great!"}]`
+	promptTokens := tokensPerReply + tokensPerMessage + 1 + 6
+
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini","stream":true,`+prompt+`}`, nil)
+	ev := env.nextEvent(t)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+	require.Equal(t, promptTokens, ev.PromptTokens)
+	require.Equal(t, 6, ev.CompletionTokens)
+
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini",`+prompt+`}`, nil)
+	ev = env.nextEvent(t)
+	require.Equal(t, UsageSourceEstimated, ev.UsageSource)
+	require.Equal(t, promptTokens+6, ev.TotalTokens)
+
+	// failed requests are not estimated
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"broken",`+prompt+`}`, nil)
+	ev = env.nextEvent(t)
+	require.Empty(t, ev.UsageSource)
+	require.Zero(t, ev.TotalTokens)
+}
+
+func TestChatCompletions_UpstreamUsageSource(t *testing.T) {
+	env := newTestEnv(t, okChatUpstream, nil)
+	env.do(t, "/v1/chat/completions", "dummy", `{"model":"gpt-4o-mini"}`, nil)
+	ev := env.nextEvent(t)
+	require.Equal(t, UsageSourceUpstream, ev.UsageSource)
+	require.Equal(t, 5, ev.TotalTokens)
+}
@@ -1,23 +1,188 @@
 package proxy
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Config struct {
 	ListenAddr        string
 	UpstreamBaseURL   string
 	UpstreamAPIKey    string
+	UpstreamProvider  string
 	CollectorURL      string
 	EventQueueSize    int
 	EventFlushTimeout time.Duration
 	HTTPClientTimeout time.Duration
 
 	MeteringCaptureBytes int
+	// DisableStreamUsageInjection stops the gateway from requesting usage
+	// (stream_options.include_usage) for streamed chat completions.
+	DisableStreamUsageInjection bool
+
+	// Models starting with one of AnthropicModelPrefixes are sent to the
+	// Anthropic Messages API when AnthropicAPIKey is set.
+	AnthropicBaseURL       string
+	AnthropicAPIKey        string
+	AnthropicModelPrefixes []string
+
+	// RoutesFile replaces the single upstream above with a routing table
+	// of named upstreams (see RoutesFile).
+	RoutesFile string
+	// UpstreamMaxAttempts is the default number of attempts per upstream
+	// for retryable failures (1 disables retries).
+	UpstreamMaxAttempts int
+
+	// RateLimitsFile enables per key, tenant and model rate limits; it is
+	// re-read every RateLimitsReloadInterval when it changes.
+	RateLimitsFile           string
+	RateLimitsReloadInterval time.Duration
+
+	// KeysFile lists the gateway keys. Without it any bearer token is
+	// accepted, which OpenMode must allow explicitly.
+	KeysFile string
+	OpenMode bool
+	// KeyHMACSecret keys the fingerprint used as app_key_id when a request
+	// is not matched to a configured key ID.
+	KeyHMACSecret string
+	// AppKeyCompat also fills the legacy app_key field with the key
+	// identifier while consumers migrate to app_key_id.
+	AppKeyCompat bool
+
+	// MetricsTenants are tenants reported under their own name in the
+	// metrics besides those of the key store; others are "other".
+	MetricsTenants []string
+	// MetricsModels are models reported under their own name in the
+	// metrics besides those of the routes, price catalog and key store;
+	// others are "other".
+	MetricsModels []string
+
+	// PriceCatalogFile enables cost_usd on metering events.
+	PriceCatalogFile string
+
+	// Request bodies larger than RequestMemoryBufferBytes are buffered in a
+	// temporary file; embeddings bodies may be up to EmbeddingsMaxBodyBytes.
+	// Chat completion bodies are decoded and kept in memory, up to
+	// ChatMaxBodyBytes.
+	RequestMemoryBufferBytes int64
+	EmbeddingsMaxBodyBytes   int64
+	ChatMaxBodyBytes         int64
+
+	// AllowedPaths are the API paths keys without allowed_paths (and every
+	// caller in open mode) may reach. PassthroughMaxBodyBytes bounds request
+	// bodies of the generic /v1/* forwarder.
+	AllowedPaths            []string
+	PassthroughMaxBodyBytes int64
+
+	// RealtimeMeteringInterval is how often usage of open Realtime sessions
+	// is metered; 0 meters only when the session ends.
+	RealtimeMeteringInterval time.Duration
+	// RealtimeAllowedOrigins are the browser origins that may open Realtime
+	// sessions with the gateway key in the WebSocket subprotocol.
+	RealtimeAllowedOrigins []string
+
+	// Events are posted to CollectorBatchURL as gzip-compressed NDJSON
+	// batches of up to EventBatchSize events, sent at the latest when the
+	// oldest is EventBatchMaxAge old. EventSenderWorkers post batches
+	// concurrently, with up to EventBatchMaxAttempts attempts each.
+	CollectorBatchURL     string
+	CollectorTimeout      time.Duration
+	EventBatchSize        int
+	EventBatchMaxAge      time.Duration
+	EventSenderWorkers    int
+	EventBatchMaxAttempts int
+
+	// On shutdown /readyz fails for ShutdownReadinessDelay before the
+	// listener closes; in-flight requests and Realtime sessions then get
+	// ShutdownGracePeriod, and queued events ShutdownFlushTimeout.
+	ShutdownReadinessDelay time.Duration
+	ShutdownGracePeriod    time.Duration
+	ShutdownFlushTimeout   time.Duration
+
+	// EventSpoolDir enables the on-disk spool for events the collector did
+	// not accept or the queue had no room for (see Spool).
+	EventSpoolDir           string
+	EventSpoolMaxBytes      int64
+	EventSpoolSegmentBytes  int64
+	EventSpoolFsync         string
+	EventSpoolFsyncInterval time.Duration
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+	// Estimated is set when the gateway counted the tokens itself.
+	Estimated bool `json:"-"`
+}
+
+// PromptTokensDetails breaks down PromptTokens; cached and audio tokens are
+// included in PromptTokens.
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+	AudioTokens  int `json:"audio_tokens,omitempty"`
+}
+
+// CompletionTokensDetails breaks down CompletionTokens; reasoning and audio
+// tokens are included in CompletionTokens.
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+	AudioTokens     int `json:"audio_tokens,omitempty"`
+}
+
+func (u *Usage) CachedTokens() int {
+	if u == nil || u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
+}
+
+func (u *Usage) ReasoningTokens() int {
+	if u == nil || u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.ReasoningTokens
+}
+
+func (u *Usage) InputAudioTokens() int {
+	if u == nil || u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.AudioTokens
+}
+
+func (u *Usage) OutputAudioTokens() int {
+	if u == nil || u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.AudioTokens
+}
+
+// add sums o into u, details included.
+func (u *Usage) add(o *Usage) {
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.TotalTokens += o.TotalTokens
+	if o.PromptTokensDetails != nil {
+		d := PromptTokensDetails{}
+		if u.PromptTokensDetails != nil {
+			d = *u.PromptTokensDetails
+		}
+		d.CachedTokens += o.PromptTokensDetails.CachedTokens
+		d.AudioTokens += o.PromptTokensDetails.AudioTokens
+		u.PromptTokensDetails = &d
+	}
+	if o.CompletionTokensDetails != nil {
+		d := CompletionTokensDetails{}
+		if u.CompletionTokensDetails != nil {
+			d = *u.CompletionTokensDetails
+		}
+		d.ReasoningTokens += o.CompletionTokensDetails.ReasoningTokens
+		d.AudioTokens += o.CompletionTokensDetails.AudioTokens
+		u.CompletionTokensDetails = &d
+	}
 }
 
 type OpenAIResponse struct {
@@ -27,27 +192,98 @@ type OpenAIResponse struct {
 }
 
 type OpenAIRequest struct {
-	Model    string `json:"model"`
-	Stream   bool   `json:"stream"`
-	Messages any    `json:"messages"`
+	Model         string          `json:"model"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *StreamOptions  `json:"stream_options,omitempty"`
+	Messages      []chatMessage   `json:"messages"`
+	Tools         json.RawMessage `json:"tools,omitempty"`
+	Functions     json.RawMessage `json:"functions,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// IncludesUsage reports whether the client asked for the usage chunk of a
+// streamed completion.
+func (o *OpenAIRequest) IncludesUsage() bool {
+	return o.StreamOptions != nil && o.StreamOptions.IncludeUsage
 }
 
 type MeteringEvent struct {
-	RequestID        string    `json:"request_id"`
-	Tenant           string    `json:"tenant"`
-	AppKey           string    `json:"app_key"`
-	Provider         string    `json:"provider"`
-	Model            string    `json:"model"`
-	PromptTokens     int       `json:"prompt_tokens"`
-	CompletionTokens int       `json:"completion_tokens"`
-	TotalTokens      int       `json:"total_tokens"`
-	LatencyMs        int64     `json:"latency_ms"`
-	StatusCode       int       `json:"status_code"`
-	At               time.Time `json:"ts"`
+	RequestID        string `json:"request_id"`
+	Tenant           string `json:"tenant"`
+	AppKey           string `json:"app_key,omitempty"`
+	AppKeyID         string `json:"app_key_id"`
+	Endpoint         string `json:"endpoint,omitempty"`
+	Provider         string `json:"provider"`
+	Upstream         string `json:"upstream,omitempty"`
+	Model            string `json:"model"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	CachedTokens     int    `json:"cached_tokens,omitempty"`
+	ReasoningTokens  int    `json:"reasoning_tokens,omitempty"`
+	// UsageSource is UsageSourceUpstream when the token counts were reported
+	// by the upstream, UsageSourceEstimated when the gateway counted them.
+	UsageSource string `json:"usage_source,omitempty"`
+	// Audio tokens are included in the prompt and completion tokens.
+	InputAudioTokens  int `json:"input_audio_tokens,omitempty"`
+	OutputAudioTokens int `json:"output_audio_tokens,omitempty"`
+	// InputCount is the number of inputs of embeddings and moderations
+	// requests; ImageCount the number of images generated.
+	InputCount          int `json:"input_count,omitempty"`
+	EmbeddingDimensions int `json:"embedding_dimensions,omitempty"`
+	ImageCount          int `json:"image_count,omitempty"`
+	// FileBytes is the size of the files of a multipart upload. AudioSeconds
+	// comes from the transcription response, or is estimated from the
+	// uploaded file when AudioSecondsEstimated is set.
+	FileBytes             int64     `json:"file_bytes,omitempty"`
+	AudioSeconds          float64   `json:"audio_seconds,omitempty"`
+	AudioSecondsEstimated bool      `json:"audio_seconds_estimated,omitempty"`
+	LatencyMs             int64     `json:"latency_ms"`
+	StatusCode            int       `json:"status_code"`
+	At                    time.Time `json:"ts"`
+	// UpstreamTTFBMs is the time from sending the upstream request to its
+	// response headers. For streamed responses TTFTMs is the time from the
+	// request reaching the gateway to the first content chunk, and
+	// StreamDurationMs the time from the upstream headers to the end of the
+	// stream; ChunkCount counts the content chunks and the gaps between
+	// them are summarized by their mean and 95th percentile.
+	UpstreamTTFBMs   int64   `json:"upstream_ttfb_ms,omitempty"`
+	TTFTMs           int64   `json:"ttft_ms,omitempty"`
+	StreamDurationMs int64   `json:"stream_duration_ms,omitempty"`
+	ChunkCount       int     `json:"chunk_count,omitempty"`
+	ChunkGapMeanMs   float64 `json:"chunk_gap_mean_ms,omitempty"`
+	ChunkGapP95Ms    float64 `json:"chunk_gap_p95_ms,omitempty"`
+	// ErrorClass classifies failed requests (see the ErrorClass* constants);
+	// ErrorCode is the code of errors generated by the gateway itself.
+	ErrorClass string `json:"error_class,omitempty"`
+	ErrorCode  string `json:"error_code,omitempty"`
+	// Aborted is set when the upstream call was cut short, by the client
+	// going away, a timeout or the upstream (see the AbortedBy* constants).
+	// Tokens produced until then are counted, estimated when needed.
+	Aborted   bool   `json:"aborted,omitempty"`
+	AbortedBy string `json:"aborted_by,omitempty"`
+	// Attempts lists every upstream call when more than one was made.
+	Attempts []UpstreamAttempt `json:"attempts,omitempty"`
+	// CostUSD is computed from the price catalog; it is omitted when no
+	// price is known for the model.
+	CostUSD             *float64 `json:"cost_usd,omitempty"`
+	PriceCatalogVersion string   `json:"price_catalog_version,omitempty"`
+	// A Realtime session is metered as numbered events sharing the request
+	// ID, each with the usage of the ResponseCount responses since the
+	// previous one; the last has Final set.
+	Sequence      int  `json:"sequence,omitempty"`
+	ResponseCount int  `json:"response_count,omitempty"`
+	Final         bool `json:"final,omitempty"`
 }
 
 type StreamChunk struct {
-	ID    string `json:"id"`
-	Model string `json:"model"`
-	Usage *Usage `json:"usage"`
+	ID      string            `json:"id"`
+	Model   string            `json:"model"`
+	Choices []chatChunkChoice `json:"choices"`
+	Usage   *Usage            `json:"usage"`
+	// Error is set on an error sent in the middle of the stream.
+	Error *upstreamStreamError `json:"error"`
 }
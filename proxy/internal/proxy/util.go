@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"os"
 	"strconv"
@@ -49,6 +51,46 @@ func EnvOrDuration(key string, def time.Duration) time.Duration {
 	return d
 }
 
+func EnvOrBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// EnvOrList parses a comma separated list, ignoring empty items.
+func EnvOrList(key string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// KeyFingerprint returns a stable, non-reversible identifier for a gateway
+// token: HMAC-SHA256 under secret, or plain SHA-256 when no secret is set.
+// The collector derives the same value for legacy events.
+func KeyFingerprint(secret, token string) string {
+	if secret == "" {
+		sum := sha256.Sum256([]byte(token))
+		return "sha256_" + hex.EncodeToString(sum[:16])
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(token))
+	return "hk_" + hex.EncodeToString(m.Sum(nil)[:16])
+}
+
 func BearerToken(auth string) string {
 	auth = strings.TrimSpace(auth)
 	if auth == "" {
@@ -73,6 +115,15 @@ func FirstNonEmpty(vals ...string) string {
 	return ""
 }
 
+func FirstNonZero(vals ...int) int {
+	for _, v := range vals {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
 func IsHopByHopHeader(k string) bool {
 	switch strings.ToLower(strings.TrimSpace(k)) {
 	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization",
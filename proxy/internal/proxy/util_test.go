@@ -21,3 +21,12 @@ func TestIsHopByHopHeader(t *testing.T) {
 	require.True(t, IsHopByHopHeader("Connection"))
 	require.False(t, IsHopByHopHeader("Content-Type"))
 }
+
+func TestKeyFingerprint(t *testing.T) {
+	a := KeyFingerprint("secret", "gw_live_abc")
+	require.Equal(t, a, KeyFingerprint("secret", "gw_live_abc"))
+	require.NotEqual(t, a, KeyFingerprint("other", "gw_live_abc"))
+	require.NotContains(t, a, "gw_live_abc")
+	require.Regexp(t, `^hk_[0-9a-f]{32}$`, a)
+	require.Regexp(t, `^sha256_[0-9a-f]{32}$`, KeyFingerprint("", "gw_live_abc"))
+}